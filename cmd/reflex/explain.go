@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/samfrm/reflex/internal/policy"
+	"github.com/samfrm/reflex/internal/server"
+)
+
+// explainCmd prints the Referer every target should receive, and why,
+// without serving anything.
+func explainCmd(args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	sf := addSessionFlags(fs)
+	_ = fs.Parse(args)
+
+	sessions, err := sf.sessions(0)
+	if err != nil {
+		if errors.Is(err, errNoSites) {
+			fs.Usage()
+		}
+		return err
+	}
+	// The referrer URL a run would open; prepare may still switch to
+	// --fallback-port when the port cannot be bound.
+	o := &runOptions{port: *sf.port, resolverMode: strings.ToLower(*sf.resolver)}
+	for _, s := range sessions {
+		if s.name != "" {
+			fmt.Printf("scenario %s\n", s.name)
+		}
+		for _, site := range s.sites {
+			startURL := o.siteURL(site)
+			p, err := s.predict(site, startURL)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s -> %s\n", startURL, site.Target)
+			fmt.Printf("  method %s, policy %s\n", s.method, p.Policy)
+			fmt.Printf("  Referer: %s\n", quoteOrNone(p.Referer))
+			for _, r := range p.Reasons {
+				fmt.Printf("  - %s\n", r)
+			}
+			if w := portWarning(p.Referer); w != "" {
+				fmt.Printf("  ! %s\n", w)
+			}
+		}
+	}
+	return nil
+}
+
+// predict returns the Referer the target of site should receive when the
+// browser opens startURL. Site overrides of the method and policy win over
+// those of s.
+func (s session) predict(site server.Site, startURL string) (policy.Prediction, error) {
+	ref, err := url.Parse(startURL)
+	if err != nil {
+		return policy.Prediction{}, err
+	}
+	tgt, err := url.Parse(site.Target)
+	if err != nil {
+		return policy.Prediction{}, fmt.Errorf("invalid target %q: %w", site.Target, err)
+	}
+	method, pol := s.method, s.policy
+	if site.Method != "" {
+		method = site.Method
+	}
+	if site.ReferrerPolicy != "" {
+		pol = site.ReferrerPolicy
+	}
+	return policy.Predict(policy.Navigation{
+		Referrer: ref,
+		Target:   tgt,
+		Policy:   pol,
+		Method:   string(method),
+		Rel:      s.rel,
+	}), nil
+}
+
+// logPredictions logs the expected Referer of every site of a.
+func (o *runOptions) logPredictions(a *activeSession) {
+	for _, site := range a.sites {
+		p, err := a.predict(site, o.siteURL(site))
+		if err != nil {
+			continue
+		}
+		log.Printf("expected Referer on %s: %s (%s)", site.Target, quoteOrNone(p.Referer), strings.Join(p.Reasons, "; "))
+		if w := portWarning(p.Referer); w != "" {
+			log.Printf("warning: %s", w)
+		}
+	}
+}
+
+// portWarning explains why a Referer carrying a non-default port breaks
+// origin based attribution, or returns "" when it carries none.
+func portWarning(referer string) string {
+	u, err := url.Parse(referer)
+	if err != nil || u.Port() == "" {
+		return ""
+	}
+	return fmt.Sprintf("the Referer includes port %s, so rules matching the origin %s://%s will not match it; serve on port 443, or keep URLs on it with --port-forward when it is busy", u.Port(), u.Scheme, u.Hostname())
+}
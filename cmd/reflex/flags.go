@@ -0,0 +1,16 @@
+package main
+
+import "strings"
+
+// stringList is a repeatable string flag: --referrer a --referrer b. Values
+// are not split on commas because referrer and target URLs may contain them.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, " ") }
+
+func (l *stringList) Set(v string) error {
+	if v = strings.TrimSpace(v); v != "" {
+		*l = append(*l, v)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/samfrm/reflex/internal/hosts"
+	"github.com/samfrm/reflex/internal/privhelper"
+	"github.com/samfrm/reflex/internal/util"
+)
+
+// helperCmd runs the privileged helper: it edits the hosts file and binds
+// privileged loopback ports for one user's reflex, which then runs
+// without root.
+func helperCmd(args []string) error {
+	fs := flag.NewFlagSet("helper", flag.ExitOnError)
+	socket := fs.String("socket", privhelper.DefaultSocket, "Unix socket to listen on; ignored when systemd passes one")
+	userName := fs.String("user", "", "User name or uid allowed to use the helper (default the user who ran sudo)")
+	hostsPath := fs.String("hosts-file", "", "Override hosts file path (testing)")
+	_ = fs.Parse(args)
+
+	if err := util.RequireRoot(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	uid, err := helperUID(*userName)
+	if err != nil {
+		return err
+	}
+	ln, err := privhelper.Listen(*socket)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", *socket, err)
+	}
+	h := &privhelper.Helper{Hosts: hosts.Manager{Path: hosts.PathOrDefault(*hostsPath)}, UID: uid}
+	log.Printf("helper listening on %s for uid %d; hosts file %s", ln.Addr(), uid, h.Hosts.Path)
+
+	ctx, stop := signalContext()
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	return h.Serve(ln)
+}
+
+// helperUID resolves --user, falling back to $SUDO_UID.
+func helperUID(name string) (int, error) {
+	if name == "" {
+		name = os.Getenv("SUDO_UID")
+	}
+	if name == "" {
+		return 0, errors.New("pass --user: the helper serves one user besides root")
+	}
+	if uid, err := strconv.Atoi(name); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, fmt.Errorf("invalid --user: %w", err)
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// helperSocket returns the helper socket to use: --helper, or the default
+// socket when it exists and reflex is not root. Runs against a --hosts-file
+// edit that file directly.
+func (f *sessionFlags) helperSocket() string {
+	if *f.helper != "" {
+		return *f.helper
+	}
+	if os.Geteuid() != 0 && *f.hostsPath == "" && util.PathExists(privhelper.DefaultSocket) {
+		return privhelper.DefaultSocket
+	}
+	return ""
+}
+
+// hostsEditor edits the hosts file directly or through the helper.
+type hostsEditor interface {
+	Add(ip, domain string) error
+	Remove(domain string) error
+}
+
+func (o *runOptions) hostsEditor() hostsEditor {
+	if o.helper != nil {
+		return o.helper
+	}
+	return hosts.Manager{Path: o.hostsPath}
+}
+
+// inheritSockets takes the listening sockets systemd passed, if any, and
+// serves on those instead of binding --listen.
+func (o *runOptions) inheritSockets() error {
+	files, err := privhelper.SystemdListeners()
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	o.sockets = files
+	o.listen = nil
+	for _, f := range files {
+		ln, err := net.FileListener(f)
+		if err != nil {
+			return fmt.Errorf("socket %s from systemd: %w", f.Name(), err)
+		}
+		addr, ok := ln.Addr().(*net.TCPAddr)
+		ln.Close()
+		if !ok {
+			return fmt.Errorf("socket %s from systemd is not a TCP socket", f.Name())
+		}
+		o.port = addr.Port
+		o.listen = append(o.listen, addr.IP.String())
+	}
+	log.Printf("serving on %d socket(s) passed by systemd", len(files))
+	return nil
+}
+
+// helperListen has the helper bind port on every --listen address.
+func (o *runOptions) helperListen(port int) error {
+	var files []*os.File
+	for _, ip := range o.listen {
+		f, err := o.helper.Listen(net.JoinHostPort(ip, strconv.Itoa(port)))
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return err
+		}
+		files = append(files, f)
+	}
+	o.sockets = files
+	return nil
+}
+
+// listeners returns fresh listeners on the inherited or helper-bound
+// sockets. Each session closes its own, so the sockets outlive it.
+func (o *runOptions) listeners() ([]net.Listener, error) {
+	var out []net.Listener
+	for _, f := range o.sockets {
+		ln, err := net.FileListener(f)
+		if err != nil {
+			for _, l := range out {
+				l.Close()
+			}
+			return nil, err
+		}
+		out = append(out, ln)
+	}
+	return out, nil
+}
+
+// closeSockets releases the inherited or helper-bound sockets and the
+// helper connection.
+func (o *runOptions) closeSockets() {
+	for _, f := range o.sockets {
+		_ = f.Close()
+	}
+	o.sockets = nil
+	if o.helper != nil {
+		_ = o.helper.Close()
+		o.helper = nil
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/samfrm/reflex/internal/hosts"
+	"github.com/samfrm/reflex/internal/util"
+)
+
+// hostsCmd lists and restores the backups reflex takes of the hosts file.
+func hostsCmd(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: reflex hosts <backups|restore <id>> [--hosts-file path]")
+	}
+	sub := args[0]
+	fs := flag.NewFlagSet("hosts "+sub, flag.ExitOnError)
+	hostsPath := fs.String("hosts-file", "", "Override hosts file path (testing)")
+	yes := fs.Bool("yes", false, "Restore without asking for confirmation")
+	_ = fs.Parse(args[1:])
+	// Allow flags after the backup id as well as before it.
+	var ids []string
+	for fs.NArg() > 0 {
+		ids = append(ids, fs.Arg(0))
+		_ = fs.Parse(fs.Args()[1:])
+	}
+	mgr := hosts.Manager{Path: hosts.PathOrDefault(*hostsPath)}
+
+	switch sub {
+	case "backups":
+		list, err := mgr.Backups()
+		if err != nil {
+			return err
+		}
+		if len(list) == 0 {
+			fmt.Printf("no backups of %s\n", mgr.Path)
+			return nil
+		}
+		cur, _ := os.ReadFile(mgr.Path)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tTIME\tSIZE\tFILE")
+		for _, b := range list {
+			file := b.Path
+			if cur != nil && bytes.Equal(cur, readOrNil(b.Path)) {
+				file += " (current)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", b.ID, b.Time.Format("2006-01-02 15:04:05"), b.Size, file)
+		}
+		return tw.Flush()
+	case "restore":
+		if len(ids) != 1 {
+			return fmt.Errorf("usage: reflex hosts restore <id> [--yes] [--hosts-file path]")
+		}
+		if *hostsPath == "" {
+			if err := util.RequireRoot(); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		}
+		b, err := mgr.FindBackup(ids[0])
+		if err != nil {
+			return err
+		}
+		cur, err := os.ReadFile(mgr.Path)
+		if err != nil {
+			return err
+		}
+		backup, err := os.ReadFile(b.Path)
+		if err != nil {
+			return err
+		}
+		diff := hosts.Diff(mgr.Path, b.Path, cur, backup)
+		if diff == "" {
+			fmt.Printf("%s already matches backup %s\n", mgr.Path, b.ID)
+			return nil
+		}
+		fmt.Print(diff)
+		if !*yes && !confirm(fmt.Sprintf("Restore %s from backup %s?", mgr.Path, b.ID)) {
+			return fmt.Errorf("restore cancelled")
+		}
+		if _, err := mgr.Restore(b.ID); err != nil {
+			return err
+		}
+		fmt.Printf("restored %s from backup %s\n", mgr.Path, b.ID)
+		return nil
+	default:
+		return fmt.Errorf("unknown hosts command: %s", sub)
+	}
+}
+
+// readOrNil returns the contents of path, or nil when it cannot be read.
+func readOrNil(path string) []byte {
+	b, _ := os.ReadFile(path)
+	return b
+}
+
+// confirm asks a yes/no question on the terminal; anything but y or yes
+// is no.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
@@ -5,23 +5,23 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
-	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
-	"syscall"
 	"time"
 
-	"github.com/samfrm/reflex/internal/browser"
 	"github.com/samfrm/reflex/internal/certs"
 	"github.com/samfrm/reflex/internal/hosts"
-	"github.com/samfrm/reflex/internal/server"
+	"github.com/samfrm/reflex/internal/portfwd"
+	"github.com/samfrm/reflex/internal/state"
 	"github.com/samfrm/reflex/internal/util"
 )
 
 const (
-	defaultIP           = "127.0.0.1"
+	defaultIPs          = "127.0.0.1,::1"
 	defaultPortTLS      = 443
 	defaultFallbackPort = 8443
 )
@@ -36,30 +36,52 @@ func main() {
 	cmd := os.Args[1]
 	switch cmd {
 	case "run":
-		if err := util.RequireRoot(); err != nil {
-			// Print a clear warning early and exit without extra "error:" noise.
-			fmt.Fprintln(os.Stderr, err.Error())
-			os.Exit(1)
-		}
 		if err := runCmd(os.Args[2:]); err != nil {
 			log.Printf("error: %v", err)
 			os.Exit(1)
 		}
-	case "cleanup":
-		if err := util.RequireRoot(); err != nil {
-			fmt.Fprintln(os.Stderr, err.Error())
+	case "verify":
+		if err := verifyCmd(os.Args[2:]); err != nil {
+			log.Printf("error: %v", err)
 			os.Exit(1)
 		}
+	case "cleanup":
 		if err := cleanupCmd(os.Args[2:]); err != nil {
 			log.Printf("error: %v", err)
 			os.Exit(1)
 		}
 	case "status":
-		if err := util.RequireRoot(); err != nil {
-			fmt.Fprintln(os.Stderr, err.Error())
+		if err := statusCmd(os.Args[2:]); err != nil {
+			log.Printf("error: %v", err)
 			os.Exit(1)
 		}
-		if err := statusCmd(os.Args[2:]); err != nil {
+	case "sweep":
+		if err := sweepCmd(os.Args[2:]); err != nil {
+			log.Printf("error: %v", err)
+			os.Exit(1)
+		}
+	case "explain":
+		if err := explainCmd(os.Args[2:]); err != nil {
+			log.Printf("error: %v", err)
+			os.Exit(1)
+		}
+	case "hosts":
+		if err := hostsCmd(os.Args[2:]); err != nil {
+			log.Printf("error: %v", err)
+			os.Exit(1)
+		}
+	case "presets":
+		if err := presetsCmd(os.Args[2:]); err != nil {
+			log.Printf("error: %v", err)
+			os.Exit(1)
+		}
+	case "helper":
+		if err := helperCmd(os.Args[2:]); err != nil {
+			log.Printf("error: %v", err)
+			os.Exit(1)
+		}
+	case "ca":
+		if err := caCmd(os.Args[2:]); err != nil {
 			log.Printf("error: %v", err)
 			os.Exit(1)
 		}
@@ -84,13 +106,32 @@ Usage:
 
 Commands:
   run       Start HTTPS server, spoof host, open browser
+  verify    Drive headless Chromium through the redirect and assert the Referer
+  sweep     Try every redirect method × referrer policy and report the Referer
+  explain   Predict the Referer each target receives, and why
+  presets   List well-known referrers usable with --preset (list)
   cleanup   Remove host mapping and generated certs
   status    Show current state for a referrer
+  hosts     List and restore hosts file backups (backups|restore <id>)
+  ca        Manage the local certificate authority (init|install|path)
+  helper    Run the privileged helper so run, verify and sweep need no root (Linux)
 
 Examples:
   reflex run --referrer https://news.google.com --target https://example.com
+  reflex run --referrer news.google.com --referrer t.co --target https://example.com
+  reflex run --config scenarios.yaml
+  reflex run --resolver dns --referrer news.google.com --target https://example.com
+  reflex verify --referrer https://news.google.com --target https://example.com --referrer-policy origin
+  reflex sweep --referrer 'https://www.google.com/search?q=shoes' --target https://example.com --format json
+  reflex explain --referrer 'https://www.google.com/search?q=shoes' --target http://example.com --referrer-policy strict-origin
+  reflex run --preset google-search --target https://example.com
+  reflex presets list --notes
   reflex cleanup --referrer news.google.com
   reflex status --referrer news.google.com
+  reflex hosts backups
+  sudo reflex hosts restore 3f9a2c
+  sudo reflex ca install
+  sudo reflex helper --user "$USER"
 
 Use "reflex <command> -h" for command-specific help.
 `)
@@ -99,44 +140,64 @@ Use "reflex <command> -h" for command-specific help.
 
 func runCmd(args []string) error {
 	fs := flag.NewFlagSet("run", flag.ExitOnError)
-	referrer := fs.String("referrer", "", "Referrer URL or hostname (e.g., https://news.google.com)")
-	target := fs.String("target", "", "Target URL to navigate to")
-	ip := fs.String("ip", defaultIP, "IP to map the referrer host to")
-	port := fs.Int("port", defaultPortTLS, "TLS port to serve on (443 requires elevated privileges)")
-	fallbackPort := fs.Int("fallback-port", defaultFallbackPort, "Fallback port if desired port is unavailable")
-	method := fs.String("method", "meta", "Redirect method: meta|302|js (default meta)")
-	refPol := fs.String("referrer-policy", "origin-when-cross-origin", "Referrer-Policy to use (e.g., no-referrer, origin, origin-when-cross-origin, strict-origin-when-cross-origin, unsafe-url)")
-	delay := fs.Int("delay", 1500, "Delay in ms for meta/js redirect methods")
+	sf := addSessionFlags(fs)
     noBrowser := fs.Bool("no-browser", false, "Do not open the browser automatically")
     private := fs.Bool("private", true, "Open browser in incognito/private mode")
-	keepCerts := fs.Bool("keep-certs", false, "Keep generated certificates after exit")
-	noHosts := fs.Bool("no-hosts", false, "Do not modify hosts file (advanced)")
-	hostsPath := fs.String("hosts-file", "", "Override hosts file path (testing)")
-	certDir := fs.String("cert-dir", "", "Directory to write certs to (defaults to temp)")
-	duration := fs.Duration("duration", 0, "Optional auto-shutdown duration (e.g., 5m, 1h)")
-	verbose := fs.Bool("verbose", false, "Verbose logs")
-	forceUnlock := fs.Bool("force-unlock", false, "Forcefully remove an existing lock before starting")
+	duration := fs.Duration("duration", 0, "Optional auto-shutdown duration (e.g., 5m, 1h); per scenario with --config")
 	_ = fs.Parse(args)
+	exitUnlessPrivileged(sf)
 
-	if *referrer == "" || *target == "" {
-		fs.Usage()
-		return fmt.Errorf("missing required flags: --referrer and --target")
+	sessions, err := sf.sessions(*duration)
+	if err != nil {
+		if errors.Is(err, errNoSites) {
+			fs.Usage()
+		}
+		return err
 	}
-
-	if *verbose {
-		util.EnableVerbose()
+	if err := rejectExpect("run", sessions); err != nil {
+		return err
 	}
+	// Catch signals before prepare takes the lock and sets up forwarding,
+	// so an early Ctrl-C still unwinds through the deferred cleanup.
+	ctx, stop := signalContext()
+	defer stop()
+	o, lock, err := sf.prepare()
+	if err != nil {
+		return err
+	}
+	// Ensure release on normal returns
+	defer lock.Release()
+	defer o.close()
+	o.noBrowser, o.private = *noBrowser, *private
 
-	host, herr := util.ExtractHostname(*referrer)
-	if herr != nil {
-		return fmt.Errorf("invalid --referrer: %w", herr)
+	for i, s := range sessions {
+		if ctx.Err() != nil {
+			break
+		}
+		if len(sessions) > 1 {
+			log.Printf("scenario %d/%d: %s", i+1, len(sessions), s.name)
+		}
+		if err := o.serve(ctx, s); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	if !strings.EqualFold(*method, "302") && !strings.EqualFold(*method, "meta") && !strings.EqualFold(*method, "js") {
-		return fmt.Errorf("invalid --method: %s", *method)
+// exitUnlessPrivileged exits when the session flags need root and the
+// process lacks it. The check runs after flag parsing because --resolver dns
+// and --no-hosts make it unnecessary.
+func exitUnlessPrivileged(sf *sessionFlags) {
+	if err := sf.requireRoot(); err != nil {
+		// Print a clear warning early and exit without extra "error:" noise.
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
 	}
+}
 
-	// Preflight: mkcert presence. Do not run `mkcert -install` here; that is a one-time setup.
+// mkcertPreflight checks that mkcert can be used and returns the CAROOT to
+// pin (Linux only). Do not run `mkcert -install` here; that is a one-time setup.
+func mkcertPreflight() (string, error) {
 	if !certs.IsMkcertInstalled() {
 		log.Println("mkcert not found. Install from https://github.com/FiloSottile/mkcert")
 		switch runtime.GOOS {
@@ -147,205 +208,250 @@ func runCmd(args []string) error {
 		case "windows":
 			log.Println("Tip (Windows): choco install mkcert, then run mkcert -install in an elevated shell")
 		}
-		return fmt.Errorf("mkcert is required to create a locally trusted cert for HTTPS referrer emulation")
+		return "", fmt.Errorf("mkcert is required to create a locally trusted cert for HTTPS referrer emulation")
 	}
 	// On Linux we require a shared CAROOT so root and user share the same CA.
 	var pinnedCAROOT string
 	if runtime.GOOS == "linux" {
 		pinnedCAROOT = "/etc/mkcert"
 		if !util.PathExists(pinnedCAROOT) || !util.PathExists(filepath.Join(pinnedCAROOT, "rootCA.pem")) {
-			return fmt.Errorf("missing pinned CAROOT at %s. Run the one-time setup:\n sudo mkcert -install\n  mkcert -install\n  sudo mkdir -p /etc/mkcert\n  sudo cp -a \"$(mkcert -CAROOT)/.\" /etc/mkcert/\n  sudo chmod 755 /etc/mkcert && sudo chmod 644 /etc/mkcert/*\nThen re-run this command with sudo", pinnedCAROOT)
+			return "", fmt.Errorf("missing pinned CAROOT at %s. Run the one-time setup:\n sudo mkcert -install\n  mkcert -install\n  sudo mkdir -p /etc/mkcert\n  sudo cp -a \"$(mkcert -CAROOT)/.\" /etc/mkcert/\n  sudo chmod 755 /etc/mkcert && sudo chmod 644 /etc/mkcert/*\nThen re-run this command with sudo", pinnedCAROOT)
 		}
 	}
+	return pinnedCAROOT, nil
+}
 
-	// Lock to prevent concurrent runs from clobbering hosts
-	if *forceUnlock {
-		_ = util.RemoveLock()
-	}
-	lock, lerr := util.AcquireLock()
-	if lerr != nil {
-		return lerr
-	}
-	// Ensure release on normal returns
-	defer lock.Release()
-
-	// Determine cert directory
-	dir := *certDir
-	if dir == "" {
-		dir = filepath.Join(os.TempDir(), "reflex", host)
-	}
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		log.Fatalf("create cert dir: %v", err)
+func caCmd(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: reflex ca <init|install|path> [--ca-root dir]")
 	}
+	sub := args[0]
+	fs := flag.NewFlagSet("ca "+sub, flag.ExitOnError)
+	caRoot := fs.String("ca-root", certs.DefaultCARoot(), "Directory of the native CA")
+	_ = fs.Parse(args[1:])
 
-	// Setup cleanup signals
-	var addedHost bool
-	cleanup := func() {
-		if addedHost && !*noHosts {
-			_ = hosts.Manager{Path: hosts.PathOrDefault(*hostsPath)}.Remove(host)
+	switch sub {
+	case "path":
+		fmt.Println(*caRoot)
+		return nil
+	case "init", "install":
+		if sub == "install" {
+			if err := util.RequireRoot(); err != nil {
+				return err
+			}
 		}
-		if !*keepCerts {
-			_ = os.RemoveAll(dir)
-		}
-		// Always try to release lock (idempotent)
-		lock.Release()
-	}
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		cleanup()
-		os.Exit(0)
-	}()
-
-	// Hosts modification
-	if !*noHosts {
-		mgr := hosts.Manager{Path: hosts.PathOrDefault(*hostsPath)}
-		if err := mgr.Add(*ip, host); err != nil {
-			if errors.Is(err, hosts.ErrAlreadyPresent) {
-				util.VLog("hosts entry already present")
-			} else {
-				return fmt.Errorf("update hosts: %w", err)
+		ca, created, err := certs.LoadOrCreateCA(*caRoot)
+		if err != nil {
+			return fmt.Errorf("create CA: %w", err)
+		}
+		if created {
+			log.Printf("created reflex CA at %s", ca.Dir)
+			// Under sudo the CA lands in the invoking user's config
+			// directory; it has to stay theirs for runs without root.
+			if err := certs.ChownToSudoUser(ca.Dir); err != nil {
+				return fmt.Errorf("hand the CA to the sudo user: %w", err)
 			}
 		} else {
-			addedHost = true
+			log.Printf("using existing reflex CA at %s", ca.Dir)
 		}
-	} else {
-		util.VLog("--no-hosts enabled; not touching hosts file")
-	}
-
-	// Cert generation via mkcert (CA is ensured already)
-	var certFile, keyFile string
-	var err error
-	if pinnedCAROOT != "" {
-		certFile, keyFile, err = certs.EnsureCertificatesWithCAROOT(host, dir, pinnedCAROOT)
-	} else {
-		certFile, keyFile, err = certs.EnsureCertificates(host, dir)
-	}
-	if err != nil {
-		return fmt.Errorf("generate certificates: %w", err)
-	}
-
-	// Port selection
-	p := *port
-	if !util.CanBind(p) {
-		log.Printf("port %d unavailable; falling back to %d", p, *fallbackPort)
-		p = *fallbackPort
-		if !util.CanBind(p) {
-			return fmt.Errorf("fallback port %d also unavailable", p)
-		}
-	}
-
-	// Start server
-	srv := server.Config{
-		Port:           p,
-		CertFile:       certFile,
-		KeyFile:        keyFile,
-		Method:         server.RedirectMethod(strings.ToLower(*method)),
-		Target:         *target,
-		Delay:          time.Duration(*delay) * time.Millisecond,
-		RefHost:        host,
-		LogVerbose:     *verbose,
-		ReferrerPolicy: *refPol,
-	}
-
-	errCh := make(chan error, 1)
-	go func() { errCh <- server.Run(srv) }()
-
-	// Compose URL and open browser
-	url := fmt.Sprintf("https://%s", host)
-	if p != 443 {
-		url = fmt.Sprintf("%s:%d", url, p)
-	}
-	log.Printf("serving spoofed referrer at %s", url)
-	if strings.EqualFold(*method, "302") {
-		log.Printf("Heads-up: 302 redirects from an external open may yield empty document.referrer in some browsers. For consistent results, use --method meta or --method js.")
-	}
-    if !*noBrowser {
-        if err := browser.Open(url, *private); err != nil {
-            log.Printf("open browser: %v", err)
-            log.Printf("Please open this URL manually: %s. (private-mode recommended)", url)
-        }
-    } else {
-        log.Printf("Open this URL in your browser: %s. (private-mode recommended)", url)
-    }
-
-	if *duration > 0 {
-		log.Printf("auto-shutdown after %s", *duration)
-		select {
-		case <-time.After(*duration):
-			cleanup()
+		if sub == "init" {
 			return nil
-		case err := <-errCh:
-			cleanup()
-			return fmt.Errorf("server error: %w", err)
 		}
+		if err := certs.InstallCA(ca); err != nil {
+			return fmt.Errorf("install CA: %w", err)
+		}
+		log.Printf("installed %s into the system trust store", ca.CertPath())
+		return nil
+	default:
+		return fmt.Errorf("unknown ca command: %s", sub)
 	}
-
-	// Block until server exits or signal triggers cleanup
-	if err := <-errCh; err != nil {
-		cleanup()
-		return fmt.Errorf("server error: %w", err)
-	}
-	cleanup()
-	return nil
 }
 
 func cleanupCmd(args []string) error {
 	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
-	referrer := fs.String("referrer", "", "Referrer host or URL whose mapping to remove")
+	var referrers stringList
+	fs.Var(&referrers, "referrer", "Referrer host or URL whose mapping to remove; repeatable")
 	hostsPath := fs.String("hosts-file", "", "Override hosts file path (testing)")
-	certDir := fs.String("cert-dir", "", "Certificate directory to remove (default temp per referrer)")
+	certDir := fs.String("cert-dir", "", "Certificate directory to remove (default the one the session recorded)")
 	keepCerts := fs.Bool("keep-certs", false, "Keep certificates; only remove hosts mapping")
-	all := fs.Bool("all", false, "Remove all reflex-managed hosts entries, all temp certs, and the lock")
+	all := fs.Bool("all", false, "Remove all reflex-managed hosts entries and port forwarding rules, all session records and certs, and the lock")
 	_ = fs.Parse(args)
 
-	if *referrer == "" && !*all {
+	if len(referrers) == 0 && !*all {
 		fs.Usage()
 		return fmt.Errorf("specify --referrer or --all")
 	}
 	mgr := hosts.Manager{Path: hosts.PathOrDefault(*hostsPath)}
+	sessions, err := state.Sessions()
+	if err != nil {
+		log.Printf("read session records: %v", err)
+	}
 
 	if *all {
-		n, err := mgr.RemoveAllTagged()
+		// Root is needed only for what the user cannot change.
+		paths := []string{mgr.Path}
+		forwarded := false
+		for _, rec := range sessions {
+			if rec.HostsFile != "" && *hostsPath == "" && rec.Mine() {
+				paths = appendNew(paths, rec.HostsFile)
+			}
+			forwarded = forwarded || rec.PublicPort != 0
+		}
+		for _, path := range paths {
+			if err := requireRootToEdit(path, ""); err != nil {
+				return err
+			}
+		}
+		if forwarded || len(portfwd.Rules()) > 0 {
+			if err := util.RequireRoot(); err != nil {
+				return fmt.Errorf("a session forwarded its port, and removing firewall rules needs root: %w", err)
+			}
+		}
+		for i := range sessions {
+			rec := &sessions[i]
+			if !rec.Mine() {
+				log.Printf("session %d ran as uid %d; run reflex cleanup as that user to remove its files", rec.PID, rec.UID)
+				continue
+			}
+			if rec.Running() {
+				log.Printf("session %d is still running; removing its state anyway", rec.PID)
+			}
+			// Entries in a hosts file other than ours are only known from
+			// the record.
+			if rec.HostsFile != "" && *hostsPath == "" && rec.HostsFile != mgr.Path {
+				other := hosts.Manager{Path: rec.HostsFile}
+				for _, host := range rec.Hosts {
+					_ = other.Remove(host)
+				}
+			}
+			if !*keepCerts && !rec.KeepCerts {
+				for _, dir := range rec.CertDirs {
+					if err := state.RemoveCerts(dir); err != nil {
+						log.Printf("left certs: %v", err)
+					}
+				}
+			}
+			_ = rec.Remove()
+		}
+		// Leave a hosts file without entries alone; it may not be ours
+		// to write.
+		lines, err := mgr.Managed()
+		n := 0
+		if err == nil && len(lines) > 0 {
+			n, err = mgr.RemoveAllTagged()
+		}
 		if err != nil {
 			log.Printf("remove hosts entries: %v", err)
 		} else {
 			log.Printf("removed %d hosts entrie(s)", n)
 		}
 		if !*keepCerts {
-			base := filepath.Join(os.TempDir(), "reflex")
-			if err := os.RemoveAll(base); err != nil {
-				log.Printf("remove certs base: %v", err)
-			} else {
-				log.Printf("removed certs base at %s", base)
+			for _, base := range []string{state.CertsDir(), state.LegacyCertsDir()} {
+				if err := state.RemoveCerts(base); err != nil {
+					log.Printf("remove certs base: %v", err)
+				} else {
+					log.Printf("removed certs base at %s", base)
+				}
 			}
 		}
+		if n, err := portfwd.RemoveAll(); err != nil {
+			log.Printf("remove port forwarding rules: %v", err)
+		} else if n > 0 {
+			log.Printf("removed %d port forwarding rule(s)", n)
+		}
 		if err := util.RemoveLock(); err == nil {
 			log.Printf("removed lock file")
 		}
 		return nil
 	}
 
-	host, err := util.ExtractHostname(*referrer)
-	if err != nil {
-		return fmt.Errorf("invalid --referrer: %w", err)
-	}
-	if err := mgr.Remove(host); err != nil {
-		log.Printf("remove hosts entry: %v", err)
-	} else {
-		log.Printf("removed hosts entry for %s", host)
-	}
+	var names []string
+	for _, referrer := range referrers {
+		host, err := util.ExtractHostname(referrer)
+		if err != nil {
+			return fmt.Errorf("invalid --referrer %q: %w", referrer, err)
+		}
+		host = strings.ToLower(host)
+		for _, path := range cleanupHostsFiles(mgr.Path, *hostsPath != "", sessions, host) {
+			if err := requireRootToEdit(path, host); err != nil {
+				return err
+			}
+		}
+		names = append(names, host)
+	}
+
+	for _, host := range names {
+		// The sessions that served host know its hosts file and
+		// certificates; without one, fall back to the defaults.
+		var recs []*state.Session
+		for i := range sessions {
+			switch rec := &sessions[i]; {
+			case !rec.Has(host):
+			case !rec.Mine():
+				log.Printf("session %d serving %s ran as uid %d; run reflex cleanup as that user to remove its files", rec.PID, host, rec.UID)
+			default:
+				recs = append(recs, rec)
+			}
+		}
+		paths := cleanupHostsFiles(mgr.Path, *hostsPath != "", sessions, host)
+		dirs := []string{state.CertDir(host), filepath.Join(state.LegacyCertsDir(), host)}
+		for _, rec := range recs {
+			if rec.Running() {
+				log.Printf("session %d serving %s is still running", rec.PID, host)
+			}
+			if !rec.KeepCerts {
+				dirs = appendNew(dirs, rec.CertDir(host))
+			}
+		}
+		// Mirror the layout used by run for --cert-dir.
+		switch {
+		case *certDir != "" && len(names) > 1:
+			dirs = []string{filepath.Join(*certDir, host)}
+		case *certDir != "":
+			dirs = []string{*certDir}
+		}
 
-	if !*keepCerts {
-		dir := *certDir
-		if dir == "" {
-			dir = filepath.Join(os.TempDir(), "reflex", host)
+		for _, path := range paths {
+			if entries, err := (hosts.Manager{Path: path}).Entries(host); err == nil && len(entries) == 0 {
+				continue
+			}
+			if err := (hosts.Manager{Path: path}).Remove(host); err != nil {
+				log.Printf("remove hosts entry: %v", err)
+			} else {
+				log.Printf("removed hosts entry for %s from %s", host, path)
+			}
 		}
-		if err := os.RemoveAll(dir); err != nil {
-			log.Printf("remove certs: %v", err)
-		} else {
-			log.Printf("removed certs at %s", dir)
+		if !*keepCerts {
+			for _, dir := range dirs {
+				if !util.PathExists(dir) {
+					continue
+				}
+				// Only a directory named by --cert-dir may be outside the
+				// state directory; recorded ones are not trusted that far.
+				remove := state.RemoveCerts
+				if *certDir != "" {
+					remove = os.RemoveAll
+				}
+				if err := remove(dir); err != nil {
+					log.Printf("remove certs: %v", err)
+				} else {
+					log.Printf("removed certs at %s", dir)
+				}
+			}
+		}
+		for _, rec := range recs {
+			if rec.Running() {
+				continue
+			}
+			rec.Drop(host)
+			if len(rec.Hosts) == 0 {
+				err = rec.Remove()
+			} else {
+				err = rec.Save()
+			}
+			if err != nil {
+				log.Printf("update session record: %v", err)
+			}
 		}
 	}
 	if err := util.RemoveLock(); err == nil {
@@ -354,6 +460,60 @@ func cleanupCmd(args []string) error {
 	return nil
 }
 
+// cleanupHostsFiles returns the hosts files that may hold entries for host:
+// the given one and, unless it was overridden, those the user's own
+// sessions serving host recorded.
+func cleanupHostsFiles(path string, overridden bool, sessions []state.Session, host string) []string {
+	paths := []string{path}
+	for _, rec := range sessions {
+		if !overridden && rec.Has(host) && rec.HostsFile != "" && rec.Mine() {
+			paths = appendNew(paths, rec.HostsFile)
+		}
+	}
+	return paths
+}
+
+// requireRootToEdit fails when path holds reflex entries for host, or any
+// reflex entries when host is empty, and only root may write it.
+func requireRootToEdit(path, host string) error {
+	mgr := hosts.Manager{Path: path}
+	var lines []hosts.Line
+	var err error
+	if host == "" {
+		lines, err = mgr.Managed()
+	} else {
+		lines, err = mgr.Entries(host)
+	}
+	if err != nil || len(lines) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err == nil {
+		f.Close()
+		return nil
+	}
+	if !errors.Is(err, os.ErrPermission) {
+		return nil
+	}
+	if err := util.RequireRoot(); err != nil {
+		return fmt.Errorf("removing the reflex entries in %s needs root: %w", path, err)
+	}
+	return nil
+}
+
+// appendNew appends s to list unless it is empty or already there.
+func appendNew(list []string, s string) []string {
+	if s == "" {
+		return list
+	}
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
 func statusCmd(args []string) error {
 	fs := flag.NewFlagSet("status", flag.ExitOnError)
 	referrer := fs.String("referrer", "", "Referrer host or URL to check")
@@ -368,26 +528,75 @@ func statusCmd(args []string) error {
 	if err != nil {
 		return fmt.Errorf("invalid --referrer: %w", err)
 	}
+	host = strings.ToLower(host)
 
-	mgr := hosts.Manager{Path: hosts.PathOrDefault(*hostsPath)}
-	present, line, err := mgr.Contains(host)
+	recs, err := state.ForHost(host)
+	if err != nil {
+		log.Printf("read session records: %v", err)
+	}
+	path := hosts.PathOrDefault(*hostsPath)
+	certDir := state.CertDir(host)
+	for _, rec := range recs {
+		run := "running"
+		if !rec.Running() {
+			run = "not running; reflex cleanup --referrer " + host + " removes what it left"
+		}
+		fmt.Printf("session: pid %d (%s), started %s\n", rec.PID, run, rec.Started.Local().Format(time.DateTime))
+		port := strconv.Itoa(rec.Port)
+		if rec.PublicPort != 0 {
+			port = fmt.Sprintf("%d forwarded to %d", rec.PublicPort, rec.Port)
+		}
+		fmt.Printf("  referrers %s; ips %s; port %s; resolver %s\n", strings.Join(rec.Referrers, ", "), strings.Join(rec.IPs, ", "), port, rec.Resolver)
+		for _, line := range rec.HostsLines {
+			fmt.Printf("  hosts line added: %s\n", line)
+		}
+		if d := rec.CertDir(host); d != "" {
+			certDir = d
+		}
+		if rec.HostsFile != "" && *hostsPath == "" {
+			path = rec.HostsFile
+		}
+	}
+	if len(recs) == 0 {
+		fmt.Println("session: none recorded")
+	}
+
+	mgr := hosts.Manager{Path: path}
+	entries, err := mgr.Entries(host)
 	if err != nil {
 		return fmt.Errorf("read hosts: %w", err)
 	}
-	if present {
-		fmt.Printf("hosts entry present: %s\n", strings.TrimSpace(line))
-	} else {
-		fmt.Println("hosts entry not present")
+	for _, family := range []string{"IPv4", "IPv6"} {
+		line := ""
+		for _, e := range entries {
+			if (net.ParseIP(e.IP).To4() != nil) == (family == "IPv4") {
+				line = strings.TrimSpace(e.Raw)
+				break
+			}
+		}
+		if line != "" {
+			fmt.Printf("hosts entry present (%s): %s\n", family, line)
+		} else {
+			fmt.Printf("hosts entry not present (%s)\n", family)
+		}
 	}
 
-	dir := filepath.Join(os.TempDir(), "reflex", host)
-	if util.PathExists(filepath.Join(dir, "cert.pem")) && util.PathExists(filepath.Join(dir, "key.pem")) {
-		fmt.Printf("certs present: %s\n", dir)
+	if util.PathExists(filepath.Join(certDir, "cert.pem")) && util.PathExists(filepath.Join(certDir, "key.pem")) {
+		fmt.Printf("certs present: %s\n", certDir)
 	} else {
 		fmt.Println("certs not present")
 	}
-	if util.PathExists(filepath.Join(os.TempDir(), "reflex.lock")) {
-		fmt.Println("lock: present")
+	for _, rule := range portfwd.Rules() {
+		fmt.Printf("port forwarding: %s\n", rule)
+	}
+	lock := ""
+	for _, dir := range state.RunDirs() {
+		if p := filepath.Join(dir, filepath.Base(state.LockPath())); util.PathExists(p) {
+			lock = p
+		}
+	}
+	if lock != "" {
+		fmt.Printf("lock: present (%s)\n", lock)
 	} else {
 		fmt.Println("lock: not present")
 	}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/samfrm/reflex/internal/presets"
+)
+
+// presetsCmd lists the well-known referrers --preset accepts.
+func presetsCmd(args []string) error {
+	if len(args) == 0 || args[0] != "list" {
+		return fmt.Errorf("usage: reflex presets list [--notes]")
+	}
+	fs := flag.NewFlagSet("presets list", flag.ExitOnError)
+	notes := fs.Bool("notes", false, "Add a column explaining each preset")
+	_ = fs.Parse(args[1:])
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := "NAME\tREFERRER\tMETHOD\tPOLICY\tCLICK ID"
+	if *notes {
+		header += "\tNOTES"
+	}
+	fmt.Fprintln(tw, header)
+	for _, p := range presets.All() {
+		method := string(p.Method)
+		if p.NewWindow {
+			method += " (new window)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s", p.Name, p.Referrer, method, p.Policy, orDash(p.ClickID))
+		if *notes {
+			fmt.Fprintf(tw, "\t%s", p.Notes)
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
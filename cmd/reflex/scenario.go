@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/samfrm/reflex/internal/scenario"
+	"github.com/samfrm/reflex/internal/server"
+	"github.com/samfrm/reflex/internal/tracking"
+	"github.com/samfrm/reflex/internal/util"
+)
+
+// selectScenarios keeps the scenarios named in only, in file order. An empty
+// filter keeps everything.
+func selectScenarios(list []scenario.Scenario, only []string) ([]scenario.Scenario, error) {
+	if len(only) == 0 {
+		return list, nil
+	}
+	want := make(map[string]bool, len(only))
+	for _, n := range only {
+		want[n] = true
+	}
+	var out []scenario.Scenario
+	for _, s := range list {
+		if want[s.Name] {
+			out = append(out, s)
+			delete(want, s.Name)
+		}
+	}
+	if len(want) > 0 {
+		var missing []string
+		for n := range want {
+			missing = append(missing, n)
+		}
+		sort.Strings(missing)
+		return nil, fmt.Errorf("--only: no scenario named %s", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
+// scenarioSessions turns validated scenarios into run sessions. Fields a
+// scenario leaves empty take the run flag values in defaults.
+func scenarioSessions(list []scenario.Scenario, defaults session) ([]session, error) {
+	out := make([]session, 0, len(list))
+	for _, sc := range list {
+		s := defaults
+		s.name = sc.Name
+		s.expect = sc.Expect
+		if sc.Method != "" {
+			s.method = server.RedirectMethod(strings.ToLower(sc.Method))
+		}
+		if sc.ReferrerPolicy != "" {
+			s.policy = sc.ReferrerPolicy
+		}
+		if sc.Rel != "" {
+			s.rel = strings.ToLower(sc.Rel)
+		}
+		if sc.NewWindow != nil {
+			s.newWindow = *sc.NewWindow
+		}
+		if sc.Template != "" {
+			t, err := server.ParseTemplate(sc.Template)
+			if err != nil {
+				return nil, fmt.Errorf("scenario %s: %w", sc.Name, err)
+			}
+			s.template = t
+		}
+		if sc.Delay.Set {
+			s.delay = sc.Delay.Duration
+		}
+		switch {
+		case sc.Duration.Set:
+			s.duration = sc.Duration.Duration
+		case s.duration == 0:
+			s.duration = scenario.DefaultDuration
+		}
+		switch strings.ToLower(sc.ClickID) {
+		case "auto":
+			s.autoClick = true
+		case "none":
+			s.autoClick = false
+		}
+		if len(sc.Params) > 0 {
+			keys := make([]string, 0, len(sc.Params))
+			for k := range sc.Params {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			s.params = append([]tracking.Param(nil), s.params...)
+			for _, k := range keys {
+				s.params = append(s.params, tracking.Param{Key: k, Value: sc.Params[k]})
+			}
+		}
+		// Referrers were validated by scenario.Load.
+		u, _ := util.ParseReferrer(sc.Referrer)
+		target, err := s.decorate(sc.Target, u.Hostname())
+		if err != nil {
+			return nil, fmt.Errorf("scenario %s: %w", sc.Name, err)
+		}
+		s.sites = []server.Site{{Host: u.Hostname(), Path: u.RequestURI(), Target: target}}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// rejectExpect refuses scenarios with an expect block. Only verify checks
+// expectations; anything else would accept them and check nothing.
+func rejectExpect(cmd string, sessions []session) error {
+	var names []string
+	for _, s := range sessions {
+		if !s.expect.IsZero() {
+			names = append(names, s.name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return fmt.Errorf("scenario %s sets expect, which only reflex verify checks; use verify or remove expect to %s it", strings.Join(names, ", "), cmd)
+}
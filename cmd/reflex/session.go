@@ -0,0 +1,990 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/samfrm/reflex/internal/browser"
+	"github.com/samfrm/reflex/internal/capture"
+	"github.com/samfrm/reflex/internal/certs"
+	"github.com/samfrm/reflex/internal/dns"
+	"github.com/samfrm/reflex/internal/hosts"
+	"github.com/samfrm/reflex/internal/policy"
+	"github.com/samfrm/reflex/internal/portfwd"
+	"github.com/samfrm/reflex/internal/presets"
+	"github.com/samfrm/reflex/internal/privhelper"
+	"github.com/samfrm/reflex/internal/scenario"
+	"github.com/samfrm/reflex/internal/server"
+	"github.com/samfrm/reflex/internal/state"
+	"github.com/samfrm/reflex/internal/tracking"
+	"github.com/samfrm/reflex/internal/util"
+)
+
+// errNoSites is returned by sessionFlags.sessions when neither referrers
+// nor a scenario file were given.
+var errNoSites = errors.New("missing required flags: --referrer (or --preset) and --target (or --config)")
+
+// sessionFlags are the flags shared by commands that serve spoofed
+// referrers: what to serve, how to redirect, and hosts/cert handling.
+type sessionFlags struct {
+	fs                       *flag.FlagSet
+	referrers, targets, only stringList
+	preset                   *string
+
+	config       *string
+	ip           *string
+	helper       *string
+	listen       *string
+	allow        *string
+	port         *int
+	fallbackPort *int
+	portForward  *string
+	method       *string
+	rel          *string
+	newWindow    *bool
+	template     *string
+	refPol       *string
+	delay        *int
+	keepCerts    *bool
+	noHosts      *bool
+	hostsPath    *string
+	certDir      *string
+	verbose      *bool
+	forceUnlock  *bool
+	certBackend  *string
+	caRoot       *string
+	resolver     *string
+	dnsListen    *string
+	dnsUpstream  *string
+	logFile      *string
+	sink         *bool
+	sinkListen   *string
+	// Tracking parameters set on every target.
+	utm       [5]*string
+	clickIDs  [3]*string
+	params    stringList
+	autoClick *bool
+}
+
+// utmNames and clickIDNames are the parameters behind the --utm-* and
+// click ID flags, in the order they are added to targets.
+var (
+	utmNames     = [5]string{"utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content"}
+	clickIDNames = [3]string{"gclid", "fbclid", "msclkid"}
+)
+
+func addSessionFlags(fs *flag.FlagSet) *sessionFlags {
+	f := &sessionFlags{fs: fs}
+	fs.Var(&f.referrers, "referrer", "Referrer URL or hostname (e.g., https://news.google.com); repeatable")
+	f.preset = fs.String("preset", "", "Well-known referrer to emulate instead of --referrer ("+strings.Join(presets.Names(), ", ")+"); sets its URL, method, policy and link attributes unless given")
+	fs.Var(&f.targets, "target", "Target URL to navigate to; repeat to pair one target per --referrer")
+	f.helper = fs.String("helper", "", "Path of the Unix socket of a running reflex helper that edits the hosts file and binds privileged ports, so reflex needs no root (Linux; used automatically at "+privhelper.DefaultSocket+" when not root)")
+	f.ip = fs.String("ip", defaultIPs, "Comma separated IPs to map the referrer host to; the default covers IPv4 and IPv6 loopback")
+	f.listen = fs.String("listen", "", "Comma separated IPs to listen on (default the --ip addresses); 0.0.0.0,:: listens on every interface")
+	f.allow = fs.String("allow", "", "Comma separated client IPs or CIDR networks allowed besides loopback; others get 403 (default any client that reaches --listen)")
+	f.port = fs.Int("port", defaultPortTLS, "TLS port to serve on (443 requires elevated privileges)")
+	f.fallbackPort = fs.Int("fallback-port", defaultFallbackPort, "Fallback port if desired port is unavailable")
+	f.portForward = fs.String("port-forward", "off", "When falling back, keep URLs on --port by forwarding it to the fallback port: off, "+strings.Join(portfwd.Methods, ", ")+" (firewall rules; Linux and root only)")
+	f.method = fs.String("method", "meta", "Redirect method: "+server.MethodNames("|")+" (default meta)")
+	f.rel = fs.String("rel", "", "Link relation for click, form-* and window-open, e.g. noreferrer or \"noopener noreferrer\"")
+	f.newWindow = fs.Bool("new-window", false, "Open the target in a new tab (target=_blank) for click and form-*")
+	f.template = fs.String("template", "", "Landing page template for the page based methods: a built-in ("+strings.Join(server.TemplateNames(), ", ")+") or the path of an html/template file, which must contain a slash or end in .html (./search is the file, search the built-in)")
+	f.refPol = fs.String("referrer-policy", "origin-when-cross-origin", "Referrer-Policy to use (e.g., no-referrer, origin, origin-when-cross-origin, strict-origin-when-cross-origin, unsafe-url)")
+	f.delay = fs.Int("delay", 1500, "Delay in ms before page based redirect methods navigate")
+	f.keepCerts = fs.Bool("keep-certs", false, "Keep generated certificates after exit")
+	f.noHosts = fs.Bool("no-hosts", false, "Do not modify hosts file (advanced)")
+	f.hostsPath = fs.String("hosts-file", "", "Override hosts file path (testing)")
+	f.certDir = fs.String("cert-dir", "", "Directory to write certs to (defaults to temp)")
+	f.verbose = fs.Bool("verbose", false, "Verbose logs")
+	f.forceUnlock = fs.Bool("force-unlock", false, "Forcefully remove an existing lock before starting")
+	f.certBackend = fs.String("certs", string(certs.BackendNative), "Certificate backend: native|mkcert")
+	f.caRoot = fs.String("ca-root", "", "Directory of the native CA (defaults to "+certs.DefaultCARoot()+")")
+	f.resolver = fs.String("resolver", resolverHosts, "How the referrer host resolves to --ip: hosts (edit the hosts file), dns (built-in DNS responder) or browser (isolated Chromium with host-resolver rules); only hosts needs root")
+	f.dnsListen = fs.String("dns-listen", defaultDNSListen, "Address of the built-in DNS responder with --resolver dns")
+	f.dnsUpstream = fs.String("dns-upstream", "", "Resolver (host:port) to forward other names to with --resolver dns; refused when empty")
+	f.logFile = fs.String("log-file", "", "Append a JSON line per request received by the referrer server to this file (\"-\" for stdout)")
+	f.sink = fs.Bool("sink", false, "Serve a local stand-in target at "+sinkHost+" that records Referer, document.referrer, UTM parameters and cookies; --target defaults to it")
+	f.sinkListen = fs.String("sink-listen", defaultSinkListen, "Address of the --sink target")
+	for i, name := range utmNames {
+		flagName := strings.ReplaceAll(name, "_", "-")
+		f.utm[i] = fs.String(flagName, "", "Set "+name+" on the target URL")
+	}
+	for i, name := range clickIDNames {
+		f.clickIDs[i] = fs.String(name, "", "Set the "+name+" click ID on the target URL")
+	}
+	fs.Var(&f.params, "param", "Set a query parameter on the target URL as key=value, overriding one already there; repeatable")
+	f.autoClick = fs.Bool("auto-click-id", false, "Add a random click ID of the kind the referrer's ads use (gclid for Google, fbclid for Facebook, msclkid for Bing, ...)")
+	f.config = fs.String("config", "", "Scenario file (YAML or JSON) to use instead of --referrer/--target; only verify accepts scenarios with expect")
+	fs.Var(&f.only, "only", "With --config, use only the named scenarios; repeatable")
+	return f
+}
+
+// Values of --resolver.
+const (
+	resolverHosts   = "hosts"
+	resolverDNS     = "dns"
+	resolverBrowser = "browser"
+)
+
+const defaultDNSListen = "127.0.0.1:5300"
+
+// requireRoot reports an error when the flags need privileges the process
+// lacks. Only editing the hosts file does; ports below 1024 fall back to
+// --fallback-port when they cannot be bound.
+func (f *sessionFlags) requireRoot() error {
+	if *f.noHosts || !strings.EqualFold(*f.resolver, resolverHosts) || f.helperSocket() != "" {
+		return nil
+	}
+	return util.RequireRoot()
+}
+
+// isSet reports whether the flag called name was given on the command line.
+func (f *sessionFlags) isSet(name string) bool {
+	set := false
+	f.fs.Visit(func(fl *flag.Flag) {
+		if fl.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// sessions builds the sessions to serve from a scenario file or from the
+// referrer/target flags. duration is the default serving time per session.
+func (f *sessionFlags) sessions(duration time.Duration) ([]session, error) {
+	if *f.verbose {
+		util.EnableVerbose()
+	}
+	defaults := session{
+		method:    server.RedirectMethod(strings.ToLower(*f.method)),
+		policy:    *f.refPol,
+		rel:       strings.ToLower(*f.rel),
+		newWindow: *f.newWindow,
+		delay:     time.Duration(*f.delay) * time.Millisecond,
+		duration:  duration,
+		autoClick: *f.autoClick,
+	}
+	for i, v := range f.utm {
+		if *v != "" {
+			defaults.params = append(defaults.params, tracking.Param{Key: utmNames[i], Value: *v})
+		}
+	}
+	for i, v := range f.clickIDs {
+		if *v != "" {
+			defaults.params = append(defaults.params, tracking.Param{Key: clickIDNames[i], Value: *v})
+		}
+	}
+	for _, kv := range f.params {
+		p, err := tracking.ParseParam(kv)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --param: %w", err)
+		}
+		defaults.params = append(defaults.params, p)
+	}
+	if err := policy.Validate(*f.refPol); err != nil {
+		return nil, fmt.Errorf("invalid --referrer-policy: %w", err)
+	}
+	if *f.template != "" {
+		t, err := server.ParseTemplate(*f.template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --template: %w", err)
+		}
+		defaults.template = t
+	}
+
+	referrers := f.referrers
+	if *f.preset != "" {
+		if *f.config != "" || len(referrers) > 0 {
+			return nil, fmt.Errorf("--preset cannot be combined with --referrer or --config (scenarios take a preset field)")
+		}
+		p, ok := presets.Lookup(*f.preset)
+		if !ok {
+			return nil, fmt.Errorf("unknown --preset: %s (want %s)", *f.preset, strings.Join(presets.Names(), ", "))
+		}
+		referrers = stringList{p.Referrer}
+		if !f.isSet("method") {
+			defaults.method = p.Method
+		}
+		if !f.isSet("referrer-policy") {
+			defaults.policy = p.Policy
+		}
+		if !f.isSet("rel") {
+			defaults.rel = p.Rel
+		}
+		if !f.isSet("new-window") {
+			defaults.newWindow = p.NewWindow
+		}
+		defaults.params = append(presetParams(p), defaults.params...)
+	}
+
+	if *f.config != "" {
+		if len(referrers) > 0 || len(f.targets) > 0 {
+			return nil, fmt.Errorf("--config cannot be combined with --referrer/--target")
+		}
+		list, err := scenario.Load(*f.config)
+		if err != nil {
+			return nil, err
+		}
+		if list, err = selectScenarios(list, f.only); err != nil {
+			return nil, err
+		}
+		return scenarioSessions(list, defaults)
+	}
+
+	targets := f.targets
+	if *f.sink && len(targets) == 0 {
+		targets = stringList{sinkURL(*f.sinkListen)}
+	}
+	if len(referrers) == 0 || len(targets) == 0 {
+		return nil, errNoSites
+	}
+	if len(targets) != 1 && len(targets) != len(referrers) {
+		return nil, fmt.Errorf("got %d --target values for %d --referrer values; pass one target or one per referrer", len(targets), len(referrers))
+	}
+	if !defaults.method.Valid() {
+		return nil, fmt.Errorf("invalid --method: %s (want %s)", *f.method, server.MethodNames(", "))
+	}
+	if err := server.ValidRel(*f.rel); err != nil {
+		return nil, fmt.Errorf("invalid --rel: %w", err)
+	}
+	if defaults.template != nil && defaults.method.StatusCode() != 0 {
+		return nil, fmt.Errorf("--template needs a page based --method; %s redirects serve no page", defaults.method)
+	}
+	s := defaults
+	seen := make(map[string]bool)
+	for i, r := range referrers {
+		u, err := util.ParseReferrer(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --referrer %q: %w", r, err)
+		}
+		h := u.Hostname()
+		if seen[h] {
+			return nil, fmt.Errorf("duplicate --referrer host: %s", h)
+		}
+		seen[h] = true
+		t := targets[0]
+		if len(targets) > 1 {
+			t = targets[i]
+		}
+		if _, err := util.ParseTarget(t); err != nil {
+			return nil, fmt.Errorf("invalid --target: %w", err)
+		}
+		if t, err = s.decorate(t, h); err != nil {
+			return nil, fmt.Errorf("invalid --target: %w", err)
+		}
+		s.sites = append(s.sites, server.Site{Host: h, Path: u.RequestURI(), Target: t})
+	}
+	return []session{s}, nil
+}
+
+// prepare checks the certificate backend, takes the global lock and picks
+// the port. The caller must release the returned lock.
+func (f *sessionFlags) prepare() (*runOptions, *util.Lock, error) {
+	backend := certs.Backend(strings.ToLower(*f.certBackend))
+	if backend != certs.BackendNative && backend != certs.BackendMkcert {
+		return nil, nil, fmt.Errorf("invalid --certs: %s (want native or mkcert)", *f.certBackend)
+	}
+	forward := strings.ToLower(*f.portForward)
+	if forward != "off" && !portfwd.Valid(forward) {
+		return nil, nil, fmt.Errorf("invalid --port-forward: %s (want off, %s)", *f.portForward, strings.Join(portfwd.Methods, ", "))
+	}
+	ips, err := util.ParseIPs(*f.ip)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid --ip: %w", err)
+	}
+	var listen []string
+	if *f.listen != "" {
+		if listen, err = util.ParseIPs(*f.listen); err != nil {
+			return nil, nil, fmt.Errorf("invalid --listen: %w", err)
+		}
+	}
+	var allow []*net.IPNet
+	if *f.allow != "" {
+		if allow, err = util.ParseNets(*f.allow); err != nil {
+			return nil, nil, fmt.Errorf("invalid --allow: %w", err)
+		}
+	}
+	o := &runOptions{
+		noHosts:   *f.noHosts,
+		hostsPath: hosts.PathOrDefault(*f.hostsPath),
+		certDir:   *f.certDir,
+		keepCerts: *f.keepCerts,
+		verbose:   *f.verbose,
+		allow:     allow,
+	}
+	o.resolverMode = strings.ToLower(*f.resolver)
+	switch o.resolverMode {
+	case resolverHosts:
+	case resolverBrowser:
+		o.noHosts = true
+	case resolverDNS:
+		if _, _, err := net.SplitHostPort(*f.dnsListen); err != nil {
+			return nil, nil, fmt.Errorf("invalid --dns-listen: %w", err)
+		}
+		if *f.dnsUpstream != "" {
+			if _, _, err := net.SplitHostPort(*f.dnsUpstream); err != nil {
+				return nil, nil, fmt.Errorf("invalid --dns-upstream: %w", err)
+			}
+		}
+		o.noHosts = true
+		o.dnsListen, o.dnsUpstream = *f.dnsListen, *f.dnsUpstream
+	default:
+		return nil, nil, fmt.Errorf("invalid --resolver: %s (want hosts, dns or browser)", *f.resolver)
+	}
+	if backend == certs.BackendNative && o.resolverMode == resolverBrowser {
+		// The isolated browser pins the leaf keys, so the CA need not be
+		// trusted or even persisted.
+		var err error
+		if o.ca, err = certs.NewEphemeralCA(); err != nil {
+			return nil, nil, fmt.Errorf("create CA: %w", err)
+		}
+	} else if backend == certs.BackendNative {
+		root := *f.caRoot
+		if root == "" {
+			root = certs.DefaultCARoot()
+		}
+		var err error
+		o.ca, err = certs.LoadCA(root)
+		if errors.Is(err, certs.ErrNoCA) {
+			return nil, nil, fmt.Errorf("no reflex CA at %s. Run the one-time setup:\n  sudo reflex ca install\nor use --certs mkcert", root)
+		} else if errors.Is(err, os.ErrPermission) {
+			return nil, nil, fmt.Errorf("load CA: %w\nThe CA at %s belongs to another user. Create one of your own:\n  reflex ca init\n  sudo reflex ca install", err, root)
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("load CA: %w", err)
+		}
+	} else {
+		var err error
+		if o.pinnedCAROOT, err = mkcertPreflight(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if *f.logFile != "" {
+		var err error
+		if o.captureLog, err = capture.Open(*f.logFile); err != nil {
+			return nil, nil, fmt.Errorf("open --log-file: %w", err)
+		}
+	}
+
+	if len(listen) > 0 {
+		o.ips, o.listen = ips, listen
+		for _, ip := range listen {
+			if !util.CanBindIP(ip, 0) {
+				o.close()
+				return nil, nil, fmt.Errorf("cannot listen on %s", ip)
+			}
+		}
+	} else {
+		// Map only the address families this machine has; IPv6 loopback
+		// is missing in some containers.
+		for _, ip := range ips {
+			if util.CanBindIP(ip, 0) {
+				o.ips = append(o.ips, ip)
+			} else {
+				log.Printf("cannot listen on %s; not mapping the referrer to it", ip)
+			}
+		}
+		if len(o.ips) == 0 {
+			o.close()
+			return nil, nil, fmt.Errorf("cannot listen on any --ip address (%s)", *f.ip)
+		}
+		o.listen = o.ips
+	}
+	if err := o.inheritSockets(); err != nil {
+		o.close()
+		return nil, nil, err
+	}
+	if sock := f.helperSocket(); sock != "" {
+		c, err := privhelper.Dial(sock)
+		if err != nil {
+			o.close()
+			return nil, nil, fmt.Errorf("connect to the reflex helper at %s: %w\nStart it with: sudo reflex helper --user $USER", sock, err)
+		}
+		o.helper = c
+		log.Printf("using the reflex helper at %s for hosts edits and privileged ports", sock)
+	}
+	for _, ip := range o.listen {
+		if net.ParseIP(ip).IsLoopback() {
+			continue
+		}
+		if len(allow) == 0 {
+			log.Printf("warning: listening on %s, which is not loopback: any machine that reaches it gets the spoofed referrer hosts; restrict clients with --allow", ip)
+		} else {
+			log.Printf("listening on %s, which is not loopback; only loopback and --allow clients are served", ip)
+		}
+	}
+
+	// Lock to prevent concurrent runs from clobbering hosts
+	if *f.forceUnlock {
+		_ = util.RemoveLock()
+	}
+	lock, err := util.AcquireLock()
+	if err != nil {
+		o.close()
+		return nil, nil, err
+	}
+
+	// Port selection, unless systemd passed the sockets. The isolated
+	// browser is told where to connect, so its URLs keep the default port
+	// while we listen on an unprivileged one. Without root, the helper
+	// binds privileged ports.
+	if len(o.sockets) == 0 {
+		o.port = *f.port
+		if o.resolverMode == resolverBrowser && o.port == defaultPortTLS {
+			o.port = *f.fallbackPort
+		}
+		if o.helper != nil && o.port < 1024 && !o.canBind(o.port) {
+			if err := o.helperListen(o.port); err != nil {
+				log.Printf("the helper could not bind port %d: %v", o.port, err)
+			}
+		}
+	}
+	if len(o.sockets) == 0 && !o.canBind(o.port) {
+		log.Printf("port %d unavailable; falling back to %d", o.port, *f.fallbackPort)
+		o.port = *f.fallbackPort
+		if !o.canBind(o.port) {
+			lock.Release()
+			o.close()
+			return nil, nil, fmt.Errorf("fallback port %d also unavailable", o.port)
+		}
+		if forward != "off" && o.resolverMode != resolverBrowser {
+			fw, err := portfwd.Start(forward, o.ips, *f.port, o.port)
+			if err != nil {
+				lock.Release()
+				o.close()
+				return nil, nil, fmt.Errorf("forward port %d to %d: %w", *f.port, o.port, err)
+			}
+			o.forward = fw
+			log.Printf("forwarding port %d to %d (%s); URLs stay on port %d", fw.From, fw.To, fw.Method, fw.From)
+		}
+	}
+	if *f.sink {
+		if err := o.startSink(*f.sinkListen); err != nil {
+			lock.Release()
+			o.close()
+			return nil, nil, err
+		}
+	}
+	return o, lock, nil
+}
+
+// session is one serve/browse cycle: a set of referrer sites that share a
+// redirect method and policy. Flag-driven runs have a single session;
+// scenario files produce one per scenario.
+type session struct {
+	name      string
+	sites     []server.Site
+	method    server.RedirectMethod
+	policy    string
+	rel       string
+	newWindow bool
+	template  *template.Template
+	delay     time.Duration
+	duration  time.Duration
+	expect    scenario.Expect
+	// params are set on every target, after a random click ID for the
+	// referrer host when autoClick is set.
+	params    []tracking.Param
+	autoClick bool
+}
+
+// presetParams returns the parameters p adds to every link, sorted by name.
+func presetParams(p presets.Preset) []tracking.Param {
+	keys := make([]string, 0, len(p.Params))
+	for k := range p.Params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]tracking.Param, len(keys))
+	for i, k := range keys {
+		out[i] = tracking.Param{Key: k, Value: p.Params[k]}
+	}
+	return out
+}
+
+// decorate sets the tracking parameters of s on target, which a visitor
+// from referrer host reaches.
+func (s session) decorate(target, host string) (string, error) {
+	var ps []tracking.Param
+	if s.autoClick {
+		if name := tracking.ClickIDFor(host); name != "" {
+			ps = append(ps, tracking.Param{Key: name, Value: tracking.NewClickID()})
+		}
+	}
+	return tracking.Apply(target, append(ps, s.params...))
+}
+
+// runOptions holds the settings shared by every session of a command, plus
+// the hosts entries and cert directories of the active session for cleanup.
+type runOptions struct {
+	// ips are the --ip addresses the referrer hosts map to; the first is
+	// preferred where only one can be used. listen holds the addresses
+	// served on, one listener each, and allow the --allow networks.
+	ips    []string
+	listen []string
+	allow  []*net.IPNet
+	port   int
+	// forward keeps URLs on the requested port after a fallback
+	// (--port-forward).
+	forward      *portfwd.Forward
+	noHosts      bool
+	hostsPath    string
+	certDir      string
+	keepCerts    bool
+	noBrowser    bool
+	private      bool
+	verbose      bool
+	ca           *certs.CA
+	pinnedCAROOT string
+	// resolverMode is the --resolver value; dnsListen and dnsUpstream
+	// configure the built-in DNS responder in dns mode.
+	resolverMode string
+	dnsListen    string
+	dnsUpstream  string
+	// captureLog receives every request the server sees (--log-file).
+	captureLog *capture.Log
+	// sink is the --sink stand-in target, served for the whole command.
+	sink       *server.Server
+	sinkDir    string
+	sinkCert   string
+	sinkListen string
+
+	// helper is the privileged helper connection, when used; sockets are
+	// listening sockets bound by it or passed by systemd.
+	helper  *privhelper.Client
+	sockets []*os.File
+
+	// record is the manifest of the active session in the state directory.
+	record *state.Session
+
+	addedHosts []string
+	dirs       []string
+	dnsServer  *dns.Server
+}
+
+// activeSession is a session whose sites are mapped and being served.
+type activeSession struct {
+	session
+	srv *server.Server
+}
+
+// signalContext returns a context cancelled on SIGINT/SIGTERM, so commands
+// unwind through their deferred cleanup instead of exiting mid-request.
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// cleanup stops the DNS responder and removes the hosts entries and
+// certificates of the active session. It is safe to call more than once.
+func (o *runOptions) cleanup() {
+	if o.dnsServer != nil {
+		_ = o.dnsServer.Close()
+	}
+	if !o.noHosts {
+		mgr := o.hostsEditor()
+		for _, host := range o.addedHosts {
+			_ = mgr.Remove(host)
+		}
+	}
+	if !o.keepCerts {
+		for _, dir := range o.dirs {
+			_ = os.RemoveAll(dir)
+		}
+	}
+	if o.record != nil {
+		if err := o.record.Remove(); err != nil {
+			log.Printf("remove session record: %v", err)
+		}
+	}
+	o.addedHosts, o.dirs, o.dnsServer, o.record = nil, nil, nil, nil
+}
+
+// newRecord returns the manifest of session s serving hostNames with their
+// certificates in dirs.
+func (o *runOptions) newRecord(s session, hostNames, dirs []string) *state.Session {
+	r := &state.Session{
+		PID:       os.Getpid(),
+		Started:   time.Now().UTC(),
+		Name:      s.name,
+		Hosts:     hostNames,
+		IPs:       o.ips,
+		Port:      o.port,
+		Resolver:  o.resolverMode,
+		CertDirs:  dirs,
+		KeepCerts: o.keepCerts,
+	}
+	for _, site := range s.sites {
+		r.Referrers = append(r.Referrers, o.siteURL(site))
+	}
+	if o.forward != nil {
+		r.PublicPort = o.forward.From
+	}
+	if !o.noHosts {
+		r.HostsFile = o.hostsPath
+	}
+	return r
+}
+
+// close releases resources held for the whole command.
+func (o *runOptions) close() {
+	o.stopSink()
+	o.closeSockets()
+	if o.forward != nil {
+		if err := o.forward.Close(); err != nil {
+			log.Printf("remove port forwarding: %v", err)
+		}
+	}
+	if o.captureLog != nil {
+		_ = o.captureLog.Close()
+	}
+}
+
+// siteURL is the full referrer URL the browser opens for a site, so the
+// Referer it later sends carries the same path and query. In browser mode the
+// host-resolver rule supplies the real port, so the URL has none.
+func (o *runOptions) siteURL(site server.Site) string {
+	url := fmt.Sprintf("https://%s", site.Host)
+	port := o.port
+	if o.forward != nil {
+		port = o.forward.From
+	}
+	if port != 443 && o.resolverMode != resolverBrowser {
+		url = fmt.Sprintf("%s:%d", url, port)
+	}
+	if site.Path == "" {
+		return url + "/"
+	}
+	return url + site.Path
+}
+
+// start maps and certifies the sites of s and starts serving them.
+func (o *runOptions) start(s session) (*activeSession, error) {
+	// Determine cert directories, one per referrer host. A custom --cert-dir
+	// is used as-is for a single referrer and as a parent for several.
+	// Sites may repeat a host under different paths; each host is mapped
+	// and certified once.
+	var hostNames []string
+	seen := make(map[string]bool, len(s.sites))
+	for _, site := range s.sites {
+		if !seen[site.Host] {
+			seen[site.Host] = true
+			hostNames = append(hostNames, site.Host)
+		}
+	}
+	dirs := make([]string, len(hostNames))
+	for i, host := range hostNames {
+		var err error
+		switch {
+		case o.certDir == "":
+			dirs[i] = state.CertDir(host)
+			err = state.MkdirAll(dirs[i])
+		case len(hostNames) == 1:
+			dirs[i] = o.certDir
+		default:
+			dirs[i] = filepath.Join(o.certDir, host)
+		}
+		if err == nil {
+			err = os.MkdirAll(dirs[i], 0o755)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("create cert dir: %w", err)
+		}
+	}
+	o.dirs = dirs
+
+	// Record the session before changing anything, so cleanup can find
+	// what a crashed run left behind.
+	o.record = o.newRecord(s, hostNames, dirs)
+	if err := o.record.Save(); err != nil {
+		o.cleanup()
+		return nil, fmt.Errorf("record session: %w", err)
+	}
+
+	// Hosts modification
+	if !o.noHosts {
+		mgr := o.hostsEditor()
+		for _, host := range hostNames {
+			added := false
+			for _, ip := range o.ips {
+				err := mgr.Add(ip, host)
+				switch {
+				case err == nil:
+					if !added {
+						o.addedHosts = append(o.addedHosts, host)
+						added = true
+					}
+					o.record.HostsLines = append(o.record.HostsLines, hosts.EntryLine(ip, host))
+				case errors.Is(err, hosts.ErrAlreadyPresent):
+					util.VLog("hosts entry already present for %s -> %s", host, ip)
+				default:
+					o.cleanup()
+					return nil, fmt.Errorf("update hosts: %w", err)
+				}
+			}
+		}
+		if err := o.record.Save(); err != nil {
+			log.Printf("record session: %v", err)
+		}
+	} else if o.dnsListen != "" {
+		if err := o.startResolver(s.sites); err != nil {
+			o.cleanup()
+			return nil, err
+		}
+	} else {
+		util.VLog("--no-hosts enabled; not touching hosts file")
+	}
+
+	// Cert generation (CA is ensured already), one leaf per host so the
+	// listener can pick the right one by SNI.
+	type pair struct{ cert, key string }
+	leaves := make(map[string]pair, len(hostNames))
+	for i, host := range hostNames {
+		var p pair
+		var err error
+		if p.cert, p.key, err = o.leaf(dirs[i], host); err != nil {
+			o.cleanup()
+			return nil, fmt.Errorf("generate certificates for %s: %w", host, err)
+		}
+		leaves[host] = p
+	}
+	sites := make([]server.Site, len(s.sites))
+	for i, site := range s.sites {
+		site.CertFile, site.KeyFile = leaves[site.Host].cert, leaves[site.Host].key
+		sites[i] = site
+	}
+	s.sites = sites
+
+	// Start server
+	cfg := server.Config{
+		Port:           o.port,
+		Listen:         o.listenAddrs(),
+		Allow:          o.allow,
+		Method:         s.method,
+		Delay:          s.delay,
+		LogVerbose:     o.verbose,
+		ReferrerPolicy: s.policy,
+		Rel:            s.rel,
+		NewWindow:      s.newWindow,
+		Template:       s.template,
+		Sites:          sites,
+	}
+	if o.captureLog != nil {
+		cfg.Capture = o.captureLog.Write
+	}
+	lns, err := o.listeners()
+	if err != nil {
+		o.cleanup()
+		return nil, err
+	}
+	cfg.Listeners = lns
+	srv, err := server.Start(cfg)
+	if err != nil {
+		o.cleanup()
+		return nil, err
+	}
+	var addrs []string
+	for _, addr := range srv.Addrs() {
+		addrs = append(addrs, addr.String())
+	}
+	log.Printf("starting HTTPS server on %s", strings.Join(addrs, ", "))
+	a := &activeSession{session: s, srv: srv}
+
+	o.logPredictions(a)
+	if s.method.StatusCode() != 0 {
+		log.Printf("Heads-up: %s redirects from an external open may yield empty document.referrer in some browsers. For consistent results, use --method meta or --method js.", s.method)
+	}
+	return a, nil
+}
+
+// listenAddrs returns one listen address per --listen IP.
+func (o *runOptions) listenAddrs() []string {
+	addrs := make([]string, len(o.listen))
+	for i, ip := range o.listen {
+		addrs[i] = net.JoinHostPort(ip, strconv.Itoa(o.port))
+	}
+	return addrs
+}
+
+// canBind reports whether port is free on every --listen address.
+func (o *runOptions) canBind(port int) bool {
+	for _, ip := range o.listen {
+		if !util.CanBindIP(ip, port) {
+			return false
+		}
+	}
+	return true
+}
+
+// leaf issues a certificate for host into dir with the configured backend.
+func (o *runOptions) leaf(dir, host string) (string, string, error) {
+	if o.ca != nil {
+		return o.ca.EnsureLeaf(dir, host)
+	}
+	if o.pinnedCAROOT != "" {
+		return certs.EnsureCertificatesWithCAROOT(host, dir, o.pinnedCAROOT)
+	}
+	return certs.EnsureCertificates(host, dir)
+}
+
+// startResolver answers the site hosts with --ip from the built-in DNS
+// responder and explains how to point a browser at it.
+func (o *runOptions) startResolver(sites []server.Site) error {
+	var ips []net.IP
+	for _, ip := range o.ips {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	names := make(map[string][]net.IP, len(sites))
+	for _, site := range sites {
+		names[site.Host] = ips
+	}
+	srv, err := dns.Start(dns.Config{Addr: o.dnsListen, Hosts: names, Upstream: o.dnsUpstream})
+	if err != nil {
+		return fmt.Errorf("start DNS responder: %w", err)
+	}
+	o.dnsServer = srv
+	addr := srv.Addr().(*net.UDPAddr)
+	log.Printf("DNS responder on %s answers %d name(s) with %s; the hosts file is not touched", addr, len(sites), strings.Join(o.ips, ", "))
+	for _, site := range sites {
+		log.Printf("  route it with dnsmasq: server=/%s/%s#%d (check: dig @%s -p %d %s)", site.Host, addr.IP, addr.Port, addr.IP, addr.Port, site.Host)
+	}
+	return nil
+}
+
+// chromiumOptions trusts exactly the leaf certificates of sites; a fresh
+// browser profile may not know the local CA. Outside hosts mode the site
+// hosts are also mapped straight to the listener.
+func (o *runOptions) chromiumOptions(sites []server.Site) (browser.ChromiumOptions, error) {
+	var opts browser.ChromiumOptions
+	pinned := make(map[string]bool, len(sites))
+	for _, site := range sites {
+		if pinned[site.CertFile] {
+			continue
+		}
+		pinned[site.CertFile] = true
+		h, err := certs.SPKIHash(site.CertFile)
+		if err != nil {
+			return opts, fmt.Errorf("hash certificate for %s: %w", site.Host, err)
+		}
+		opts.TrustSPKI = append(opts.TrustSPKI, h)
+		if o.resolverMode != resolverHosts {
+			if opts.HostRules == nil {
+				opts.HostRules = make(map[string]string)
+			}
+			opts.HostRules[site.Host] = net.JoinHostPort(o.ips[0], strconv.Itoa(o.port))
+		}
+	}
+	if o.sink != nil {
+		h, err := certs.SPKIHash(o.sinkCert)
+		if err != nil {
+			return opts, fmt.Errorf("hash certificate for %s: %w", sinkHost, err)
+		}
+		opts.TrustSPKI = append(opts.TrustSPKI, h)
+		if opts.HostRules != nil {
+			opts.HostRules[sinkHost] = o.sinkListen
+		}
+	}
+	return opts, nil
+}
+
+// stop lets in-flight requests of a finish, then removes its DNS answers,
+// hosts entries and certs, in that order.
+func (o *runOptions) stop(a *activeSession) {
+	if err := a.srv.Shutdown(context.Background()); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	o.cleanup()
+}
+
+// openIsolated launches a dedicated Chromium on the sites of a running
+// session, or prints the flags to do so by hand with --no-browser.
+func (o *runOptions) openIsolated(sites []server.Site) (*browser.Chromium, error) {
+	opts, err := o.chromiumOptions(sites)
+	if err != nil {
+		return nil, err
+	}
+	if o.noBrowser {
+		flags := opts.Flags()
+		for i, f := range flags {
+			if strings.Contains(f, " ") {
+				flags[i] = strconv.Quote(f)
+			}
+		}
+		log.Printf("Launch Chromium with a fresh profile and: %s", strings.Join(flags, " "))
+		return nil, nil
+	}
+	urls := make([]string, len(sites))
+	for i, site := range sites {
+		urls[i] = o.siteURL(site)
+	}
+	b, err := browser.LaunchChromium(opts, urls...)
+	if err != nil {
+		return nil, fmt.Errorf("launch isolated browser: %w", err)
+	}
+	log.Printf("opened isolated Chromium profile (hosts file and system trust store untouched)")
+	return b, nil
+}
+
+// serve starts s, opens the browser and waits for the session to end, the
+// server to fail or ctx to be cancelled before cleaning up.
+func (o *runOptions) serve(ctx context.Context, s session) error {
+	a, err := o.start(s)
+	if err != nil {
+		return err
+	}
+	var isolated *browser.Chromium
+	if o.resolverMode == resolverBrowser {
+		if isolated, err = o.openIsolated(a.sites); err != nil {
+			o.stop(a)
+			return err
+		}
+	}
+	// Compose URLs and open browser
+	for _, site := range a.sites {
+		url := o.siteURL(site)
+		log.Printf("serving spoofed referrer at %s -> %s", url, site.Target)
+		if o.resolverMode == resolverBrowser {
+			continue
+		}
+		if !o.noBrowser {
+			if err := browser.Open(url, o.private); err != nil {
+				log.Printf("open browser: %v", err)
+				log.Printf("Please open this URL manually: %s. (private-mode recommended)", url)
+			}
+		} else {
+			log.Printf("Open this URL in your browser: %s. (private-mode recommended)", url)
+		}
+	}
+
+	var wait <-chan time.Time
+	if s.duration > 0 {
+		log.Printf("auto-shutdown after %s", s.duration)
+		wait = time.After(s.duration)
+	}
+	select {
+	case <-wait:
+	case <-ctx.Done():
+		log.Printf("interrupted; shutting down")
+	case <-a.srv.Done():
+		err = fmt.Errorf("server error: %w", a.srv.Err())
+	}
+	// The browser goes first so it cannot start new requests while the
+	// server drains.
+	if isolated != nil {
+		_ = isolated.Close()
+	}
+	o.stop(a)
+	return err
+}
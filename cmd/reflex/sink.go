@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/samfrm/reflex/internal/server"
+	"github.com/samfrm/reflex/internal/sink"
+	"github.com/samfrm/reflex/internal/state"
+)
+
+// sinkHost names the local stand-in target. Browsers resolve *.localhost to
+// loopback on their own, so it needs no hosts entry.
+const sinkHost = "reflex-sink.localhost"
+
+const defaultSinkListen = "127.0.0.1:9444"
+
+// sinkURL is the landing URL of a sink listening on listen.
+func sinkURL(listen string) string {
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil || port == "443" {
+		return "https://" + sinkHost + "/"
+	}
+	return "https://" + net.JoinHostPort(sinkHost, port) + "/"
+}
+
+// startSink serves the stand-in target on listen for the whole command.
+func (o *runOptions) startSink(listen string) error {
+	dir := state.CertDir(sinkHost)
+	err := state.MkdirAll(dir)
+	if o.certDir != "" {
+		dir = filepath.Join(o.certDir, sinkHost)
+		err = os.MkdirAll(dir, 0o755)
+	}
+	if err != nil {
+		return fmt.Errorf("create cert dir: %w", err)
+	}
+	o.sinkDir = dir
+	cert, key, err := o.leaf(dir, sinkHost)
+	if err != nil {
+		return fmt.Errorf("generate certificates for %s: %w", sinkHost, err)
+	}
+	srv, err := server.Serve(&http.Server{Addr: listen, Handler: sink.New(logSinkVisit)}, cert, key, 0)
+	if err != nil {
+		return fmt.Errorf("start sink: %w", err)
+	}
+	o.sink, o.sinkCert, o.sinkListen = srv, cert, listen
+	log.Printf("sink target listening on %s; visits at %s", srv.Addr(), sinkURL(listen)+sink.PathResults[1:])
+	return nil
+}
+
+// stopSink shuts the sink down and removes its certificate.
+func (o *runOptions) stopSink() {
+	if o.sink == nil {
+		return
+	}
+	if err := o.sink.Shutdown(context.Background()); err != nil {
+		log.Printf("sink shutdown: %v", err)
+	}
+	if !o.keepCerts {
+		_ = os.RemoveAll(o.sinkDir)
+	}
+	o.sink = nil
+}
+
+func logSinkVisit(v sink.Visit) {
+	if v.Beacon {
+		log.Printf("sink: visit #%d document.referrer %s", v.ID, quoteOrNone(v.DocumentReferrer))
+		return
+	}
+	log.Printf("sink: visit #%d %s %s, Referer %s, params %v, cookies %d", v.ID, v.Method, v.URL, quoteOrNone(v.Referer), v.Params, len(v.Cookies))
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/samfrm/reflex/internal/browser"
+	"github.com/samfrm/reflex/internal/cdp"
+	"github.com/samfrm/reflex/internal/policy"
+	"github.com/samfrm/reflex/internal/server"
+)
+
+// sweepResult is one method × policy combination of a sweep.
+type sweepResult struct {
+	Method           string `json:"method"`
+	Policy           string `json:"referrer_policy"`
+	URL              string `json:"url"`
+	Expected         string `json:"expected_referer"`
+	Referer          string `json:"referer"`
+	DocumentReferrer string `json:"document_referrer"`
+	// DocumentLoaded is false when document.referrer could not be read.
+	DocumentLoaded bool   `json:"document_loaded"`
+	Match          bool   `json:"match"`
+	Error          string `json:"error,omitempty"`
+}
+
+// sweepCmd serves every redirect method × referrer policy combination of
+// one referrer → target pair from a single listener, visits each in a
+// headless browser and reports which Referer the target received.
+func sweepCmd(args []string) error {
+	fs := flag.NewFlagSet("sweep", flag.ExitOnError)
+	sf := addSessionFlags(fs)
+	chrome := fs.String("chrome", "", "Chromium-family browser binary (defaults to the first one found)")
+	timeout := fs.Duration("timeout", 30*time.Second, "Time limit for each referrer → target navigation")
+	show := fs.Bool("show", false, "Show the browser window instead of running headless")
+	methods := fs.String("methods", "", "Comma separated redirect methods to sweep (default all: "+server.MethodNames(",")+")")
+	policies := fs.String("policies", "", "Comma separated referrer policies to sweep (default all)")
+	format := fs.String("format", "table", "Report format: table|json")
+	output := fs.String("output", "-", "Write the report to this file (\"-\" for stdout)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: reflex sweep --referrer URL --target URL [options]
+
+Every combination is served at the same referrer URL; a reflex_variant cookie
+set in the sweep's own browser profile picks which one answers. The sweep
+must therefore run in that one cookie jar: other browsers and concurrent
+clients get 404, or the combination their own cookie names. --log-file
+records the variant that served each request.
+
+`)
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	exitUnlessPrivileged(sf)
+
+	if *sf.config != "" {
+		return fmt.Errorf("sweep takes one --referrer and one --target, not --config")
+	}
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("invalid --format: %s (want table or json)", *format)
+	}
+	sessions, err := sf.sessions(0)
+	if err != nil {
+		if errors.Is(err, errNoSites) {
+			fs.Usage()
+		}
+		return err
+	}
+	if len(sessions[0].sites) != 1 {
+		return fmt.Errorf("sweep takes one --referrer and one --target")
+	}
+	ms, err := sweepMethods(*methods)
+	if err != nil {
+		return err
+	}
+	ps, err := sweepPolicies(*policies)
+	if err != nil {
+		return err
+	}
+	s := sessions[0]
+	s.sites = sweepSites(s.sites[0], ms, ps)
+
+	bin := *chrome
+	if bin == "" {
+		if bin = browser.FindChromium(); bin == "" {
+			return fmt.Errorf("sweep needs Chrome, Chromium, Edge or Brave; install one or pass --chrome")
+		}
+	}
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	// Catch signals before prepare takes the lock and sets up forwarding,
+	// so an early Ctrl-C still unwinds through the deferred cleanup.
+	ctx, stop := signalContext()
+	defer stop()
+	o, lock, err := sf.prepare()
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	defer o.close()
+	if ctx.Err() != nil {
+		return fmt.Errorf("interrupted")
+	}
+
+	a, err := o.start(s)
+	if err != nil {
+		return err
+	}
+	defer o.stop(a)
+	conn, closeBrowser, err := o.openDevTools(ctx, a, bin, *show)
+	if err != nil {
+		return err
+	}
+	defer closeBrowser()
+
+	log.Printf("sweeping %d combination(s): %d method(s) × %d policies", len(s.sites), len(ms), len(ps))
+	results := make([]sweepResult, 0, len(s.sites))
+	mismatches := 0
+	for _, site := range s.sites {
+		if ctx.Err() != nil {
+			return fmt.Errorf("interrupted after %d combination(s)", len(results))
+		}
+		if err := setVariant(ctx, conn, o.siteURL(site), site.Variant); err != nil {
+			return err
+		}
+		c, err := o.checkSite(ctx, conn, a, site, *timeout, "")
+		if err != nil {
+			return err
+		}
+		r := sweepResult{
+			Method:   string(site.Method),
+			Policy:   site.ReferrerPolicy,
+			URL:      o.siteURL(site),
+			Expected: c.wantRef,
+			Match:    c.ok(),
+		}
+		if c.obs != nil {
+			r.Referer, r.DocumentReferrer, r.DocumentLoaded = c.obs.Referer, c.obs.DocumentReferrer, c.obs.DocumentLoaded
+		}
+		if c.err != nil {
+			r.Error = c.err.Error()
+		}
+		if !r.Match {
+			mismatches++
+		}
+		results = append(results, r)
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(results)
+	} else {
+		err = writeSweepTable(out, results)
+	}
+	if err != nil {
+		return err
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("%d of %d combination(s) differ from the predicted Referer", mismatches, len(results))
+	}
+	return nil
+}
+
+// sweepMethods parses --methods; empty means every method.
+func sweepMethods(list string) ([]server.RedirectMethod, error) {
+	if strings.TrimSpace(list) == "" {
+		return server.Methods, nil
+	}
+	var out []server.RedirectMethod
+	for _, name := range strings.Split(list, ",") {
+		m := server.RedirectMethod(strings.ToLower(strings.TrimSpace(name)))
+		if !m.Valid() {
+			return nil, fmt.Errorf("invalid --methods entry: %s (want %s)", name, server.MethodNames(", "))
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// sweepPolicies parses --policies; empty means every policy token.
+func sweepPolicies(list string) ([]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return policy.Tokens, nil
+	}
+	var out []string
+	for _, tok := range strings.Split(list, ",") {
+		tok = strings.ToLower(strings.TrimSpace(tok))
+		if !policy.Valid(tok) {
+			return nil, fmt.Errorf("invalid --policies entry: %s (want %s)", tok, strings.Join(policy.Tokens, ", "))
+		}
+		out = append(out, tok)
+	}
+	return out, nil
+}
+
+// sweepSites serves one variant of base per method and policy. All share
+// the referrer URL, so full-URL policies report the real one; the variant
+// cookie set before each visit picks the combination. None is served
+// without the cookie.
+func sweepSites(base server.Site, methods []server.RedirectMethod, policies []string) []server.Site {
+	sites := make([]server.Site, 0, len(methods)*len(policies))
+	for _, m := range methods {
+		for _, p := range policies {
+			site := base
+			site.Method, site.ReferrerPolicy = m, p
+			site.Variant = string(m) + "/" + p
+			sites = append(sites, site)
+		}
+	}
+	return sites
+}
+
+// setVariant makes the browser request variant from the referrer server at
+// siteURL. The cookie is host-only, so the target never receives it.
+func setVariant(ctx context.Context, conn *cdp.Conn, siteURL, variant string) error {
+	cookie := map[string]any{"name": server.VariantCookie, "value": variant, "url": siteURL}
+	if err := conn.Call(ctx, "", "Storage.setCookies", map[string]any{"cookies": []any{cookie}}, nil); err != nil {
+		return fmt.Errorf("select sweep variant %s: %w", variant, err)
+	}
+	return nil
+}
+
+func writeSweepTable(w io.Writer, results []sweepResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "METHOD\tPOLICY\tEXPECTED\tREFERER\tDOCUMENT.REFERRER\tRESULT")
+	for _, r := range results {
+		doc, result := quoteOrNone(r.DocumentReferrer), "ok"
+		if !r.DocumentLoaded {
+			doc = "?"
+		}
+		switch {
+		case r.Error != "":
+			result = "error: " + r.Error
+		case !r.Match:
+			result = "MISMATCH"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Method, r.Policy, quoteOrNone(r.Expected), quoteOrNone(r.Referer), doc, result)
+	}
+	return tw.Flush()
+}
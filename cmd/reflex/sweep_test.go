@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/samfrm/reflex/internal/policy"
+	"github.com/samfrm/reflex/internal/server"
+)
+
+func TestSweepMethods(t *testing.T) {
+	all, err := sweepMethods(" ")
+	if err != nil || !reflect.DeepEqual(all, server.Methods) {
+		t.Errorf("empty list = %v, %v; want every method", all, err)
+	}
+	got, err := sweepMethods("JS, 302")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []server.RedirectMethod{"js", "302"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := sweepMethods("js,teleport"); err == nil {
+		t.Error("unknown method accepted")
+	}
+}
+
+func TestSweepPolicies(t *testing.T) {
+	all, err := sweepPolicies("")
+	if err != nil || !reflect.DeepEqual(all, policy.Tokens) {
+		t.Errorf("empty list = %v, %v; want every token", all, err)
+	}
+	got, err := sweepPolicies(" No-Referrer ,origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"no-referrer", "origin"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := sweepPolicies("origin,sometimes"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+func TestSweepSitesKeepReferrerPath(t *testing.T) {
+	base := server.Site{Host: "a.test", Path: "/deep/page?x=1", Target: "https://b.test/"}
+	sites := sweepSites(base, []server.RedirectMethod{"302", "js"}, []string{"origin", "unsafe-url"})
+	if len(sites) != 4 {
+		t.Fatalf("got %d sites, want 4", len(sites))
+	}
+	seen := map[string]bool{}
+	for _, s := range sites {
+		if s.Path != base.Path || s.Host != base.Host || s.Target != base.Target {
+			t.Errorf("site %+v moved off the referrer URL", s)
+		}
+		if want := string(s.Method) + "/" + s.ReferrerPolicy; s.Variant != want {
+			t.Errorf("variant %q, want %q", s.Variant, want)
+		}
+		seen[s.Variant] = true
+	}
+	if len(seen) != 4 {
+		t.Errorf("variants not distinct: %v", seen)
+	}
+}
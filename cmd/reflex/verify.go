@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/samfrm/reflex/internal/browser"
+	"github.com/samfrm/reflex/internal/cdp"
+	"github.com/samfrm/reflex/internal/server"
+	"github.com/samfrm/reflex/internal/verify"
+)
+
+func verifyCmd(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	sf := addSessionFlags(fs)
+	chrome := fs.String("chrome", "", "Chromium-family browser binary (defaults to the first one found)")
+	timeout := fs.Duration("timeout", 30*time.Second, "Time limit for each referrer → target navigation")
+	expectReferer := fs.String("expect-referer", "", "Expected Referer on the target, overriding the value derived from --referrer-policy (\"none\" for no Referer)")
+	show := fs.Bool("show", false, "Show the browser window instead of running headless")
+	_ = fs.Parse(args)
+	exitUnlessPrivileged(sf)
+
+	sessions, err := sf.sessions(0)
+	if err != nil {
+		if errors.Is(err, errNoSites) {
+			fs.Usage()
+		}
+		return err
+	}
+	bin := *chrome
+	if bin == "" {
+		if bin = browser.FindChromium(); bin == "" {
+			return fmt.Errorf("verify needs Chrome, Chromium, Edge or Brave; install one or pass --chrome")
+		}
+	}
+	// Catch signals before prepare takes the lock and sets up forwarding,
+	// so an early Ctrl-C still unwinds through the deferred cleanup.
+	ctx, stop := signalContext()
+	defer stop()
+	o, lock, err := sf.prepare()
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	defer o.close()
+	if ctx.Err() != nil {
+		return fmt.Errorf("interrupted")
+	}
+
+	var checks, failures int
+	for i, s := range sessions {
+		if len(sessions) > 1 {
+			log.Printf("scenario %d/%d: %s", i+1, len(sessions), s.name)
+		}
+		n, failed, err := o.verifySession(ctx, s, bin, *show, *timeout, *expectReferer)
+		checks += n
+		failures += failed
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("interrupted after %d check(s)", checks)
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("%d of %d check(s) failed", failures, checks)
+	}
+	log.Printf("all %d check(s) passed", checks)
+	return nil
+}
+
+// verifySession serves s, drives a dedicated browser through every site and
+// compares what the target received with the expectation. It returns the
+// number of checks and failures.
+func (o *runOptions) verifySession(ctx context.Context, s session, bin string, show bool, timeout time.Duration, expectOverride string) (int, int, error) {
+	a, err := o.start(s)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer o.stop(a)
+
+	conn, closeBrowser, err := o.openDevTools(ctx, a, bin, show)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer closeBrowser()
+	return o.verifySites(ctx, conn, a, timeout, expectOverride)
+}
+
+// openDevTools launches a dedicated browser trusting the sites of a and
+// connects to it. The returned func closes both.
+func (o *runOptions) openDevTools(ctx context.Context, a *activeSession, bin string, show bool) (*cdp.Conn, func(), error) {
+	opts, err := o.chromiumOptions(a.sites)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts.Binary, opts.Headless = bin, !show
+	// window-open must not be stopped by the popup blocker, and keeping
+	// cross-site iframes in-process lets their document be inspected.
+	opts.Args = append(opts.Args, "--disable-popup-blocking", "--disable-features=IsolateOrigins,site-per-process")
+	b, err := browser.LaunchChromium(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	startCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+	wsURL, err := b.DevToolsURL(startCtx)
+	if err == nil {
+		var conn *cdp.Conn
+		if conn, err = cdp.Dial(startCtx, wsURL); err == nil {
+			return conn, func() { conn.Close(); b.Close() }, nil
+		}
+	}
+	b.Close()
+	return nil, nil, err
+}
+
+// siteCheck is the outcome of visiting one site.
+type siteCheck struct {
+	label            string
+	wantRef, wantDoc string
+	obs              *verify.Observation
+	// err is set when the visit failed; problems lists the mismatches.
+	err      error
+	problems []string
+}
+
+// checkSite visits site in the browser behind conn and compares the result
+// with the expectation.
+func (o *runOptions) checkSite(ctx context.Context, conn *cdp.Conn, a *activeSession, site server.Site, timeout time.Duration, expectOverride string) (siteCheck, error) {
+	startURL := o.siteURL(site)
+	c := siteCheck{label: fmt.Sprintf("%s -> %s", startURL, site.Target)}
+	var err error
+	c.wantRef, c.wantDoc, err = expectedReferrers(a.session, site, startURL, expectOverride)
+	if err != nil {
+		return c, err
+	}
+	visitCtx, cancel := context.WithTimeout(ctx, timeout)
+	c.obs, err = verify.Visit(visitCtx, conn, startURL, site.Target)
+	cancel()
+	if err != nil && c.obs == nil {
+		c.err = err
+		return c, nil
+	}
+	if c.obs.LoadError != "" {
+		log.Printf("target page failed to load (%s); document.referrer not checked", c.obs.LoadError)
+	} else if err != nil {
+		log.Printf("%s: %v; document.referrer not checked", c.label, err)
+	}
+	c.problems = verify.Check(c.obs, c.wantRef, c.wantDoc)
+	return c, nil
+}
+
+// ok reports whether the visit succeeded and matched the expectation.
+func (c siteCheck) ok() bool { return c.err == nil && len(c.problems) == 0 }
+
+// verifySites visits every site of a; it stops early once ctx is cancelled.
+func (o *runOptions) verifySites(ctx context.Context, conn *cdp.Conn, a *activeSession, timeout time.Duration, expectOverride string) (int, int, error) {
+	failures := 0
+	for i, site := range a.sites {
+		if ctx.Err() != nil {
+			return i, failures, nil
+		}
+		c, err := o.checkSite(ctx, conn, a, site, timeout, expectOverride)
+		if err != nil {
+			return 0, 0, err
+		}
+		switch {
+		case c.err != nil:
+			failures++
+			fmt.Printf("FAIL %s: %v\n", c.label, c.err)
+		case len(c.problems) > 0:
+			failures++
+			fmt.Printf("FAIL %s: %s\n", c.label, strings.Join(c.problems, "; "))
+		default:
+			fmt.Printf("PASS %s: Referer %s\n", c.label, quoteOrNone(c.obs.Referer))
+		}
+	}
+	return len(a.sites), failures, nil
+}
+
+// expectedReferrers returns the Referer header and document.referrer the
+// target should see. Scenario expectations and --expect-referer take
+// precedence over the prediction from the referrer policy and method.
+func expectedReferrers(s session, site server.Site, startURL, override string) (string, string, error) {
+	p, err := s.predict(site, startURL)
+	if err != nil {
+		return "", "", err
+	}
+	header := p.Referer
+	if override == "" {
+		override = s.expect.Referer
+	}
+	if override != "" {
+		header = noneToEmpty(override)
+	}
+	doc := header
+	if s.expect.DocumentReferrer != "" {
+		doc = noneToEmpty(s.expect.DocumentReferrer)
+	}
+	return header, doc, nil
+}
+
+func noneToEmpty(s string) string {
+	if strings.EqualFold(s, "none") {
+		return ""
+	}
+	return s
+}
+
+func quoteOrNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return fmt.Sprintf("%q", s)
+}
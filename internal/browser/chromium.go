@@ -0,0 +1,171 @@
+package browser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ChromiumOptions configures a dedicated Chromium-family browser process.
+type ChromiumOptions struct {
+	// Binary is the browser executable; the first Chromium-family browser
+	// found on the system is used when empty.
+	Binary string
+	// Headless runs without a window (new headless mode).
+	Headless bool
+	// ProfileDir is the user data directory; a temporary one is created and
+	// removed on Close when empty.
+	ProfileDir string
+	// HostRules maps host names to the address (ip:port) the browser
+	// connects to instead of resolving them, leaving DNS and the hosts file
+	// untouched.
+	HostRules map[string]string
+	// TrustSPKI lists base64 SHA-256 hashes of public keys whose
+	// certificates are accepted even though no trusted CA issued them.
+	TrustSPKI []string
+	// Args are appended to the command line before the URLs.
+	Args []string
+}
+
+// Flags returns the command line flags for HostRules and TrustSPKI.
+func (o ChromiumOptions) Flags() []string {
+	var flags []string
+	if len(o.HostRules) > 0 {
+		hosts := make([]string, 0, len(o.HostRules))
+		for h := range o.HostRules {
+			hosts = append(hosts, h)
+		}
+		sort.Strings(hosts)
+		rules := make([]string, len(hosts))
+		for i, h := range hosts {
+			rules[i] = "MAP " + h + " " + o.HostRules[h]
+		}
+		flags = append(flags, "--host-resolver-rules="+strings.Join(rules, ", "))
+	}
+	if len(o.TrustSPKI) > 0 {
+		flags = append(flags, "--ignore-certificate-errors-spki-list="+strings.Join(o.TrustSPKI, ","))
+	}
+	return flags
+}
+
+// Chromium is a running browser instance with its own profile and the
+// DevTools endpoint enabled.
+type Chromium struct {
+	cmd         *exec.Cmd
+	profileDir  string
+	tempProfile bool
+}
+
+// FindChromium returns the path of a Chromium-family browser, or "".
+func FindChromium() string {
+	switch runtime.GOOS {
+	case "darwin":
+		for _, app := range []string{
+			"/Applications/Google Chrome.app/Contents/MacOS/Google Chrome",
+			"/Applications/Chromium.app/Contents/MacOS/Chromium",
+			"/Applications/Microsoft Edge.app/Contents/MacOS/Microsoft Edge",
+			"/Applications/Brave Browser.app/Contents/MacOS/Brave Browser",
+		} {
+			if _, err := os.Stat(app); err == nil {
+				return app
+			}
+		}
+		return ""
+	case "windows":
+		return firstOnPath("chrome", "chrome.exe", "msedge", "msedge.exe")
+	default:
+		return firstOnPath("google-chrome-stable", "google-chrome", "chromium", "chromium-browser", "brave-browser", "microsoft-edge", "microsoft-edge-stable")
+	}
+}
+
+// LaunchChromium starts a browser with remote debugging on an ephemeral
+// port and opens urls, one tab each (about:blank when none are given).
+func LaunchChromium(opts ChromiumOptions, urls ...string) (*Chromium, error) {
+	bin := opts.Binary
+	if bin == "" {
+		bin = FindChromium()
+	}
+	if bin == "" {
+		return nil, errors.New("no Chromium-family browser found; pass its path explicitly")
+	}
+	c := &Chromium{profileDir: opts.ProfileDir}
+	if c.profileDir == "" {
+		dir, err := os.MkdirTemp("", "reflex-chromium-")
+		if err != nil {
+			return nil, err
+		}
+		c.profileDir, c.tempProfile = dir, true
+	}
+
+	args := []string{
+		"--user-data-dir=" + c.profileDir,
+		"--remote-debugging-port=0",
+		"--no-first-run",
+		"--no-default-browser-check",
+		"--disable-background-networking",
+		"--disable-sync",
+	}
+	if opts.Headless {
+		args = append(args, "--headless=new", "--disable-gpu")
+	}
+	// Chromium refuses to start as root without disabling its sandbox.
+	if runtime.GOOS != "windows" && os.Geteuid() == 0 {
+		args = append(args, "--no-sandbox")
+	}
+	args = append(args, opts.Flags()...)
+	args = append(args, opts.Args...)
+	if len(urls) == 0 {
+		urls = []string{"about:blank"}
+	}
+	args = append(args, urls...)
+
+	c.cmd = exec.Command(bin, args...)
+	if err := c.cmd.Start(); err != nil {
+		c.removeProfile()
+		return nil, fmt.Errorf("start %s: %w", filepath.Base(bin), err)
+	}
+	return c, nil
+}
+
+// DevToolsURL waits for the browser to publish its DevTools endpoint and
+// returns the browser websocket URL.
+func (c *Chromium) DevToolsURL(ctx context.Context) (string, error) {
+	path := filepath.Join(c.profileDir, "DevToolsActivePort")
+	for {
+		if b, err := os.ReadFile(path); err == nil {
+			// First line is the port, second the browser target path.
+			lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+			if len(lines) >= 2 {
+				return fmt.Sprintf("ws://127.0.0.1:%s%s", strings.TrimSpace(lines[0]), strings.TrimSpace(lines[1])), nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("browser did not expose DevTools: %w", ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Close stops the browser and removes a temporary profile.
+func (c *Chromium) Close() error {
+	if c.cmd != nil && c.cmd.Process != nil {
+		_ = c.cmd.Process.Kill()
+		_ = c.cmd.Wait()
+	}
+	c.removeProfile()
+	return nil
+}
+
+func (c *Chromium) removeProfile() {
+	if c.tempProfile {
+		_ = os.RemoveAll(c.profileDir)
+	}
+}
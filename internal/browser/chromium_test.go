@@ -0,0 +1,23 @@
+package browser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChromiumOptionsFlags(t *testing.T) {
+	opts := ChromiumOptions{
+		HostRules: map[string]string{"t.co": "127.0.0.1:8443", "news.google.com": "[::1]:8443"},
+		TrustSPKI: []string{"pinA", "pinB"},
+	}
+	want := []string{
+		"--host-resolver-rules=MAP news.google.com [::1]:8443, MAP t.co 127.0.0.1:8443",
+		"--ignore-certificate-errors-spki-list=pinA,pinB",
+	}
+	if got := opts.Flags(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Flags() = %q, want %q", got, want)
+	}
+	if got := (ChromiumOptions{}).Flags(); len(got) != 0 {
+		t.Fatalf("empty options produced flags %q", got)
+	}
+}
@@ -0,0 +1,97 @@
+// Package capture records the requests that reach the spoofed referrer
+// server and streams them as JSON lines.
+package capture
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record is one request received by the redirect server.
+type Record struct {
+	Time       time.Time   `json:"time"`
+	RemoteAddr string      `json:"remote_addr"`
+	Method     string      `json:"method"`
+	Host       string      `json:"host"`
+	Path       string      `json:"path"`
+	UserAgent  string      `json:"user_agent,omitempty"`
+	Referer    string      `json:"referer,omitempty"`
+	TLSVersion string      `json:"tls_version,omitempty"`
+	SNI        string      `json:"sni,omitempty"`
+	ALPN       string      `json:"alpn,omitempty"`
+	Headers    http.Header `json:"headers"`
+	// Redirect is the redirect method served and Target where it pointed;
+	// both are empty when no site matched the request. Variant names the
+	// sweep combination that served it, such as "302/origin".
+	Redirect string `json:"redirect,omitempty"`
+	Target   string `json:"target,omitempty"`
+	Variant  string `json:"variant,omitempty"`
+	Status   int    `json:"status"`
+}
+
+// FromRequest fills the request-derived fields of a Record.
+func FromRequest(r *http.Request) Record {
+	rec := Record{
+		Time:       time.Now().UTC(),
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.RequestURI(),
+		UserAgent:  r.UserAgent(),
+		Referer:    r.Referer(),
+		Headers:    r.Header.Clone(),
+	}
+	if r.TLS != nil {
+		rec.TLSVersion = tls.VersionName(r.TLS.Version)
+		rec.SNI = r.TLS.ServerName
+		rec.ALPN = r.TLS.NegotiatedProtocol
+	}
+	return rec
+}
+
+// Log writes records as JSON lines. It is safe for concurrent use.
+type Log struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	c   io.Closer
+}
+
+// New returns a Log writing to w.
+func New(w io.Writer) *Log {
+	return &Log{enc: json.NewEncoder(w)}
+}
+
+// Open appends to the file at path, creating it if needed. "-" writes to
+// standard output.
+func Open(path string) (*Log, error) {
+	if path == "-" {
+		return New(os.Stdout), nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	l := New(f)
+	l.c = f
+	return l, nil
+}
+
+// Write appends one record.
+func (l *Log) Write(rec Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(rec)
+}
+
+// Close closes the underlying file, if Open created one.
+func (l *Log) Close() error {
+	if l.c == nil {
+		return nil
+	}
+	return l.c.Close()
+}
@@ -0,0 +1,72 @@
+package capture
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFromRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "https://news.google.com/search?q=x", nil)
+	r.Header.Set("User-Agent", "ua")
+	r.Header.Set("Referer", "https://a.test/")
+	r.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, ServerName: "news.google.com", NegotiatedProtocol: "h2"}
+
+	rec := FromRequest(r)
+	if rec.Host != "news.google.com" || rec.Path != "/search?q=x" || rec.UserAgent != "ua" || rec.Referer != "https://a.test/" {
+		t.Fatalf("unexpected record: %+v", rec)
+	}
+	if rec.TLSVersion != "TLS 1.3" || rec.SNI != "news.google.com" || rec.ALPN != "h2" {
+		t.Fatalf("unexpected TLS fields: %+v", rec)
+	}
+	r.Header.Set("User-Agent", "changed")
+	if rec.Headers.Get("User-Agent") != "ua" {
+		t.Fatalf("headers not copied")
+	}
+}
+
+func TestLogWritesJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf)
+	for _, p := range []string{"/a", "/b"} {
+		if err := l.Write(Record{Path: p, Status: 200}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %q", len(lines), buf.String())
+	}
+	var rec Record
+	if err := json.Unmarshal([]byte(lines[1]), &rec); err != nil || rec.Path != "/b" {
+		t.Fatalf("second line = %q (%v)", lines[1], err)
+	}
+}
+
+func TestOpenAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hits.jsonl")
+	for i := 0; i < 2; i++ {
+		l, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Write(Record{Path: "/"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "\n"); n != 2 {
+		t.Fatalf("file has %d lines, want 2", n)
+	}
+}
@@ -0,0 +1,195 @@
+// Package cdp is a small Chrome DevTools Protocol client. It speaks to a
+// browser endpoint over a websocket and supports flattened target sessions,
+// which is all reflex needs to drive a headless Chromium.
+package cdp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Event is an unsolicited protocol message such as Network.requestWillBeSent.
+type Event struct {
+	Method    string
+	SessionID string
+	Params    json.RawMessage
+}
+
+// Error is a protocol-level error returned by the browser for a call.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("cdp error %d: %s", e.Code, e.Message) }
+
+type message struct {
+	ID        int64           `json:"id,omitempty"`
+	Method    string          `json:"method,omitempty"`
+	SessionID string          `json:"sessionId,omitempty"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     *Error          `json:"error,omitempty"`
+}
+
+// Conn is a connection to a DevTools browser endpoint.
+type Conn struct {
+	ws     *wsConn
+	nextID atomic.Int64
+
+	mu      sync.Mutex
+	pending map[int64]chan message
+	err     error
+
+	events chan Event
+	done   chan struct{} // closed by Close
+	gone   chan struct{} // closed when the read loop exits
+}
+
+// Dial connects to a DevTools websocket URL such as the one reported in
+// DevToolsActivePort ("ws://127.0.0.1:PORT/devtools/browser/ID").
+func Dial(ctx context.Context, wsURL string) (*Conn, error) {
+	ws, err := dialWebSocket(ctx, wsURL)
+	if err != nil {
+		return nil, fmt.Errorf("connect to devtools: %w", err)
+	}
+	c := &Conn{
+		ws:      ws,
+		pending: make(map[int64]chan message),
+		events:  make(chan Event, 4096),
+		done:    make(chan struct{}),
+		gone:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *Conn) readLoop() {
+	defer close(c.gone)
+	var err error
+	for {
+		var b []byte
+		if b, err = c.ws.ReadMessage(); err != nil {
+			break
+		}
+		var m message
+		if json.Unmarshal(b, &m) != nil {
+			continue
+		}
+		if m.ID != 0 {
+			c.mu.Lock()
+			ch := c.pending[m.ID]
+			delete(c.pending, m.ID)
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- m
+			}
+			continue
+		}
+		select {
+		case c.events <- Event{Method: m.Method, SessionID: m.SessionID, Params: m.Params}:
+		case <-c.done:
+			err = errors.New("cdp: connection closed")
+			c.setErr(err)
+			return
+		}
+	}
+	c.setErr(err)
+	close(c.events)
+}
+
+// Events delivers protocol events in arrival order. The channel is closed
+// when the connection ends. Callers must keep draining it while they wait
+// for call results.
+func (c *Conn) Events() <-chan Event { return c.events }
+
+// Call invokes method on the browser (sessionID "") or on an attached target
+// session and decodes the result into result when it is non-nil.
+func (c *Conn) Call(ctx context.Context, sessionID, method string, params, result any) error {
+	id := c.nextID.Add(1)
+	m := message{ID: id, Method: method, SessionID: sessionID}
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		m.Params = b
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	ch := make(chan message, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	if err := c.ws.WriteText(b); err != nil {
+		c.forget(id)
+		return err
+	}
+	resp, err := c.wait(ctx, id, method, ch)
+	if err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("%s: %w", method, resp.Error)
+	}
+	if result != nil && len(resp.Result) > 0 {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
+
+// wait returns the reply to call id. A reply that arrived just before the
+// connection ended still counts: the read loop delivers it before closing
+// gone, and select picks between ready cases at random.
+func (c *Conn) wait(ctx context.Context, id int64, method string, ch chan message) (message, error) {
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-ctx.Done():
+		c.forget(id)
+		return message{}, ctx.Err()
+	case <-c.gone:
+		select {
+		case resp := <-ch:
+			return resp, nil
+		default:
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return message{}, fmt.Errorf("%s: %w", method, c.err)
+	}
+}
+
+func (c *Conn) setErr(err error) {
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+}
+
+func (c *Conn) forget(id int64) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// Close shuts the connection down.
+func (c *Conn) Close() error {
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	close(c.done)
+	return c.ws.Close()
+}
@@ -0,0 +1,133 @@
+package cdp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBrowser upgrades the request and answers every call with its method
+// name, preceded by one event on the same session. Browser.close is answered
+// and then the socket is closed, as Chromium does.
+func fakeBrowser(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		key := r.Header.Get("Sec-WebSocket-Key")
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n")
+		_ = brw.Flush()
+
+		// Reuse the client framing code for the server side; servers send
+		// masked frames here, which the reader accepts as well.
+		ws := &wsConn{conn: conn, br: bufio.NewReader(brw)}
+		for {
+			b, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			var m message
+			if err := json.Unmarshal(b, &m); err != nil {
+				t.Errorf("bad request: %v", err)
+				return
+			}
+			ev, _ := json.Marshal(message{Method: "Test.event", SessionID: m.SessionID, Params: json.RawMessage(`{"n":1}`)})
+			_ = ws.WriteText(ev)
+			if m.Method == "Test.fail" {
+				resp, _ := json.Marshal(message{ID: m.ID, Error: &Error{Code: -32000, Message: "nope"}})
+				_ = ws.WriteText(resp)
+				continue
+			}
+			res, _ := json.Marshal(map[string]string{"method": m.Method, "payload": strings.Repeat("x", 70000)})
+			resp, _ := json.Marshal(message{ID: m.ID, SessionID: m.SessionID, Result: res})
+			_ = ws.WriteText(resp)
+			if m.Method == "Browser.close" {
+				return
+			}
+		}
+	}))
+}
+
+func TestCallAndEvents(t *testing.T) {
+	srv := fakeBrowser(t)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/devtools/browser/x")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	var res struct {
+		Method  string `json:"method"`
+		Payload string `json:"payload"`
+	}
+	if err := c.Call(ctx, "S1", "Page.navigate", map[string]string{"url": "about:blank"}, &res); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if res.Method != "Page.navigate" || len(res.Payload) != 70000 {
+		t.Fatalf("unexpected result: method=%q payload=%d", res.Method, len(res.Payload))
+	}
+	select {
+	case ev := <-c.Events():
+		if ev.Method != "Test.event" || ev.SessionID != "S1" {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	case <-ctx.Done():
+		t.Fatalf("no event received")
+	}
+
+	err = c.Call(ctx, "", "Test.fail", nil, nil)
+	var cdpErr *Error
+	if err == nil || !errors.As(err, &cdpErr) || cdpErr.Code != -32000 {
+		t.Fatalf("expected protocol error, got %v", err)
+	}
+}
+
+func TestCallReplyBeforeClose(t *testing.T) {
+	srv := fakeBrowser(t)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := 0; i < 50; i++ {
+		c, err := Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/devtools/browser/x")
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		// The reply and the end of the connection arrive together; the call
+		// still succeeded.
+		if err := c.Call(ctx, "", "Browser.close", nil, nil); err != nil {
+			t.Fatalf("attempt %d: Call: %v", i, err)
+		}
+		c.Close()
+	}
+}
+
+func TestWaitPrefersReplyOverClose(t *testing.T) {
+	// Both the reply and the end of the connection are ready, as when the
+	// read loop delivers a reply and then hits EOF before Call selects.
+	c := &Conn{pending: map[int64]chan message{}, gone: make(chan struct{}), err: errors.New("EOF")}
+	close(c.gone)
+	for i := 0; i < 100; i++ {
+		ch := make(chan message, 1)
+		ch <- message{ID: 1, Result: json.RawMessage(`{}`)}
+		if _, err := c.wait(context.Background(), 1, "Browser.close", ch); err != nil {
+			t.Fatalf("wait: %v", err)
+		}
+	}
+	if _, err := c.wait(context.Background(), 1, "Browser.close", make(chan message, 1)); err == nil {
+		t.Fatalf("wait without reply on a closed connection succeeded")
+	}
+}
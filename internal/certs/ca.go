@@ -0,0 +1,440 @@
+package certs
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/base64"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "math/big"
+    "net"
+    "os"
+    "os/user"
+    "path/filepath"
+    "runtime"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Backend selects how leaf certificates are produced.
+type Backend string
+
+const (
+    // BackendNative issues certificates in-process from the reflex CA.
+    BackendNative Backend = "native"
+    // BackendMkcert shells out to the mkcert binary.
+    BackendMkcert Backend = "mkcert"
+)
+
+// File names inside a CA root. They match mkcert's layout so an existing
+// mkcert CAROOT can be reused by the native backend.
+const (
+    CACertName = "rootCA.pem"
+    CAKeyName  = "rootCA-key.pem"
+)
+
+const (
+    caValidity   = 10 * 365 * 24 * time.Hour
+    leafValidity = 397 * 24 * time.Hour
+)
+
+// ErrNoCA is returned by LoadCA when the CA root has not been created yet.
+var ErrNoCA = errors.New("reflex CA not found")
+
+// CA is a local certificate authority used to issue leaf certificates for
+// spoofed referrer hosts.
+type CA struct {
+    Dir  string
+    Cert *x509.Certificate
+    Key  crypto.Signer
+}
+
+// DefaultCARoot returns where the reflex CA lives. REFLEX_CAROOT overrides it.
+// The CA belongs to the user so runs without root can sign with it; under
+// sudo on Linux it is the invoking user's, so both share one CA. Root
+// without sudo on Linux keeps it in /etc/reflex/ca.
+func DefaultCARoot() string {
+    if d := os.Getenv("REFLEX_CAROOT"); d != "" {
+        return d
+    }
+    if runtime.GOOS == "linux" && os.Geteuid() == 0 {
+        if u := sudoUser(); u != nil {
+            return filepath.Join(u.HomeDir, ".config", "reflex", "ca")
+        }
+        return "/etc/reflex/ca"
+    }
+    if d, err := os.UserConfigDir(); err == nil {
+        return filepath.Join(d, "reflex", "ca")
+    }
+    return filepath.Join(os.TempDir(), "reflex-ca")
+}
+
+// sudoUser returns the user who ran sudo, or nil when not running as root
+// under sudo.
+func sudoUser() *user.User {
+    id := os.Getenv("SUDO_UID")
+    if os.Geteuid() != 0 || id == "" || id == "0" {
+        return nil
+    }
+    u, err := user.LookupId(id)
+    if err != nil || u.HomeDir == "" {
+        return nil
+    }
+    return u
+}
+
+// ChownToSudoUser hands dir and its files to the user who ran sudo, along
+// with the directories above it inside their home, so a CA created by
+// "sudo reflex ca install" stays readable by that user. It does nothing
+// outside sudo.
+func ChownToSudoUser(dir string) error {
+    u := sudoUser()
+    if u == nil {
+        return nil
+    }
+    uid, err := strconv.Atoi(u.Uid)
+    if err != nil {
+        return err
+    }
+    gid, err := strconv.Atoi(u.Gid)
+    if err != nil {
+        return err
+    }
+    return chownTree(dir, u.HomeDir, uid, gid)
+}
+
+// chownTree chowns dir, the files in it and its parents below home.
+func chownTree(dir, home string, uid, gid int) error {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return err
+    }
+    for _, e := range entries {
+        if err := os.Lchown(filepath.Join(dir, e.Name()), uid, gid); err != nil {
+            return err
+        }
+    }
+    if err := os.Lchown(dir, uid, gid); err != nil {
+        return err
+    }
+    for d := filepath.Dir(dir); isBelow(d, home); d = filepath.Dir(d) {
+        if err := os.Lchown(d, uid, gid); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// isBelow reports whether path is inside dir, excluding dir itself.
+func isBelow(path, dir string) bool {
+    rel, err := filepath.Rel(dir, path)
+    return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// CertPath returns the path of the PEM encoded root certificate.
+func (ca *CA) CertPath() string { return filepath.Join(ca.Dir, CACertName) }
+
+// LoadCA reads an existing CA from dir. It returns ErrNoCA if none exists.
+func LoadCA(dir string) (*CA, error) {
+    certPath := filepath.Join(dir, CACertName)
+    keyPath := filepath.Join(dir, CAKeyName)
+    if !fileExists(certPath) || !fileExists(keyPath) {
+        return nil, fmt.Errorf("%w in %s", ErrNoCA, dir)
+    }
+    certPEM, err := os.ReadFile(certPath)
+    if err != nil {
+        return nil, err
+    }
+    keyPEM, err := os.ReadFile(keyPath)
+    if err != nil {
+        return nil, err
+    }
+    cb, _ := pem.Decode(certPEM)
+    if cb == nil || cb.Type != "CERTIFICATE" {
+        return nil, fmt.Errorf("%s: no certificate PEM block", certPath)
+    }
+    cert, err := x509.ParseCertificate(cb.Bytes)
+    if err != nil {
+        return nil, fmt.Errorf("parse %s: %w", certPath, err)
+    }
+    if !cert.IsCA {
+        return nil, fmt.Errorf("%s is not a CA certificate", certPath)
+    }
+    kb, _ := pem.Decode(keyPEM)
+    if kb == nil {
+        return nil, fmt.Errorf("%s: no key PEM block", keyPath)
+    }
+    key, err := parsePrivateKey(kb)
+    if err != nil {
+        return nil, fmt.Errorf("parse %s: %w", keyPath, err)
+    }
+    return &CA{Dir: dir, Cert: cert, Key: key}, nil
+}
+
+// LoadOrCreateCA loads the CA in dir, creating a new one if it is missing.
+// The boolean result reports whether a new CA was created.
+func LoadOrCreateCA(dir string) (*CA, bool, error) {
+    ca, err := LoadCA(dir)
+    if err == nil {
+        return ca, false, nil
+    }
+    if !errors.Is(err, ErrNoCA) {
+        return nil, false, err
+    }
+    ca, err = createCA(dir)
+    if err != nil {
+        return nil, false, err
+    }
+    return ca, true, nil
+}
+
+// NewEphemeralCA returns a CA that only lives in memory. Its leaves are not
+// trusted anywhere, so it suits browsers that pin the leaf key instead.
+func NewEphemeralCA() (*CA, error) {
+    ca, _, err := generateCA()
+    return ca, err
+}
+
+func createCA(dir string) (*CA, error) {
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return nil, err
+    }
+    ca, keyDER, err := generateCA()
+    if err != nil {
+        return nil, err
+    }
+    // The key is only readable by its owner; the certificate is public.
+    if err := writePair(dir, CACertName, CAKeyName, ca.Cert.Raw, keyDER); err != nil {
+        return nil, err
+    }
+    ca.Dir = dir
+    return ca, nil
+}
+
+// writePair writes a PEM certificate and its PKCS#8 key into dir. Both go to
+// temporary files first and the certificate is renamed into place last, so
+// an interrupted write never leaves a certificate without its key; LoadCA
+// and EnsureLeaf treat the missing certificate as no pair at all.
+func writePair(dir, certName, keyName string, certDER, keyDER []byte) error {
+    keyTmp, err := writeTemp(dir, keyName, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+    if err != nil {
+        return err
+    }
+    defer os.Remove(keyTmp)
+    certTmp, err := writeTemp(dir, certName, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0o644)
+    if err != nil {
+        return err
+    }
+    defer os.Remove(certTmp)
+    if err := os.Rename(keyTmp, filepath.Join(dir, keyName)); err != nil {
+        return err
+    }
+    return os.Rename(certTmp, filepath.Join(dir, certName))
+}
+
+// writeTemp writes data to a new temporary file in dir, named after name,
+// and returns its path.
+func writeTemp(dir, name string, data []byte, mode os.FileMode) (string, error) {
+    f, err := os.CreateTemp(dir, "."+name+".*")
+    if err != nil {
+        return "", err
+    }
+    if _, err := f.Write(data); err != nil {
+        f.Close()
+        os.Remove(f.Name())
+        return "", err
+    }
+    if err := f.Chmod(mode); err != nil {
+        f.Close()
+        os.Remove(f.Name())
+        return "", err
+    }
+    if err := f.Close(); err != nil {
+        os.Remove(f.Name())
+        return "", err
+    }
+    return f.Name(), nil
+}
+
+// generateCA creates a new root and returns it with its PKCS#8 encoded key.
+func generateCA() (*CA, []byte, error) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return nil, nil, err
+    }
+    skid, err := subjectKeyID(key.Public())
+    if err != nil {
+        return nil, nil, err
+    }
+    host, _ := os.Hostname()
+    name := "reflex local CA"
+    if host != "" {
+        name = fmt.Sprintf("reflex local CA (%s)", host)
+    }
+    tmpl := &x509.Certificate{
+        SerialNumber:          randomSerial(),
+        Subject:               pkix.Name{CommonName: name, Organization: []string{"reflex development CA"}},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(caValidity),
+        KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+        MaxPathLenZero:        true,
+        SubjectKeyId:          skid,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+    if err != nil {
+        return nil, nil, fmt.Errorf("create CA certificate: %w", err)
+    }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {
+        return nil, nil, err
+    }
+    keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+    if err != nil {
+        return nil, nil, err
+    }
+    return &CA{Cert: cert, Key: key}, keyDER, nil
+}
+
+// EnsureLeaf writes cert.pem and key.pem for domains into outDir, signed by
+// the CA. An existing pair is reused if it is still valid for all domains and
+// was issued by this CA.
+func (ca *CA) EnsureLeaf(outDir string, domains ...string) (string, string, error) {
+    if len(domains) == 0 {
+        return "", "", fmt.Errorf("at least one domain required")
+    }
+    certPath := filepath.Join(outDir, "cert.pem")
+    keyPath := filepath.Join(outDir, "key.pem")
+    if fileExists(certPath) && fileExists(keyPath) && ca.leafUsable(certPath, domains) {
+        return certPath, keyPath, nil
+    }
+    if err := os.MkdirAll(outDir, 0o755); err != nil {
+        return "", "", err
+    }
+
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return "", "", err
+    }
+    tmpl := &x509.Certificate{
+        SerialNumber: randomSerial(),
+        Subject:      pkix.Name{CommonName: domains[0], Organization: []string{"reflex development certificate"}},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(leafValidity),
+        KeyUsage:     x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    }
+    for _, d := range domains {
+        if ip := net.ParseIP(d); ip != nil {
+            tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+        } else {
+            tmpl.DNSNames = append(tmpl.DNSNames, d)
+        }
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, key.Public(), ca.Key)
+    if err != nil {
+        return "", "", fmt.Errorf("sign certificate for %s: %w", domains[0], err)
+    }
+    keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+    if err != nil {
+        return "", "", err
+    }
+    if err := writePair(outDir, "cert.pem", "key.pem", der, keyDER); err != nil {
+        return "", "", err
+    }
+    return certPath, keyPath, nil
+}
+
+// leafUsable reports whether the certificate at path covers domains, is
+// within its validity window and chains to ca.
+func (ca *CA) leafUsable(path string, domains []string) bool {
+    b, err := os.ReadFile(path)
+    if err != nil {
+        return false
+    }
+    blk, _ := pem.Decode(b)
+    if blk == nil {
+        return false
+    }
+    leaf, err := x509.ParseCertificate(blk.Bytes)
+    if err != nil {
+        return false
+    }
+    if time.Now().Add(24 * time.Hour).After(leaf.NotAfter) {
+        return false
+    }
+    if leaf.CheckSignatureFrom(ca.Cert) != nil {
+        return false
+    }
+    for _, d := range domains {
+        if leaf.VerifyHostname(d) != nil {
+            return false
+        }
+    }
+    return true
+}
+
+// SPKIHash returns the base64 SHA-256 digest of the public key in the PEM
+// certificate at certFile, the format Chromium expects for
+// --ignore-certificate-errors-spki-list.
+func SPKIHash(certFile string) (string, error) {
+    b, err := os.ReadFile(certFile)
+    if err != nil {
+        return "", err
+    }
+    blk, _ := pem.Decode(b)
+    if blk == nil || blk.Type != "CERTIFICATE" {
+        return "", fmt.Errorf("%s: no certificate PEM block", certFile)
+    }
+    cert, err := x509.ParseCertificate(blk.Bytes)
+    if err != nil {
+        return "", err
+    }
+    sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+    return base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+func parsePrivateKey(b *pem.Block) (crypto.Signer, error) {
+    switch b.Type {
+    case "EC PRIVATE KEY":
+        return x509.ParseECPrivateKey(b.Bytes)
+    case "RSA PRIVATE KEY":
+        return x509.ParsePKCS1PrivateKey(b.Bytes)
+    }
+    k, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+    if err != nil {
+        return nil, err
+    }
+    s, ok := k.(crypto.Signer)
+    if !ok {
+        return nil, fmt.Errorf("unsupported key type %T", k)
+    }
+    return s, nil
+}
+
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+    der, err := x509.MarshalPKIXPublicKey(pub)
+    if err != nil {
+        return nil, err
+    }
+    sum := sha1.Sum(der)
+    return sum[:], nil
+}
+
+func randomSerial() *big.Int {
+    limit := new(big.Int).Lsh(big.NewInt(1), 128)
+    n, err := rand.Int(rand.Reader, limit)
+    if err != nil {
+        return big.NewInt(time.Now().UnixNano())
+    }
+    return n
+}
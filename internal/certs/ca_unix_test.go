@@ -0,0 +1,44 @@
+//go:build !windows
+
+package certs
+
+import (
+    "os"
+    "path/filepath"
+    "syscall"
+    "testing"
+)
+
+func TestChownTreeStopsAtHome(t *testing.T) {
+    if os.Geteuid() != 0 {
+        t.Skip("chown needs root")
+    }
+    home := t.TempDir()
+    dir := filepath.Join(home, ".config", "reflex", "ca")
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(filepath.Join(dir, CAKeyName), []byte("key"), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    if err := chownTree(dir, home, 65534, 65534); err != nil {
+        t.Fatal(err)
+    }
+    for _, p := range []string{filepath.Join(dir, CAKeyName), dir, filepath.Join(home, ".config", "reflex"), filepath.Join(home, ".config")} {
+        if uid := ownerOf(t, p); uid != 65534 {
+            t.Errorf("%s owned by %d; want 65534", p, uid)
+        }
+    }
+    if uid := ownerOf(t, home); uid != 0 {
+        t.Errorf("home owned by %d; want it left alone", uid)
+    }
+}
+
+func ownerOf(t *testing.T, path string) uint32 {
+    t.Helper()
+    fi, err := os.Stat(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return fi.Sys().(*syscall.Stat_t).Uid
+}
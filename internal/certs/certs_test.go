@@ -1,7 +1,13 @@
 package certs
 
 import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
     "os"
+    "path/filepath"
+    "runtime"
+    "strings"
     "testing"
 )
 
@@ -15,3 +21,120 @@ func TestIsMkcertInstalledRespectsPATH(t *testing.T) {
     }
 }
 
+
+func TestNativeCAIssuesTrustedLeaf(t *testing.T) {
+    caDir := t.TempDir()
+    ca, created, err := LoadOrCreateCA(caDir)
+    if err != nil || !created {
+        t.Fatalf("LoadOrCreateCA: created=%v err=%v", created, err)
+    }
+    again, created, err := LoadOrCreateCA(caDir)
+    if err != nil || created {
+        t.Fatalf("reload CA: created=%v err=%v", created, err)
+    }
+    if !again.Cert.Equal(ca.Cert) {
+        t.Fatalf("reloaded CA differs from created CA")
+    }
+
+    out := t.TempDir()
+    certPath, keyPath, err := ca.EnsureLeaf(out, "news.google.com")
+    if err != nil {
+        t.Fatalf("EnsureLeaf: %v", err)
+    }
+    pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+    if err != nil {
+        t.Fatalf("LoadX509KeyPair: %v", err)
+    }
+    leaf, err := x509.ParseCertificate(pair.Certificate[0])
+    if err != nil {
+        t.Fatal(err)
+    }
+    roots := x509.NewCertPool()
+    roots.AddCert(ca.Cert)
+    if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "news.google.com", Roots: roots}); err != nil {
+        t.Fatalf("leaf does not verify against CA: %v", err)
+    }
+
+    // A usable pair is reused; a pair for another host is replaced.
+    before, _ := os.ReadFile(certPath)
+    if _, _, err := ca.EnsureLeaf(out, "news.google.com"); err != nil {
+        t.Fatal(err)
+    }
+    if after, _ := os.ReadFile(certPath); string(after) != string(before) {
+        t.Fatalf("expected existing leaf to be reused")
+    }
+    if _, _, err := ca.EnsureLeaf(out, "t.co"); err != nil {
+        t.Fatal(err)
+    }
+    if after, _ := os.ReadFile(certPath); string(after) == string(before) {
+        t.Fatalf("expected leaf to be reissued for a different host")
+    }
+}
+
+func TestLoadCAMissing(t *testing.T) {
+    if _, err := LoadCA(filepath.Join(t.TempDir(), "none")); !errors.Is(err, ErrNoCA) {
+        t.Fatalf("LoadCA on empty dir: err=%v; want ErrNoCA", err)
+    }
+}
+
+func TestCreateCAAfterInterruptedWrite(t *testing.T) {
+    // A key without its certificate is what an interrupted write leaves;
+    // it counts as no CA and is replaced.
+    dir := t.TempDir()
+    if err := os.WriteFile(filepath.Join(dir, CAKeyName), []byte("partial"), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    if _, created, err := LoadOrCreateCA(dir); err != nil || !created {
+        t.Fatalf("LoadOrCreateCA: created=%v err=%v", created, err)
+    }
+    if _, err := LoadCA(dir); err != nil {
+        t.Fatalf("LoadCA: %v", err)
+    }
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(entries) != 2 {
+        t.Fatalf("expected only %s and %s, got %v", CACertName, CAKeyName, entries)
+    }
+    fi, err := os.Stat(filepath.Join(dir, CAKeyName))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if runtime.GOOS != "windows" && fi.Mode().Perm() != 0o600 {
+        t.Fatalf("key mode %v; want 0600", fi.Mode().Perm())
+    }
+}
+
+func TestEphemeralCAIssuesPinnableLeaf(t *testing.T) {
+    ca, err := NewEphemeralCA()
+    if err != nil {
+        t.Fatalf("NewEphemeralCA: %v", err)
+    }
+    if ca.Dir != "" {
+        t.Fatalf("ephemeral CA has dir %q", ca.Dir)
+    }
+    certPath, _, err := ca.EnsureLeaf(t.TempDir(), "news.google.com")
+    if err != nil {
+        t.Fatalf("EnsureLeaf: %v", err)
+    }
+    pin, err := SPKIHash(certPath)
+    if err != nil || len(pin) != 44 {
+        t.Fatalf("SPKIHash = %q, %v", pin, err)
+    }
+}
+
+func TestDefaultCARootFollowsUser(t *testing.T) {
+    t.Setenv("REFLEX_CAROOT", "/opt/ca")
+    if got := DefaultCARoot(); got != "/opt/ca" {
+        t.Fatalf("DefaultCARoot = %q; want the REFLEX_CAROOT override", got)
+    }
+    t.Setenv("REFLEX_CAROOT", "")
+    t.Setenv("SUDO_UID", "")
+    if os.Geteuid() == 0 {
+        t.Skip("root without sudo uses the system CA root")
+    }
+    if got := DefaultCARoot(); strings.HasPrefix(got, "/etc/") {
+        t.Fatalf("DefaultCARoot = %q; want a directory the user owns", got)
+    }
+}
@@ -0,0 +1,99 @@
+package certs
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "runtime"
+)
+
+// linuxTrustStores lists anchor directories and refresh commands for the
+// common distribution families.
+var linuxTrustStores = []struct {
+    dir     string
+    name    string
+    refresh []string
+}{
+    {"/usr/local/share/ca-certificates", "reflex-rootCA.crt", []string{"update-ca-certificates"}},
+    {"/etc/pki/ca-trust/source/anchors", "reflex-rootCA.pem", []string{"update-ca-trust", "extract"}},
+    {"/etc/ca-certificates/trust-source/anchors", "reflex-rootCA.crt", []string{"trust", "extract-compat"}},
+    {"/usr/share/pki/trust/anchors", "reflex-rootCA.pem", []string{"update-ca-certificates"}},
+}
+
+// InstallCA adds the CA certificate to the system trust store. Browsers that
+// keep their own NSS database (Firefox, Chromium on Linux) are handled when
+// certutil is available; otherwise a hint is printed.
+func InstallCA(ca *CA) error {
+    pemPath := ca.CertPath()
+    switch runtime.GOOS {
+    case "linux":
+        installed := false
+        for _, s := range linuxTrustStores {
+            if st, err := os.Stat(s.dir); err != nil || !st.IsDir() {
+                continue
+            }
+            if _, err := exec.LookPath(s.refresh[0]); err != nil {
+                continue
+            }
+            b, err := os.ReadFile(pemPath)
+            if err != nil {
+                return err
+            }
+            if err := os.WriteFile(filepath.Join(s.dir, s.name), b, 0o644); err != nil {
+                return fmt.Errorf("write %s: %w", s.dir, err)
+            }
+            if out, err := exec.Command(s.refresh[0], s.refresh[1:]...).CombinedOutput(); err != nil {
+                return fmt.Errorf("%s failed: %w\n%s", s.refresh[0], err, out)
+            }
+            installed = true
+            break
+        }
+        if !installed {
+            return fmt.Errorf("no supported system trust store found; import %s manually", pemPath)
+        }
+        installNSS(pemPath)
+    case "darwin":
+        cmd := exec.Command("security", "add-trusted-cert", "-d", "-k", "/Library/Keychains/System.keychain", pemPath)
+        if out, err := cmd.CombinedOutput(); err != nil {
+            return fmt.Errorf("security add-trusted-cert failed: %w\n%s", err, out)
+        }
+        installNSS(pemPath)
+    case "windows":
+        cmd := exec.Command("certutil", "-addstore", "-f", "ROOT", pemPath)
+        if out, err := cmd.CombinedOutput(); err != nil {
+            return fmt.Errorf("certutil -addstore failed: %w\n%s", err, out)
+        }
+    default:
+        return fmt.Errorf("installing the CA is not supported on %s; import %s manually", runtime.GOOS, pemPath)
+    }
+    return nil
+}
+
+// installNSS imports the CA into the NSS databases of the current user. Under
+// sudo those databases belong to the invoking user, so only a hint is printed
+// to avoid leaving root-owned files in their profile.
+func installNSS(pemPath string) {
+    certutil, err := exec.LookPath("certutil")
+    if err != nil || (os.Geteuid() == 0 && os.Getenv("SUDO_USER") != "") {
+        fmt.Println("Note: Firefox and Chromium on Linux keep their own certificate database.")
+        fmt.Println("To trust the reflex CA there, run as your normal user (needs NSS tools):")
+        fmt.Printf("  certutil -d sql:$HOME/.pki/nssdb -A -t C,, -n reflex -i %s\n", pemPath)
+        return
+    }
+    home, err := os.UserHomeDir()
+    if err != nil {
+        return
+    }
+    dbs, _ := filepath.Glob(filepath.Join(home, ".mozilla", "firefox", "*"))
+    dbs = append(dbs, filepath.Join(home, ".pki", "nssdb"))
+    for _, db := range dbs {
+        if !fileExists(filepath.Join(db, "cert9.db")) {
+            continue
+        }
+        cmd := exec.Command(certutil, "-d", "sql:"+db, "-A", "-t", "C,,", "-n", "reflex", "-i", pemPath)
+        if out, err := cmd.CombinedOutput(); err != nil {
+            fmt.Printf("Note: certutil failed for %s: %v\n%s", db, err, out)
+        }
+    }
+}
@@ -0,0 +1,297 @@
+// Package dns is a tiny authoritative DNS responder for the spoofed referrer
+// names. It answers A/AAAA queries for a fixed set of hosts and forwards
+// everything else to an upstream resolver, or refuses it when none is set.
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	typeA    = 1
+	typeAAAA = 28
+	typeANY  = 255
+	classIN  = 1
+
+	rcodeFormErr = 1
+	rcodeRefused = 5
+
+	flagQR = 1 << 15
+	flagAA = 1 << 10
+	flagRD = 1 << 8
+	flagRA = 1 << 7
+
+	headerLen       = 12
+	forwardTimeout  = 3 * time.Second
+	tcpIdleTimeout  = 10 * time.Second
+	maxUDPQuerySize = 4096
+)
+
+// DefaultTTL is used for answers when Config.TTL is zero. It is short so a
+// finished run does not linger in resolver caches.
+const DefaultTTL = 5 * time.Second
+
+// Config configures the responder.
+type Config struct {
+	// Addr is the host:port to listen on for both UDP and TCP.
+	Addr string
+	// Hosts maps names (without trailing dot) to the addresses to answer.
+	Hosts map[string][]net.IP
+	// Upstream is the host:port of a resolver for all other names. Queries
+	// are refused when it is empty.
+	Upstream string
+	// TTL of the synthesized answers.
+	TTL time.Duration
+}
+
+// Server is a running responder.
+type Server struct {
+	cfg   Config
+	hosts map[string][]net.IP
+	udp   net.PacketConn
+	tcp   net.Listener
+	wg    sync.WaitGroup
+}
+
+// Start binds UDP and TCP on cfg.Addr and begins answering queries.
+func Start(cfg Config) (*Server, error) {
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultTTL
+	}
+	s := &Server{cfg: cfg, hosts: make(map[string][]net.IP, len(cfg.Hosts))}
+	for name, ips := range cfg.Hosts {
+		s.hosts[canonical(name)] = ips
+	}
+	udp, err := net.ListenPacket("udp", cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen udp %s: %w", cfg.Addr, err)
+	}
+	// Bind TCP on the port UDP actually got, so ":0" works for tests.
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		return nil, fmt.Errorf("listen tcp %s: %w", cfg.Addr, err)
+	}
+	s.udp, s.tcp = udp, tcp
+	s.wg.Add(2)
+	go s.serveUDP()
+	go s.serveTCP()
+	return s, nil
+}
+
+// Addr returns the bound address.
+func (s *Server) Addr() net.Addr { return s.udp.LocalAddr() }
+
+// Close stops the responder and waits for its loops to exit.
+func (s *Server) Close() error {
+	err := errors.Join(s.udp.Close(), s.tcp.Close())
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, maxUDPQuerySize)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		q := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := s.handle(q, "udp"); resp != nil {
+				_, _ = s.udp.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		c, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(c)
+	}
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	defer c.Close()
+	for {
+		_ = c.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		q, err := readTCPMessage(c)
+		if err != nil {
+			return
+		}
+		resp := s.handle(q, "tcp")
+		if resp == nil {
+			return
+		}
+		if err := writeTCPMessage(c, resp); err != nil {
+			return
+		}
+	}
+}
+
+// handle returns the response for one query message, or nil to drop it.
+func (s *Server) handle(q []byte, network string) []byte {
+	if len(q) < headerLen {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(q[2:4])
+	if flags&flagQR != 0 {
+		return nil // not a query
+	}
+	name, qtype, qend, err := parseQuestion(q)
+	if err != nil || binary.BigEndian.Uint16(q[4:6]) != 1 {
+		return reply(q, qend, rcodeFormErr, false, nil)
+	}
+	if ips, ok := s.hosts[canonical(name)]; ok {
+		return reply(q, qend, 0, true, s.answers(ips, qtype))
+	}
+	if s.cfg.Upstream == "" {
+		return reply(q, qend, rcodeRefused, false, nil)
+	}
+	resp, err := forward(q, network, s.cfg.Upstream)
+	if err != nil {
+		log.Printf("dns: forward %s: %v", name, err)
+		return nil
+	}
+	return resp
+}
+
+// answers encodes resource records for the matching address family. A name
+// we own but without addresses of the asked type yields an empty answer.
+func (s *Server) answers(ips []net.IP, qtype uint16) [][]byte {
+	var out [][]byte
+	ttl := uint32(s.cfg.TTL / time.Second)
+	for _, ip := range ips {
+		var rtype uint16
+		var data []byte
+		if v4 := ip.To4(); v4 != nil {
+			rtype, data = typeA, v4
+		} else {
+			rtype, data = typeAAAA, ip.To16()
+		}
+		if qtype != rtype && qtype != typeANY {
+			continue
+		}
+		rr := []byte{0xC0, headerLen} // pointer to the question name
+		rr = binary.BigEndian.AppendUint16(rr, rtype)
+		rr = binary.BigEndian.AppendUint16(rr, classIN)
+		rr = binary.BigEndian.AppendUint32(rr, ttl)
+		rr = binary.BigEndian.AppendUint16(rr, uint16(len(data)))
+		out = append(out, append(rr, data...))
+	}
+	return out
+}
+
+// reply builds a response echoing the question section of q.
+func reply(q []byte, qend int, rcode uint16, authoritative bool, answers [][]byte) []byte {
+	if qend <= headerLen || qend > len(q) {
+		qend = headerLen
+	}
+	resp := make([]byte, 0, qend+len(answers)*28)
+	resp = append(resp, q[:2]...) // id
+	flags := flagQR | flagRA | (binary.BigEndian.Uint16(q[2:4]) & flagRD) | rcode
+	if authoritative {
+		flags |= flagAA
+	}
+	resp = binary.BigEndian.AppendUint16(resp, flags)
+	qd := uint16(0)
+	if qend > headerLen {
+		qd = 1
+	}
+	resp = binary.BigEndian.AppendUint16(resp, qd)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(answers)))
+	resp = binary.BigEndian.AppendUint16(resp, 0) // authority
+	resp = binary.BigEndian.AppendUint16(resp, 0) // additional
+	resp = append(resp, q[headerLen:qend]...)
+	for _, rr := range answers {
+		resp = append(resp, rr...)
+	}
+	return resp
+}
+
+// parseQuestion decodes the first question and returns its name, type and
+// the offset just past it. Compression pointers are not valid here.
+func parseQuestion(q []byte) (string, uint16, int, error) {
+	var labels []string
+	i := headerLen
+	for {
+		if i >= len(q) {
+			return "", 0, 0, errors.New("truncated name")
+		}
+		l := int(q[i])
+		i++
+		if l == 0 {
+			break
+		}
+		if l&0xC0 != 0 || i+l > len(q) {
+			return "", 0, 0, errors.New("bad label")
+		}
+		labels = append(labels, string(q[i:i+l]))
+		i += l
+	}
+	if i+4 > len(q) {
+		return "", 0, 0, errors.New("truncated question")
+	}
+	qtype := binary.BigEndian.Uint16(q[i : i+2])
+	return strings.Join(labels, "."), qtype, i + 4, nil
+}
+
+func forward(q []byte, network, upstream string) ([]byte, error) {
+	c, err := net.DialTimeout(network, upstream, forwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(forwardTimeout))
+	if network == "tcp" {
+		if err := writeTCPMessage(c, q); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(c)
+	}
+	if _, err := c.Write(q); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := c.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, len(msg)+2), uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+func canonical(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,161 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func query(id uint16, name string, qtype uint16) []byte {
+	q := binary.BigEndian.AppendUint16(nil, id)
+	q = binary.BigEndian.AppendUint16(q, flagRD)
+	q = append(q, 0, 1, 0, 0, 0, 0, 0, 0)
+	for _, l := range strings.Split(name, ".") {
+		q = append(q, byte(len(l)))
+		q = append(q, l...)
+	}
+	q = append(q, 0)
+	q = binary.BigEndian.AppendUint16(q, qtype)
+	return binary.BigEndian.AppendUint16(q, classIN)
+}
+
+type answer struct {
+	id      uint16
+	rcode   uint16
+	aa      bool
+	ancount int
+	ips     []net.IP
+}
+
+func parseAnswer(t *testing.T, b []byte) answer {
+	t.Helper()
+	if len(b) < headerLen {
+		t.Fatalf("short response: %d bytes", len(b))
+	}
+	flags := binary.BigEndian.Uint16(b[2:4])
+	a := answer{
+		id:      binary.BigEndian.Uint16(b[0:2]),
+		rcode:   flags & 0xF,
+		aa:      flags&flagAA != 0,
+		ancount: int(binary.BigEndian.Uint16(b[6:8])),
+	}
+	if binary.BigEndian.Uint16(b[4:6]) == 0 {
+		return a
+	}
+	_, _, i, err := parseQuestion(b)
+	if err != nil {
+		t.Fatalf("parse echoed question: %v", err)
+	}
+	for n := 0; n < a.ancount; n++ {
+		i += 2 + 8 // name pointer, type, class, ttl
+		l := int(binary.BigEndian.Uint16(b[i : i+2]))
+		i += 2
+		a.ips = append(a.ips, net.IP(b[i:i+l]))
+		i += l
+	}
+	return a
+}
+
+func exchangeUDP(t *testing.T, addr string, q []byte) answer {
+	t.Helper()
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write(q); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parseAnswer(t, buf[:n])
+}
+
+func startTest(t *testing.T, upstream string) *Server {
+	t.Helper()
+	s, err := Start(Config{
+		Addr:     "127.0.0.1:0",
+		Hosts:    map[string][]net.IP{"News.Google.com": {net.ParseIP("127.0.0.1"), net.ParseIP("::1")}},
+		Upstream: upstream,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestAnswersSpoofedNames(t *testing.T) {
+	s := startTest(t, "")
+	addr := s.Addr().String()
+
+	a := exchangeUDP(t, addr, query(7, "news.google.com", typeA))
+	if a.id != 7 || a.rcode != 0 || !a.aa || a.ancount != 1 || !a.ips[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("A answer = %+v", a)
+	}
+	a = exchangeUDP(t, addr, query(8, "NEWS.google.com", typeAAAA))
+	if a.rcode != 0 || a.ancount != 1 || !a.ips[0].Equal(net.ParseIP("::1")) {
+		t.Fatalf("AAAA answer = %+v", a)
+	}
+	// A name we own without records of the asked type is NODATA, not NXDOMAIN.
+	a = exchangeUDP(t, addr, query(9, "news.google.com", 16))
+	if a.rcode != 0 || a.ancount != 0 || !a.aa {
+		t.Fatalf("TXT answer = %+v", a)
+	}
+}
+
+func TestRefusesOtherNamesWithoutUpstream(t *testing.T) {
+	s := startTest(t, "")
+	a := exchangeUDP(t, s.Addr().String(), query(1, "example.com", typeA))
+	if a.rcode != rcodeRefused || a.ancount != 0 {
+		t.Fatalf("answer = %+v, want REFUSED", a)
+	}
+}
+
+func TestForwardsToUpstream(t *testing.T) {
+	up, err := Start(Config{Addr: "127.0.0.1:0", Hosts: map[string][]net.IP{"example.com": {net.ParseIP("192.0.2.1")}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	s := startTest(t, up.Addr().String())
+
+	a := exchangeUDP(t, s.Addr().String(), query(2, "example.com", typeA))
+	if a.id != 2 || a.rcode != 0 || a.ancount != 1 || !a.ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("forwarded answer = %+v", a)
+	}
+}
+
+func TestTCP(t *testing.T) {
+	s := startTest(t, "")
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for id := uint16(1); id <= 2; id++ {
+		if err := writeTCPMessage(c, query(id, "news.google.com", typeA)); err != nil {
+			t.Fatal(err)
+		}
+		b, err := readTCPMessage(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a := parseAnswer(t, b); a.id != id || a.ancount != 1 {
+			t.Fatalf("answer %d = %+v", id, a)
+		}
+	}
+}
+
+func TestMalformedQuery(t *testing.T) {
+	s := startTest(t, "")
+	q := query(3, "news.google.com", typeA)
+	a := exchangeUDP(t, s.Addr().String(), q[:headerLen+4])
+	if a.rcode != rcodeFormErr {
+		t.Fatalf("answer = %+v, want FORMERR", a)
+	}
+}
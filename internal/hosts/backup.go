@@ -0,0 +1,177 @@
+package hosts
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+// DefaultKeepBackups is how many backups a Manager keeps when KeepBackups
+// is zero.
+const DefaultKeepBackups = 10
+
+// Backup is a copy of the hosts file taken before reflex changed it.
+type Backup struct {
+    // ID is a prefix of the SHA-256 of the contents; backups with the same
+    // contents share it.
+    ID   string
+    Path string
+    Time time.Time
+    Size int64
+}
+
+// contentID returns the backup ID of data.
+func contentID(data []byte) string {
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:])[:12]
+}
+
+func (m Manager) keep() int {
+    if m.KeepBackups > 0 {
+        return m.KeepBackups
+    }
+    return DefaultKeepBackups
+}
+
+// Backups returns the backups of the hosts file, newest first. Files
+// written by older versions, named hosts.reflex.<timestamp>.bak, are
+// included; their ID is computed from their contents.
+func (m Manager) Backups() ([]Backup, error) {
+    paths, err := filepath.Glob(globEscape(m.Path) + ".reflex.*.bak")
+    if err != nil {
+        return nil, err
+    }
+    var out []Backup
+    for _, p := range paths {
+        fi, err := os.Stat(p)
+        if err != nil || !fi.Mode().IsRegular() {
+            continue
+        }
+        name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), filepath.Base(m.Path)+".reflex."), ".bak")
+        id := ""
+        if _, h, ok := strings.Cut(name, "."); ok && len(h) == 12 {
+            id = h
+        } else {
+            data, err := os.ReadFile(p)
+            if err != nil {
+                continue
+            }
+            id = contentID(data)
+        }
+        out = append(out, Backup{ID: id, Path: p, Time: fi.ModTime(), Size: fi.Size()})
+    }
+    sort.SliceStable(out, func(i, j int) bool { return out[i].Time.After(out[j].Time) })
+    return out, nil
+}
+
+// FindBackup returns the backup whose ID starts with prefix.
+func (m Manager) FindBackup(prefix string) (Backup, error) {
+    if len(prefix) < 4 {
+        return Backup{}, fmt.Errorf("backup id %q is too short; give at least 4 characters", prefix)
+    }
+    list, err := m.Backups()
+    if err != nil {
+        return Backup{}, err
+    }
+    var found *Backup
+    for i, b := range list {
+        if !strings.HasPrefix(b.ID, strings.ToLower(prefix)) {
+            continue
+        }
+        if found != nil && found.ID != b.ID {
+            return Backup{}, fmt.Errorf("backup id %q is ambiguous", prefix)
+        }
+        if found == nil {
+            found = &list[i]
+        }
+    }
+    if found == nil {
+        return Backup{}, fmt.Errorf("no backup with id %q", prefix)
+    }
+    return *found, nil
+}
+
+// backup saves data as the newest backup and prunes the history. When a
+// backup with the same contents exists it is reused and marked as newest
+// instead of written again.
+func (m Manager) backup(data []byte) (string, error) {
+    id := contentID(data)
+    list, err := m.Backups()
+    if err != nil {
+        return "", err
+    }
+    now := time.Now()
+    path := ""
+    for _, b := range list {
+        if b.ID == id {
+            path = b.Path
+            break
+        }
+    }
+    if path == "" {
+        path = fmt.Sprintf("%s.reflex.%s.%s.bak", m.Path, now.Format("20060102-150405"), id)
+        if err := os.WriteFile(path, data, 0o644); err != nil {
+            return "", err
+        }
+    } else if err := os.Chtimes(path, now, now); err != nil {
+        return "", err
+    }
+    return path, m.prune(path)
+}
+
+// prune deletes duplicate backups and all but the newest KeepBackups
+// backups. keep is never deleted.
+func (m Manager) prune(keep string) error {
+    list, err := m.Backups()
+    if err != nil {
+        return err
+    }
+    seen := make(map[string]bool)
+    kept := 0
+    for _, b := range list {
+        if b.Path != keep && (seen[b.ID] || kept >= m.keep()) {
+            if err := os.Remove(b.Path); err != nil && !os.IsNotExist(err) {
+                return err
+            }
+            continue
+        }
+        seen[b.ID] = true
+        kept++
+    }
+    return nil
+}
+
+// Restore replaces the hosts file with the contents of the backup whose ID
+// starts with id. The current contents are backed up first, so a restore
+// can itself be undone.
+func (m Manager) Restore(id string) (Backup, error) {
+    b, err := m.FindBackup(id)
+    if err != nil {
+        return Backup{}, err
+    }
+    data, err := os.ReadFile(b.Path)
+    if err != nil {
+        return Backup{}, err
+    }
+    return b, m.edit(func(cur []byte) ([]byte, error) {
+        if string(cur) == string(data) {
+            return nil, nil
+        }
+        return data, nil
+    })
+}
+
+// globEscape quotes the glob metacharacters of a path.
+func globEscape(path string) string {
+    r := strings.NewReplacer(`*`, `\*`, `?`, `\?`, `[`, `\[`)
+    if filepath.Separator == '\\' {
+        // Backslash separates paths on Windows and cannot escape there.
+        r = strings.NewReplacer(`*`, `[*]`, `?`, `[?]`, `[`, `[[]`)
+    }
+    return r.Replace(path)
+}
@@ -0,0 +1,160 @@
+package hosts
+
+import (
+    "fmt"
+    "strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 2
+
+// maxDiffCells bounds the LCS table; larger changes are shown as one block
+// of removed lines followed by the added ones.
+const maxDiffCells = 4 << 20
+
+// Diff returns a unified diff of the lines of a and b, or "" when they are
+// equal.
+func Diff(aName, bName string, a, b []byte) string {
+    if string(a) == string(b) {
+        return ""
+    }
+    x, y := splitLines(a), splitLines(b)
+    ops := diffLines(x, y)
+
+    var sb strings.Builder
+    fmt.Fprintf(&sb, "--- %s\n+++ %s\n", aName, bName)
+    for i := 0; i < len(ops); {
+        if ops[i].kind == ' ' {
+            i++
+            continue
+        }
+        // Grow the hunk until diffContext*2 unchanged lines separate it
+        // from the next change.
+        start := i - diffContext
+        if start < 0 {
+            start = 0
+        }
+        end := i
+        for end < len(ops) {
+            if ops[end].kind != ' ' {
+                end++
+                continue
+            }
+            run := end
+            for run < len(ops) && ops[run].kind == ' ' {
+                run++
+            }
+            if run == len(ops) || run-end > 2*diffContext {
+                end += diffContext
+                if end > len(ops) {
+                    end = len(ops)
+                }
+                break
+            }
+            end = run
+        }
+        ai, bi, an, bn := ops[start].a, ops[start].b, 0, 0
+        for _, op := range ops[start:end] {
+            if op.kind != '+' {
+                an++
+            }
+            if op.kind != '-' {
+                bn++
+            }
+        }
+        fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", ai+1, an, bi+1, bn)
+        for _, op := range ops[start:end] {
+            sb.WriteByte(op.kind)
+            sb.WriteString(op.line)
+            sb.WriteByte('\n')
+        }
+        i = end
+    }
+    return sb.String()
+}
+
+type diffOp struct {
+    kind byte // ' ', '-' or '+'
+    line string
+    a, b int // line index in a and b before this op
+}
+
+func splitLines(data []byte) []string {
+    s := strings.TrimSuffix(string(data), "\n")
+    if s == "" {
+        return nil
+    }
+    return strings.Split(s, "\n")
+}
+
+// diffLines returns the edit script from x to y: common prefix and suffix,
+// and a longest common subsequence of the lines in between.
+func diffLines(x, y []string) []diffOp {
+    pre := 0
+    for pre < len(x) && pre < len(y) && x[pre] == y[pre] {
+        pre++
+    }
+    suf := 0
+    for suf < len(x)-pre && suf < len(y)-pre && x[len(x)-1-suf] == y[len(y)-1-suf] {
+        suf++
+    }
+    mx, my := x[pre:len(x)-suf], y[pre:len(y)-suf]
+
+    var ops []diffOp
+    for i := 0; i < pre; i++ {
+        ops = append(ops, diffOp{' ', x[i], i, i})
+    }
+    ai, bi := pre, pre
+    emit := func(kind byte, line string) {
+        ops = append(ops, diffOp{kind, line, ai, bi})
+        if kind != '+' {
+            ai++
+        }
+        if kind != '-' {
+            bi++
+        }
+    }
+    if (len(mx)+1)*(len(my)+1) > maxDiffCells {
+        for _, l := range mx {
+            emit('-', l)
+        }
+        for _, l := range my {
+            emit('+', l)
+        }
+    } else {
+        // lcs[i][j] is the LCS length of mx[i:] and my[j:].
+        lcs := make([][]int, len(mx)+1)
+        for i := range lcs {
+            lcs[i] = make([]int, len(my)+1)
+        }
+        for i := len(mx) - 1; i >= 0; i-- {
+            for j := len(my) - 1; j >= 0; j-- {
+                if mx[i] == my[j] {
+                    lcs[i][j] = lcs[i+1][j+1] + 1
+                } else if lcs[i+1][j] >= lcs[i][j+1] {
+                    lcs[i][j] = lcs[i+1][j]
+                } else {
+                    lcs[i][j] = lcs[i][j+1]
+                }
+            }
+        }
+        i, j := 0, 0
+        for i < len(mx) || j < len(my) {
+            switch {
+            case i < len(mx) && j < len(my) && mx[i] == my[j]:
+                emit(' ', mx[i])
+                i, j = i+1, j+1
+            case j == len(my) || (i < len(mx) && lcs[i+1][j] >= lcs[i][j+1]):
+                emit('-', mx[i])
+                i++
+            default:
+                emit('+', my[j])
+                j++
+            }
+        }
+    }
+    for i := len(x) - suf; i < len(x); i++ {
+        emit(' ', x[i])
+    }
+    return ops
+}
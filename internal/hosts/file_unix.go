@@ -0,0 +1,87 @@
+//go:build !windows
+
+package hosts
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// lockTimeout bounds how long lockFile waits for another editor; tests
+// shorten it.
+var lockTimeout = 10 * time.Second
+
+// lockFile takes an exclusive flock on path, creating it if needed, and
+// returns the function that releases it. It gives up after lockTimeout,
+// naming the process holding the lock when it can. A planted symlink is
+// not followed.
+func lockFile(path string) (func(), error) {
+    f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW, 0o644)
+    if errors.Is(err, os.ErrPermission) {
+        // A lock another user made; flock only needs it open.
+        f, err = os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+    }
+    if err != nil {
+        return nil, err
+    }
+    deadline := time.Now().Add(lockTimeout)
+    for {
+        err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+        if err == nil {
+            break
+        }
+        if !errors.Is(err, syscall.EWOULDBLOCK) || time.Now().After(deadline) {
+            holder := "another process"
+            if b, rerr := os.ReadFile(path); rerr == nil && strings.HasPrefix(string(b), "pid=") {
+                holder = "pid " + strings.TrimSpace(strings.TrimPrefix(string(b), "pid="))
+            }
+            f.Close()
+            if errors.Is(err, syscall.EWOULDBLOCK) {
+                return nil, fmt.Errorf("hosts file locked by %s for %s (%s)", holder, lockTimeout, path)
+            }
+            return nil, err
+        }
+        time.Sleep(50 * time.Millisecond)
+    }
+    // Record the holder for whoever waits next.
+    if f.Truncate(0) == nil {
+        _, _ = f.WriteAt([]byte(fmt.Sprintf("pid=%d\n", os.Getpid())), 0)
+    }
+    return func() {
+        _ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+        _ = f.Close()
+    }, nil
+}
+
+// chown gives f the owner and group of fi. Only root can change them, so it
+// is skipped when they already match.
+func chown(f *os.File, fi os.FileInfo) error {
+    st, ok := fi.Sys().(*syscall.Stat_t)
+    if !ok || (int(st.Uid) == os.Geteuid() && int(st.Gid) == os.Getegid()) {
+        return nil
+    }
+    return f.Chown(int(st.Uid), int(st.Gid))
+}
+
+// syncDir flushes the directory entry of a rename to disk.
+func syncDir(dir string) error {
+    d, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    defer d.Close()
+    if err := d.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) {
+        return err
+    }
+    return nil
+}
+
+// isBusy reports whether a rename failed because the target is a mount
+// point, as /etc/hosts is in most containers.
+func isBusy(err error) bool {
+    return errors.Is(err, syscall.EBUSY)
+}
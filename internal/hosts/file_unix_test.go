@@ -0,0 +1,57 @@
+//go:build !windows
+
+package hosts
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestLockFileGivesUp(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "hosts.reflex.lock")
+    unlock, err := lockFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer unlock()
+
+    old := lockTimeout
+    lockTimeout = 100 * time.Millisecond
+    defer func() { lockTimeout = old }()
+    start := time.Now()
+    _, err = lockFile(path)
+    if err == nil {
+        t.Fatal("second lock taken while the first is held")
+    }
+    if want := fmt.Sprintf("locked by pid %d", os.Getpid()); !strings.Contains(err.Error(), want) {
+        t.Errorf("err = %v; want it to say %q", err, want)
+    }
+    if d := time.Since(start); d > 2*time.Second {
+        t.Errorf("waited %s", d)
+    }
+
+    unlock()
+    again, err := lockFile(path)
+    if err != nil {
+        t.Fatalf("lock after release: %v", err)
+    }
+    again()
+}
+
+func TestLockFileRefusesSymlink(t *testing.T) {
+    dir := t.TempDir()
+    target := filepath.Join(dir, "target")
+    if err := os.Symlink(target, filepath.Join(dir, "hosts.reflex.lock")); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := lockFile(filepath.Join(dir, "hosts.reflex.lock")); err == nil {
+        t.Fatal("lock followed a symlink")
+    }
+    if _, err := os.Lstat(target); err == nil {
+        t.Error("symlink target created")
+    }
+}
@@ -0,0 +1,25 @@
+//go:build windows
+
+package hosts
+
+import (
+    "errors"
+    "os"
+    "syscall"
+)
+
+// lockFile is a no-op on Windows: the standard library has no advisory
+// locks there, so only the reflex instance lock guards concurrent edits.
+func lockFile(path string) (func(), error) { return func() {}, nil }
+
+// chown is a no-op: the new file inherits the ACL of the directory.
+func chown(f *os.File, fi os.FileInfo) error { return nil }
+
+func syncDir(dir string) error { return nil }
+
+// isBusy reports whether a rename failed because another process, such as
+// the DNS client service or a virus scanner, holds the hosts file open.
+func isBusy(err error) bool {
+    const errSharingViolation = syscall.Errno(32)
+    return errors.Is(err, errSharingViolation) || errors.Is(err, syscall.ERROR_ACCESS_DENIED)
+}
@@ -1,14 +1,15 @@
 package hosts
 
 import (
-    "bufio"
+    "bytes"
     "errors"
     "fmt"
+    "io/fs"
+    "net"
     "os"
     "path/filepath"
     "runtime"
     "strings"
-    "time"
 )
 
 const tag = "# reflex-managed"
@@ -28,106 +29,259 @@ func PathOrDefault(path string) string {
     return "/etc/hosts"
 }
 
-type Manager struct{ Path string }
+type Manager struct {
+    Path string
+    // KeepBackups bounds the backup history; zero means DefaultKeepBackups.
+    KeepBackups int
+}
 
-// Add ensures a managed hosts entry exists for domain -> ip.
+// Add ensures a managed hosts entry exists for domain -> ip. A managed
+// entry mapping domain to another address of the same family is replaced.
+// Entries reflex does not manage that map domain elsewhere are left alone
+// and reported as a *ConflictError, since they would win over the new one.
 func (m Manager) Add(ip, domain string) error {
     if ip == "" || domain == "" {
         return fmt.Errorf("ip and domain required")
     }
-    path := m.Path
-    // Read current content
-    data, err := os.ReadFile(path)
-    if err != nil {
-        return err
+    family := net.ParseIP(ip).To4() != nil
+    return m.edit(func(data []byte) ([]byte, error) {
+        f := Parse(data)
+        if c := f.Conflicts(domain, ip); len(c) > 0 {
+            return nil, &ConflictError{Path: m.Path, Conflicts: c}
+        }
+        for _, i := range f.Find(domain) {
+            if l := f.Lines[i]; l.Managed() && l.IP == ip {
+                return nil, ErrAlreadyPresent
+            }
+        }
+        f.removeManaged(domain, func(l Line) bool {
+            return (net.ParseIP(l.IP).To4() != nil) == family
+        })
+        f.Append(EntryLine(ip, domain))
+        return f.Bytes(), nil
+    })
+}
+
+// EntryLine returns the hosts line Add writes for domain -> ip.
+func EntryLine(ip, domain string) string {
+    return fmt.Sprintf("%s %s %s", ip, domain, tag)
+}
+
+// Remove deletes the managed entry for the given domain (if present). Only
+// exact matches count: removing google.com leaves news.google.com alone.
+func (m Manager) Remove(domain string) error {
+    if domain == "" {
+        return fmt.Errorf("domain required")
     }
-    line := fmt.Sprintf("%s %s %s", ip, domain, tag)
-    if strings.Contains(string(data), line) {
-        return ErrAlreadyPresent
+    return m.edit(func(data []byte) ([]byte, error) {
+        f := Parse(data)
+        if f.removeManaged(domain, func(Line) bool { return true }) == 0 {
+            return nil, nil
+        }
+        f.trimTrailingBlank()
+        return f.Bytes(), nil
+    })
+}
+
+// Contains reports if a managed entry exists for the domain.
+func (m Manager) Contains(domain string) (bool, string, error) {
+    entries, err := m.Entries(domain)
+    if err != nil || len(entries) == 0 {
+        return false, "", err
     }
+    return true, strings.TrimSuffix(entries[0].Raw, "\r"), nil
+}
 
-    // Backup once per day with timestamp to be safe
-    ts := time.Now().Format("20060102-150405")
-    _ = os.WriteFile(path+".reflex."+ts+".bak", data, 0o644)
+// Entries returns the managed entries for the domain, one per address.
+func (m Manager) Entries(domain string) ([]Line, error) {
+    data, err := os.ReadFile(m.Path)
+    if err != nil {
+        return nil, err
+    }
+    f := Parse(data)
+    var out []Line
+    for _, i := range f.Find(domain) {
+        if l := f.Lines[i]; l.Managed() {
+            out = append(out, l)
+        }
+    }
+    return out, nil
+}
 
-    f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+// Managed returns all entries managed by Reflex, regardless of domain.
+func (m Manager) Managed() ([]Line, error) {
+    data, err := os.ReadFile(m.Path)
     if err != nil {
-        return err
+        return nil, err
     }
-    defer f.Close()
-    if _, err := f.WriteString("\n" + line + "\n"); err != nil {
-        return err
+    var out []Line
+    for _, l := range Parse(data).Lines {
+        if l.Managed() {
+            out = append(out, l)
+        }
     }
-    return nil
+    return out, nil
 }
 
-// Remove deletes the managed entry for the given domain (if present).
-func (m Manager) Remove(domain string) error {
-    if domain == "" {
-        return fmt.Errorf("domain required")
+// RemoveAllTagged removes all entries managed by Reflex, regardless of domain.
+func (m Manager) RemoveAllTagged() (int, error) {
+    removed := 0
+    err := m.edit(func(data []byte) ([]byte, error) {
+        f := Parse(data)
+        kept := f.Lines[:0]
+        for _, l := range f.Lines {
+            if l.Managed() {
+                removed++
+                continue
+            }
+            kept = append(kept, l)
+        }
+        if removed == 0 {
+            return nil, nil
+        }
+        f.Lines = kept
+        f.trimTrailingBlank()
+        return f.Bytes(), nil
+    })
+    if err != nil {
+        return 0, err
     }
-    path := m.Path
-    in, err := os.Open(path)
+    return removed, nil
+}
+
+// writeFile replaces the contents of the hosts file; tests swap it out.
+var writeFile = replaceFile
+
+// edit runs one read-modify-write cycle of the hosts file under an advisory
+// lock. change returns the new contents, or nil to leave the file alone.
+// The original is backed up first, the new contents are written atomically
+// and read back, and the backup is restored if that check fails.
+func (m Manager) edit(change func(data []byte) ([]byte, error)) error {
+    path, err := filepath.EvalSymlinks(m.Path)
     if err != nil {
         return err
     }
-    defer in.Close()
+    unlock, err := lockFile(lockPath(path))
+    if err != nil {
+        return fmt.Errorf("lock hosts file: %w", err)
+    }
+    defer unlock()
 
-    var b strings.Builder
-    s := bufio.NewScanner(in)
-    removed := false
-    for s.Scan() {
-        line := s.Text()
-        if strings.Contains(line, tag) && strings.Contains(line, domain) {
-            removed = true
-            continue
-        }
-        b.WriteString(line)
-        b.WriteByte('\n')
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return err
     }
-    if err := s.Err(); err != nil {
+    updated, err := change(data)
+    if err != nil || updated == nil {
         return err
     }
-    if !removed {
+    fi, err := os.Stat(path)
+    if err != nil {
+        return err
+    }
+
+    backup, err := m.backup(data)
+    if err != nil {
+        return fmt.Errorf("back up hosts file: %w", err)
+    }
+
+    err = writeFile(path, updated, fi)
+    if err == nil {
+        err = verify(path, updated)
+    }
+    if err == nil {
         return nil
     }
-    return os.WriteFile(path, []byte(strings.TrimRight(b.String(), "\n")+"\n"), 0o644)
+    if rerr := restore(path, backup, fi); rerr != nil {
+        return fmt.Errorf("%w; restoring %s also failed: %v", err, backup, rerr)
+    }
+    return fmt.Errorf("%w (restored from %s)", err, backup)
 }
 
-// Contains reports if a managed entry exists for the domain.
-func (m Manager) Contains(domain string) (bool, string, error) {
-    data, err := os.ReadFile(m.Path)
+// lockPath returns the advisory lock of the hosts file at path. path must
+// be resolved, so every link to the file shares the lock.
+func lockPath(path string) string { return path + ".reflex.lock" }
+
+// verify reads path back and checks it holds want.
+func verify(path string, want []byte) error {
+    got, err := os.ReadFile(path)
     if err != nil {
-        return false, "", err
+        return fmt.Errorf("verify hosts file: %w", err)
     }
-    lines := strings.Split(string(data), "\n")
-    for _, l := range lines {
-        if strings.Contains(l, tag) && strings.Contains(l, domain) {
-            return true, l, nil
-        }
+    if !bytes.Equal(got, want) {
+        return fmt.Errorf("verify hosts file: %s does not contain what was written", path)
     }
-    return false, "", nil
+    return nil
 }
 
-// RemoveAllTagged removes all entries managed by Reflex, regardless of domain.
-func (m Manager) RemoveAllTagged() (int, error) {
-    data, err := os.ReadFile(m.Path)
+// restore puts the contents of backup back into path.
+func restore(path, backup string, fi os.FileInfo) error {
+    data, err := os.ReadFile(backup)
     if err != nil {
-        return 0, err
+        return err
     }
-    lines := strings.Split(string(data), "\n")
-    var out []string
-    removed := 0
-    for _, l := range lines {
-        if strings.Contains(l, tag) {
-            removed++
-            continue
+    if err := replaceFile(path, data, fi); err != nil {
+        return err
+    }
+    return verify(path, data)
+}
+
+// replaceFile writes data to a temporary file next to path, syncs it, gives
+// it the mode and owner of fi and renames it over path, so readers see
+// either the old or the new file and never a truncated one. Where path
+// cannot be replaced, as with a hosts file bind-mounted into a container,
+// it falls back to rewriting path in place.
+func replaceFile(path string, data []byte, fi os.FileInfo) error {
+    dir := filepath.Dir(path)
+    tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".reflex-*")
+    if err != nil {
+        if errors.Is(err, fs.ErrPermission) {
+            return rewriteFile(path, data)
+        }
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := chown(tmp, fi); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp.Name(), path); err != nil {
+        if isBusy(err) {
+            return rewriteFile(path, data)
         }
-        out = append(out, l)
+        return err
+    }
+    return syncDir(dir)
+}
+
+// rewriteFile truncates path and writes data into it, keeping its inode.
+func rewriteFile(path string, data []byte) error {
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+    if err != nil {
+        return err
     }
-    if removed == 0 {
-        return 0, nil
+    if _, err := f.Write(data); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return err
     }
-    s := strings.TrimRight(strings.Join(out, "\n"), "\n") + "\n"
-    return removed, os.WriteFile(m.Path, []byte(s), 0o644)
+    return f.Close()
 }
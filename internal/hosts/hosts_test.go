@@ -1,11 +1,41 @@
 package hosts
 
 import (
+    "errors"
+    "fmt"
     "os"
     "path/filepath"
+    "reflect"
+    "runtime"
+    "strings"
+    "sync"
     "testing"
 )
 
+func TestLockOnResolvedPath(t *testing.T) {
+    dir := t.TempDir()
+    real := filepath.Join(dir, "hosts.real")
+    if err := os.WriteFile(real, []byte("127.0.0.1 localhost\n"), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    link := filepath.Join(dir, "hosts")
+    if err := os.Symlink(real, link); err != nil {
+        t.Skipf("symlink: %v", err)
+    }
+    if err := (Manager{Path: link}).Add("127.0.0.1", "example.test"); err != nil {
+        t.Fatalf("Add: %v", err)
+    }
+    if runtime.GOOS == "windows" {
+        return
+    }
+    if _, err := os.Stat(real + ".reflex.lock"); err != nil {
+        t.Errorf("no lock beside the resolved path: %v", err)
+    }
+    if _, err := os.Lstat(link + ".reflex.lock"); err == nil {
+        t.Errorf("lock taken on the link")
+    }
+}
+
 func TestAddRemoveContains(t *testing.T) {
     dir := t.TempDir()
     hp := filepath.Join(dir, "hosts")
@@ -61,3 +91,286 @@ func TestAddDuplicateAndRemoveAllTagged(t *testing.T) {
         t.Fatalf("RemoveAllTagged removed %d; want 2", n)
     }
 }
+
+func TestEditKeepsModeAndSymlink(t *testing.T) {
+    dir := t.TempDir()
+    real := filepath.Join(dir, "hosts.real")
+    if err := os.WriteFile(real, []byte("127.0.0.1 localhost\n"), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    hp := filepath.Join(dir, "hosts")
+    if err := os.Symlink(real, hp); err != nil {
+        t.Skipf("symlink: %v", err)
+    }
+    m := Manager{Path: hp}
+    if err := m.Add("127.0.0.1", "example.test"); err != nil {
+        t.Fatalf("Add: %v", err)
+    }
+    if fi, err := os.Lstat(hp); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+        t.Fatalf("hosts symlink replaced: %v %v", fi, err)
+    }
+    fi, err := os.Stat(real)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if fi.Mode().Perm() != 0o600 {
+        t.Fatalf("mode = %v; want 0600", fi.Mode().Perm())
+    }
+    entries, _ := os.ReadDir(dir)
+    for _, e := range entries {
+        if strings.Contains(e.Name(), ".reflex-") {
+            t.Fatalf("temporary file left behind: %s", e.Name())
+        }
+    }
+}
+
+func TestEditRestoresBackupWhenVerifyFails(t *testing.T) {
+    dir := t.TempDir()
+    hp := filepath.Join(dir, "hosts")
+    orig := "127.0.0.1 localhost\n"
+    if err := os.WriteFile(hp, []byte(orig), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    writeFile = func(path string, data []byte, fi os.FileInfo) error {
+        return os.WriteFile(path, data[:len(data)/2], 0o644)
+    }
+    defer func() { writeFile = replaceFile }()
+
+    err := Manager{Path: hp}.Add("127.0.0.1", "example.test")
+    if err == nil || !strings.Contains(err.Error(), "restored from") {
+        t.Fatalf("Add err = %v; want verification failure and restore", err)
+    }
+    got, _ := os.ReadFile(hp)
+    if string(got) != orig {
+        t.Fatalf("hosts = %q; want original %q", got, orig)
+    }
+}
+
+func TestConcurrentEdits(t *testing.T) {
+    dir := t.TempDir()
+    hp := filepath.Join(dir, "hosts")
+    if err := os.WriteFile(hp, []byte("127.0.0.1 localhost\n"), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    m := Manager{Path: hp}
+    var wg sync.WaitGroup
+    for i := 0; i < 16; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            if err := m.Add("127.0.0.1", fmt.Sprintf("host%d.test", i)); err != nil {
+                t.Errorf("Add %d: %v", i, err)
+            }
+        }(i)
+    }
+    wg.Wait()
+    for i := 0; i < 16; i++ {
+        if ok, _, _ := m.Contains(fmt.Sprintf("host%d.test", i)); !ok {
+            t.Fatalf("host%d.test lost by a concurrent edit", i)
+        }
+    }
+}
+
+func TestBackupsDedupeAndPrune(t *testing.T) {
+    dir := t.TempDir()
+    hp := filepath.Join(dir, "hosts")
+    if err := os.WriteFile(hp, []byte("127.0.0.1 localhost\n"), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    // Backups left by older versions, one per run whatever the contents.
+    for _, ts := range []string{"20240101-000000", "20240102-000000"} {
+        if err := os.WriteFile(hp+".reflex."+ts+".bak", []byte("127.0.0.1 localhost\n"), 0o644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    m := Manager{Path: hp, KeepBackups: 3}
+    for i := 0; i < 3; i++ {
+        if err := m.Add("127.0.0.1", "a.test"); err != nil {
+            t.Fatalf("Add: %v", err)
+        }
+        if err := m.Remove("a.test"); err != nil {
+            t.Fatalf("Remove: %v", err)
+        }
+    }
+    list, err := m.Backups()
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Only two distinct contents were ever backed up.
+    if len(list) != 2 {
+        t.Fatalf("got %d backups, want 2: %+v", len(list), list)
+    }
+    if list[0].ID == list[1].ID {
+        t.Fatalf("duplicate backup id %s", list[0].ID)
+    }
+
+    for i := 0; i < 5; i++ {
+        if err := m.Add("127.0.0.1", fmt.Sprintf("h%d.test", i)); err != nil {
+            t.Fatalf("Add: %v", err)
+        }
+    }
+    if list, _ = m.Backups(); len(list) != 3 {
+        t.Fatalf("got %d backups, want KeepBackups=3", len(list))
+    }
+}
+
+func TestRestore(t *testing.T) {
+    dir := t.TempDir()
+    hp := filepath.Join(dir, "hosts")
+    orig := "127.0.0.1 localhost\n"
+    if err := os.WriteFile(hp, []byte(orig), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    m := Manager{Path: hp}
+    if err := m.Add("127.0.0.1", "a.test"); err != nil {
+        t.Fatal(err)
+    }
+    changed, _ := os.ReadFile(hp)
+    b, err := m.FindBackup(contentID([]byte(orig))[:6])
+    if err != nil {
+        t.Fatalf("FindBackup: %v", err)
+    }
+    if _, err := m.Restore(b.ID); err != nil {
+        t.Fatalf("Restore: %v", err)
+    }
+    if got, _ := os.ReadFile(hp); string(got) != orig {
+        t.Fatalf("hosts = %q; want %q", got, orig)
+    }
+    // The restore backed up what it replaced.
+    if _, err := m.FindBackup(contentID(changed)); err != nil {
+        t.Fatalf("pre-restore contents not backed up: %v", err)
+    }
+    if _, err := m.FindBackup("abc"); err == nil {
+        t.Fatalf("expected short id to be rejected")
+    }
+}
+
+func TestDiff(t *testing.T) {
+    a := []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n")
+    b := []byte("1\n2\nthree\n4\n5\n6\n7\n8\n9\nten\n")
+    want := `--- a
++++ b
+@@ -1,5 +1,5 @@
+ 1
+ 2
+-3
++three
+ 4
+ 5
+@@ -8,2 +8,3 @@
+ 8
+ 9
++ten
+`
+    if got := Diff("a", "b", a, b); got != want {
+        t.Fatalf("Diff =\n%s\nwant\n%s", got, want)
+    }
+    if got := Diff("a", "b", a, a); got != "" {
+        t.Fatalf("Diff of equal input = %q", got)
+    }
+}
+
+func TestParseRoundTrip(t *testing.T) {
+    for _, in := range []string{
+        "",
+        "127.0.0.1\tlocalhost\n",
+        "127.0.0.1 localhost\n::1\tlocalhost ip6-localhost  # loopback\n\n# 10.0.0.1 off.test\n",
+        "no newline at end",
+        "127.0.0.1 localhost\r\n10.0.0.1 a.test b.test\r\n",
+    } {
+        if got := string(Parse([]byte(in)).Bytes()); got != in {
+            t.Fatalf("round trip of %q = %q", in, got)
+        }
+    }
+    l := ParseLine("::1\tlocalhost  ip6-localhost\t# loopback")
+    if l.IP != "::1" || !reflect.DeepEqual(l.Hosts, []string{"localhost", "ip6-localhost"}) || l.Comment != " loopback" {
+        t.Fatalf("ParseLine = %+v", l)
+    }
+    if l := ParseLine("# 127.0.0.1 commented.test"); l.IP != "" || l.Has("commented.test") {
+        t.Fatalf("commented out entry parsed as mapping: %+v", l)
+    }
+}
+
+func TestExactMatching(t *testing.T) {
+    dir := t.TempDir()
+    hp := filepath.Join(dir, "hosts")
+    if err := os.WriteFile(hp, []byte("127.0.0.1 localhost\n"), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    m := Manager{Path: hp}
+    for _, d := range []string{"news.google.com", "google.com"} {
+        if err := m.Add("127.0.0.1", d); err != nil {
+            t.Fatalf("Add %s: %v", d, err)
+        }
+    }
+    if err := m.Remove("google.com"); err != nil {
+        t.Fatal(err)
+    }
+    if ok, _, _ := m.Contains("news.google.com"); !ok {
+        t.Fatalf("removing google.com removed news.google.com")
+    }
+    if ok, _, _ := m.Contains("google.com"); ok {
+        t.Fatalf("google.com still present")
+    }
+    // Whitespace differences are still the same entry.
+    if err := os.WriteFile(hp, []byte("127.0.0.1\tlocalhost\n127.0.0.1\tt.co\t# reflex-managed\n"), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    if err := m.Add("127.0.0.1", "T.CO"); !errors.Is(err, ErrAlreadyPresent) {
+        t.Fatalf("Add = %v; want ErrAlreadyPresent", err)
+    }
+    // A managed entry with another address is replaced.
+    if err := m.Add("127.0.0.2", "t.co"); err != nil {
+        t.Fatal(err)
+    }
+    want := "127.0.0.1\tlocalhost\n127.0.0.2 t.co # reflex-managed\n"
+    if got, _ := os.ReadFile(hp); string(got) != want {
+        t.Fatalf("hosts = %q; want %q", got, want)
+    }
+}
+
+func TestAddReportsConflicts(t *testing.T) {
+    dir := t.TempDir()
+    hp := filepath.Join(dir, "hosts")
+    orig := "127.0.0.1 localhost\n10.0.0.5\tintranet.test t.co\n::1 t.co\n"
+    if err := os.WriteFile(hp, []byte(orig), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    m := Manager{Path: hp}
+    err := m.Add("127.0.0.1", "t.co")
+    var ce *ConflictError
+    if !errors.As(err, &ce) || len(ce.Conflicts) != 1 || ce.Conflicts[0].LineNo != 2 || ce.Conflicts[0].IP != "10.0.0.5" {
+        t.Fatalf("Add = %v; want a conflict on line 2", err)
+    }
+    if got, _ := os.ReadFile(hp); string(got) != orig {
+        t.Fatalf("hosts changed despite conflict: %q", got)
+    }
+    // Same address, or another family, is not a conflict.
+    if err := m.Add("10.0.0.5", "t.co"); err != nil {
+        t.Fatalf("Add same address: %v", err)
+    }
+}
+
+func TestAddBothFamilies(t *testing.T) {
+    dir := t.TempDir()
+    hp := filepath.Join(dir, "hosts")
+    if err := os.WriteFile(hp, []byte("127.0.0.1 localhost\n"), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    m := Manager{Path: hp}
+    for _, ip := range []string{"127.0.0.1", "::1"} {
+        if err := m.Add(ip, "t.co"); err != nil {
+            t.Fatalf("Add %s: %v", ip, err)
+        }
+    }
+    entries, err := m.Entries("t.co")
+    if err != nil || len(entries) != 2 {
+        t.Fatalf("Entries = %v, %v; want one per family", entries, err)
+    }
+    if err := m.Remove("t.co"); err != nil {
+        t.Fatal(err)
+    }
+    if got, _ := os.ReadFile(hp); string(got) != "127.0.0.1 localhost\n" {
+        t.Fatalf("hosts after Remove = %q", got)
+    }
+}
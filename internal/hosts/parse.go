@@ -0,0 +1,212 @@
+package hosts
+
+import (
+    "fmt"
+    "net"
+    "strings"
+)
+
+// Line is one line of a hosts file.
+type Line struct {
+    // Raw is the line as read, without its newline. Lines are written back
+    // from Raw, so unmanaged lines round-trip byte for byte.
+    Raw string
+    // IP and Hosts are set when the line maps an address to names.
+    IP    string
+    Hosts []string
+    // Comment is the text after '#', if any.
+    Comment string
+}
+
+// Managed reports whether reflex wrote the line.
+func (l Line) Managed() bool {
+    return l.IP != "" && strings.TrimSpace(l.Comment) == strings.TrimSpace(strings.TrimPrefix(tag, "#"))
+}
+
+// Has reports whether the line maps host, compared case-insensitively.
+func (l Line) Has(host string) bool {
+    for _, h := range l.Hosts {
+        if strings.EqualFold(strings.TrimSuffix(h, "."), strings.TrimSuffix(host, ".")) {
+            return true
+        }
+    }
+    return false
+}
+
+// ParseLine tokenizes one hosts file line. Fields may be separated by any
+// mix of spaces and tabs; lines whose first field is not an IP address are
+// kept as Raw only.
+func ParseLine(raw string) Line {
+    l := Line{Raw: raw}
+    body := strings.TrimSuffix(raw, "\r")
+    if i := strings.IndexByte(body, '#'); i >= 0 {
+        body, l.Comment = body[:i], body[i+1:]
+    }
+    fields := strings.Fields(body)
+    if len(fields) < 2 {
+        return l
+    }
+    ip := fields[0]
+    // Zone suffixes such as fe80::1%lo0 are allowed by most resolvers.
+    if i := strings.IndexByte(ip, '%'); i >= 0 {
+        ip = ip[:i]
+    }
+    if net.ParseIP(ip) == nil {
+        return l
+    }
+    l.IP, l.Hosts = fields[0], fields[1:]
+    return l
+}
+
+// File is a parsed hosts file.
+type File struct {
+    Lines []Line
+    // crlf is set when the file uses Windows line endings.
+    crlf bool
+}
+
+// Parse splits data into lines. Bytes() of the result returns data
+// unchanged.
+func Parse(data []byte) *File {
+    s := string(data)
+    f := &File{}
+    if s == "" {
+        return f
+    }
+    raws := strings.Split(s, "\n")
+    for _, raw := range raws {
+        f.Lines = append(f.Lines, ParseLine(raw))
+    }
+    f.crlf = strings.HasSuffix(raws[0], "\r")
+    return f
+}
+
+// Bytes returns the file contents.
+func (f *File) Bytes() []byte {
+    raws := make([]string, len(f.Lines))
+    for i, l := range f.Lines {
+        raws[i] = l.Raw
+    }
+    return []byte(strings.Join(raws, "\n"))
+}
+
+// Find returns the indexes of the lines that map host, managed or not.
+func (f *File) Find(host string) []int {
+    var out []int
+    for i, l := range f.Lines {
+        if l.Has(host) {
+            out = append(out, i)
+        }
+    }
+    return out
+}
+
+// Append adds a line at the end of the file and ends the file with a
+// newline.
+func (f *File) Append(raw string) {
+    if f.crlf {
+        raw += "\r"
+    }
+    n := len(f.Lines)
+    switch {
+    case n > 0 && f.Lines[n-1].Raw == "":
+        // The file ends with a newline: the empty last line takes raw.
+        f.Lines = f.Lines[:n-1]
+    case n > 0 && f.crlf:
+        f.Lines[n-1].Raw += "\r"
+    }
+    f.Lines = append(f.Lines, ParseLine(raw), Line{})
+}
+
+// without returns l with host dropped, and false when no host is left.
+func (l Line) without(host string) (Line, bool) {
+    var rest []string
+    for _, h := range l.Hosts {
+        if !(Line{Hosts: []string{h}}).Has(host) {
+            rest = append(rest, h)
+        }
+    }
+    if len(rest) == 0 {
+        return Line{}, false
+    }
+    raw := l.IP + " " + strings.Join(rest, " ") + " #" + l.Comment
+    if strings.HasSuffix(l.Raw, "\r") {
+        raw += "\r"
+    }
+    return ParseLine(raw), true
+}
+
+// removeManaged drops host from the managed lines for which match returns
+// true and reports how many lines it changed.
+func (f *File) removeManaged(host string, match func(Line) bool) int {
+    n := 0
+    kept := f.Lines[:0]
+    for _, l := range f.Lines {
+        if l.Managed() && l.Has(host) && match(l) {
+            n++
+            if l, ok := l.without(host); ok {
+                kept = append(kept, l)
+            }
+            continue
+        }
+        kept = append(kept, l)
+    }
+    f.Lines = kept
+    return n
+}
+
+// trimTrailingBlank drops blank lines at the end of the file, keeping one
+// final newline.
+func (f *File) trimTrailingBlank() {
+    n := len(f.Lines)
+    for n > 0 && strings.TrimSpace(f.Lines[n-1].Raw) == "" {
+        n--
+    }
+    f.Lines = append(f.Lines[:n], Line{})
+}
+
+// Conflict is a hosts entry reflex does not manage that maps a host to
+// another address of the same family.
+type Conflict struct {
+    Host   string
+    IP     string
+    LineNo int
+    Line   string
+}
+
+// ConflictError reports entries that would shadow or contradict a mapping.
+type ConflictError struct {
+    Path      string
+    Conflicts []Conflict
+}
+
+func (e *ConflictError) Error() string {
+    var b strings.Builder
+    for i, c := range e.Conflicts {
+        if i > 0 {
+            b.WriteString("; ")
+        }
+        fmt.Fprintf(&b, "%s is already mapped to %s on line %d of %s", c.Host, c.IP, c.LineNo, e.Path)
+    }
+    b.WriteString(" (not managed by reflex; remove or comment it out)")
+    return b.String()
+}
+
+// Conflicts returns the unmanaged entries that map host to an address of
+// the same family as ip but a different one.
+func (f *File) Conflicts(host, ip string) []Conflict {
+    want := net.ParseIP(ip)
+    var out []Conflict
+    for _, i := range f.Find(host) {
+        l := f.Lines[i]
+        if l.Managed() {
+            continue
+        }
+        got := net.ParseIP(strings.SplitN(l.IP, "%", 2)[0])
+        if want == nil || got == nil || got.Equal(want) || (got.To4() == nil) != (want.To4() == nil) {
+            continue
+        }
+        out = append(out, Conflict{Host: host, IP: l.IP, LineNo: i + 1, Line: strings.TrimSuffix(l.Raw, "\r")})
+    }
+    return out
+}
@@ -0,0 +1,188 @@
+// Package policy predicts the Referer a navigation carries according to the
+// W3C Referrer Policy specification.
+package policy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Referrer policy tokens defined by the specification.
+const (
+	NoReferrer                  = "no-referrer"
+	NoReferrerWhenDowngrade     = "no-referrer-when-downgrade"
+	SameOrigin                  = "same-origin"
+	Origin                      = "origin"
+	StrictOrigin                = "strict-origin"
+	OriginWhenCrossOrigin       = "origin-when-cross-origin"
+	StrictOriginWhenCrossOrigin = "strict-origin-when-cross-origin"
+	UnsafeURL                   = "unsafe-url"
+)
+
+// Default is the policy browsers apply when none is set.
+const Default = StrictOriginWhenCrossOrigin
+
+// Tokens lists every valid policy token.
+var Tokens = []string{
+	NoReferrer,
+	NoReferrerWhenDowngrade,
+	SameOrigin,
+	Origin,
+	StrictOrigin,
+	OriginWhenCrossOrigin,
+	StrictOriginWhenCrossOrigin,
+	UnsafeURL,
+}
+
+// Valid reports whether token is a known policy token.
+func Valid(token string) bool {
+	for _, t := range Tokens {
+		if strings.EqualFold(token, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks a Referrer-Policy value: one token or a comma separated
+// list of fallbacks, each of which must be a known token. An empty value
+// (no policy) is valid.
+func Validate(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	for _, tok := range strings.Split(value, ",") {
+		tok = strings.TrimSpace(tok)
+		if tok == "" {
+			return fmt.Errorf("empty token in %q", value)
+		}
+		if !Valid(tok) {
+			return fmt.Errorf("unknown referrer policy %q (want %s)", tok, strings.Join(Tokens, ", "))
+		}
+	}
+	return nil
+}
+
+// Effective returns the policy a browser applies for a Referrer-Policy
+// value. The header may list fallbacks ("no-referrer, strict-origin"); the
+// last recognised token wins and unknown tokens are ignored. Without any
+// recognised token the default policy applies.
+func Effective(value string) string {
+	eff := ""
+	for _, tok := range strings.Split(value, ",") {
+		tok = strings.ToLower(strings.TrimSpace(tok))
+		if Valid(tok) {
+			eff = tok
+		}
+	}
+	if eff == "" {
+		return Default
+	}
+	return eff
+}
+
+// Referer returns the Referer header value a navigation from referrer to
+// target carries under policy, or "" when none is sent.
+func Referer(referrer, target *url.URL, policy string) string {
+	ref, _ := decide(referrer, target, Effective(policy))
+	return ref
+}
+
+// decide applies the effective policy eff and explains the outcome.
+func decide(referrer, target *url.URL, eff string) (string, string) {
+	full := stripURL(referrer)
+	origin := originOf(referrer)
+	sameOrigin := originOf(target) == origin
+	downgrade := isTrustworthy(referrer) && !isTrustworthy(target)
+	scope := "a cross-origin"
+	if sameOrigin {
+		scope = "a same-origin"
+	}
+
+	switch eff {
+	case NoReferrer:
+		return "", "no-referrer never sends a Referer"
+	case NoReferrerWhenDowngrade:
+		if downgrade {
+			return "", "no-referrer-when-downgrade sends nothing on an HTTPS to HTTP downgrade"
+		}
+		return full, "no-referrer-when-downgrade sends the full URL unless the target downgrades to HTTP"
+	case SameOrigin:
+		if sameOrigin {
+			return full, "same-origin sends the full URL to the same origin"
+		}
+		return "", "same-origin sends nothing to " + scope + " target"
+	case Origin:
+		return origin, "origin always sends only the origin"
+	case StrictOrigin:
+		if downgrade {
+			return "", "strict-origin sends nothing on an HTTPS to HTTP downgrade"
+		}
+		return origin, "strict-origin sends only the origin"
+	case OriginWhenCrossOrigin:
+		if sameOrigin {
+			return full, "origin-when-cross-origin sends the full URL to the same origin"
+		}
+		return origin, "origin-when-cross-origin sends only the origin to " + scope + " target"
+	case UnsafeURL:
+		return full, "unsafe-url always sends the full URL, even on an HTTPS to HTTP downgrade"
+	default: // strict-origin-when-cross-origin
+		if sameOrigin {
+			return full, "strict-origin-when-cross-origin sends the full URL to the same origin"
+		}
+		if downgrade {
+			return "", "strict-origin-when-cross-origin sends nothing on an HTTPS to HTTP downgrade"
+		}
+		return origin, "strict-origin-when-cross-origin sends only the origin to " + scope + " target"
+	}
+}
+
+// stripURL removes the parts of a URL that are never sent as a referrer:
+// credentials and the fragment.
+func stripURL(u *url.URL) string {
+	c := *u
+	c.User = nil
+	c.Fragment = ""
+	c.RawFragment = ""
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	return c.String()
+}
+
+// originOf serialises the origin of u with a trailing slash, as sent in a
+// Referer header. Default ports are omitted.
+func originOf(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	return scheme + "://" + host + "/"
+}
+
+// isTrustworthy approximates the spec's "potentially trustworthy URL":
+// https/wss, and loopback hosts over any scheme.
+func isTrustworthy(u *url.URL) bool {
+	switch strings.ToLower(u.Scheme) {
+	case "https", "wss":
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package policy
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func mustParse(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestReferer(t *testing.T) {
+	ref := "https://news.google.com/articles/abc?hl=en#top"
+	cases := []struct {
+		policy, target, want string
+	}{
+		{NoReferrer, "https://example.com/", ""},
+		{UnsafeURL, "http://example.com/", "https://news.google.com/articles/abc?hl=en"},
+		{Origin, "http://example.com/", "https://news.google.com/"},
+		{StrictOrigin, "http://example.com/", ""},
+		{StrictOrigin, "https://example.com/", "https://news.google.com/"},
+		{NoReferrerWhenDowngrade, "http://example.com/", ""},
+		{NoReferrerWhenDowngrade, "https://example.com/", "https://news.google.com/articles/abc?hl=en"},
+		{SameOrigin, "https://example.com/", ""},
+		{SameOrigin, "https://news.google.com/other", "https://news.google.com/articles/abc?hl=en"},
+		{OriginWhenCrossOrigin, "https://example.com/", "https://news.google.com/"},
+		{StrictOriginWhenCrossOrigin, "http://example.com/", ""},
+		{StrictOriginWhenCrossOrigin, "http://localhost:3000/", "https://news.google.com/"},
+		{"", "https://example.com/", "https://news.google.com/"},
+		{"no-referrer, unsafe-url", "https://example.com/", "https://news.google.com/articles/abc?hl=en"},
+		{"unsafe-url, bogus", "https://example.com/", "https://news.google.com/articles/abc?hl=en"},
+	}
+	for _, c := range cases {
+		got := Referer(mustParse(t, ref), mustParse(t, c.target), c.policy)
+		if got != c.want {
+			t.Errorf("Referer(policy=%q, target=%s) = %q; want %q", c.policy, c.target, got, c.want)
+		}
+	}
+}
+
+func TestOriginKeepsNonDefaultPort(t *testing.T) {
+	got := Referer(mustParse(t, "https://news.google.com:8443/"), mustParse(t, "https://example.com/"), Origin)
+	if got != "https://news.google.com:8443/" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, ok := range []string{"", "origin", "Unsafe-URL", "no-referrer, strict-origin-when-cross-origin"} {
+		if err := Validate(ok); err != nil {
+			t.Fatalf("Validate(%q): %v", ok, err)
+		}
+	}
+	for _, bad := range []string{"orign", "origin,", "no-referrer, never", `origin" onload="x`} {
+		if err := Validate(bad); err == nil {
+			t.Fatalf("Validate(%q) expected error", bad)
+		}
+	}
+}
+
+func TestPredict(t *testing.T) {
+	ref := mustParse(t, "https://www.google.com/search?q=shoes")
+	cases := []struct {
+		target, policy, method, rel, want, reason string
+	}{
+		{"https://shop.example/", "", "meta", "", "https://www.google.com/", "default strict-origin-when-cross-origin"},
+		{"https://shop.example/", "unsafe-url", "js", "", "https://www.google.com/search?q=shoes", "full URL"},
+		{"http://shop.example/", "strict-origin", "click", "", "", "downgrade"},
+		{"https://shop.example/", "unsafe-url", "302", "", "", "302 redirect"},
+		{"https://shop.example/", "unsafe-url", "window-open", "noopener noreferrer", "", "rel=noreferrer"},
+		{"https://shop.example/", "no-referrer, origin", "iframe", "", "https://www.google.com/", "fallbacks"},
+		{"https://www.google.com/maps", "origin-when-cross-origin", "form-get", "noopener", "https://www.google.com/search?q=shoes", "same origin"},
+	}
+	for _, c := range cases {
+		p := Predict(Navigation{Referrer: ref, Target: mustParse(t, c.target), Policy: c.policy, Method: c.method, Rel: c.rel})
+		if p.Referer != c.want {
+			t.Errorf("%s %s -> %s: Referer %q, want %q", c.method, c.policy, c.target, p.Referer, c.want)
+		}
+		if why := strings.Join(p.Reasons, "; "); !strings.Contains(why, c.reason) {
+			t.Errorf("%s %s -> %s: reasons %q lack %q", c.method, c.policy, c.target, why, c.reason)
+		}
+	}
+}
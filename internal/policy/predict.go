@@ -0,0 +1,74 @@
+package policy
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Navigation describes how a referrer page sends the browser to a target.
+type Navigation struct {
+	Referrer *url.URL
+	Target   *url.URL
+	// Policy is the Referrer-Policy value of the referrer page.
+	Policy string
+	// Method is a reflex redirect method: meta, js, click, form-get,
+	// form-post, window-open, iframe or a status code such as 302.
+	Method string
+	// Rel is the link relation of click, form-* and window-open.
+	Rel string
+}
+
+// Prediction is the Referer a target should receive for a Navigation.
+type Prediction struct {
+	// Referer is the header value, "" when none is sent. document.referrer
+	// on the target has the same value.
+	Referer string
+	// Policy is the effective policy token.
+	Policy string
+	// Reasons explain the outcome, most general first.
+	Reasons []string
+}
+
+// Predict computes the Referer the target of n receives according to the
+// Referrer Policy specification and the semantics of the redirect method.
+func Predict(n Navigation) Prediction {
+	p := Prediction{Policy: Effective(n.Policy)}
+	switch {
+	case strings.TrimSpace(n.Policy) == "":
+		p.Reasons = append(p.Reasons, "no policy is set, so browsers apply the default "+Default)
+	case strings.Contains(n.Policy, ","):
+		p.Reasons = append(p.Reasons, fmt.Sprintf("%q lists fallbacks; the last token the browser knows (%s) applies", n.Policy, p.Policy))
+	}
+
+	method := strings.ToLower(n.Method)
+	if code, err := strconv.Atoi(method); err == nil && code >= 300 && code < 400 {
+		p.Reasons = append(p.Reasons, fmt.Sprintf("a %d redirect answers the very first request; the browser opened the referrer URL directly, so there is no referring document and no Referer", code))
+		return p
+	}
+	switch method {
+	case "click", "form-get", "form-post", "window-open":
+		if hasToken(n.Rel, "noreferrer") {
+			p.Reasons = append(p.Reasons, fmt.Sprintf("%s uses rel=noreferrer, which suppresses the Referer whatever the policy", method))
+			return p
+		}
+	case "iframe":
+		p.Reasons = append(p.Reasons, "the iframe request is sent on behalf of the embedding page, under its policy")
+	}
+
+	ref, reason := decide(n.Referrer, n.Target, p.Policy)
+	p.Referer = ref
+	p.Reasons = append(p.Reasons, reason)
+	return p
+}
+
+// hasToken reports whether the space separated list contains token.
+func hasToken(list, token string) bool {
+	for _, t := range strings.Fields(list) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,291 @@
+// Package portfwd keeps a public port while reflex serves on another one:
+// it redirects loopback connections with nftables or iptables rules. The
+// redirect happens before the socket lookup, so it works while another
+// process holds the public port.
+package portfwd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Forwarding methods. Auto tries each firewall method that can work.
+const (
+	Auto     = "auto"
+	Nft      = "nft"
+	Iptables = "iptables"
+)
+
+// Methods lists the accepted method names.
+var Methods = []string{Auto, Nft, Iptables}
+
+// Valid reports whether method is one of Methods.
+func Valid(method string) bool {
+	for _, m := range Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Tag marks the firewall rules reflex owns, like the hosts file tag.
+const Tag = "reflex-managed"
+
+// table is the nftables table holding reflex's rules.
+const table = "reflex"
+
+// run executes a command with stdin and returns its combined output. Tests
+// replace it.
+var run = func(stdin, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
+
+// geteuid returns the effective user id. Tests replace it.
+var geteuid = os.Geteuid
+
+// lookPath reports whether a command is installed. Tests replace it.
+var lookPath = func(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// Forward is an active redirection of From to To on each of IPs.
+type Forward struct {
+	Method   string
+	IPs      []string
+	From, To int
+
+	close func() error
+	once  sync.Once
+	err   error
+}
+
+// Close removes the rules. It is safe to call more than once.
+func (f *Forward) Close() error {
+	f.once.Do(func() { f.err = f.close() })
+	return f.err
+}
+
+// Start redirects connections to ip:from to ip:to for every ip. Stale
+// rules of an earlier run are replaced.
+func Start(method string, ips []string, from, to int) (*Forward, error) {
+	f := &Forward{Method: method, IPs: ips, From: from, To: to}
+	var err error
+	switch method {
+	case Nft:
+		f.close, err = startNft(ips, from, to)
+	case Iptables:
+		f.close, err = startIptables(ips, from, to)
+	case Auto:
+		methods := autoMethods()
+		if len(methods) == 0 {
+			return nil, errors.New("port forwarding needs root on Linux with nft or iptables installed; without root, run reflex helper, which binds the port for you")
+		}
+		var errs []error
+		for _, m := range methods {
+			fw, err := Start(m, ips, from, to)
+			if err == nil {
+				return fw, nil
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", m, err))
+		}
+		return nil, errors.Join(errs...)
+	default:
+		return nil, fmt.Errorf("unknown port forwarding method %q (want %s)", method, strings.Join(Methods, ", "))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// autoMethods returns the methods Auto tries, in order. Firewall rules need
+// Linux, root and the tool.
+func autoMethods() []string {
+	if runtime.GOOS != "linux" || geteuid() != 0 {
+		return nil
+	}
+	var out []string
+	if lookPath("nft") {
+		out = append(out, Nft)
+	}
+	if lookPath("iptables") {
+		out = append(out, Iptables)
+	}
+	return out
+}
+
+// Rules describes the firewall rules reflex currently has installed.
+func Rules() []string {
+	var out []string
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	if lookPath("nft") {
+		if b, err := run("", "nft", "list", "table", "inet", table); err == nil {
+			for _, line := range strings.Split(string(b), "\n") {
+				if strings.Contains(line, "redirect") {
+					out = append(out, "nft: "+strings.TrimSpace(line))
+				}
+			}
+		}
+	}
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		for _, rule := range taggedRules(bin) {
+			out = append(out, bin+": "+strings.Join(rule, " "))
+		}
+	}
+	return out
+}
+
+// RemoveAll deletes every firewall rule reflex installed and reports how
+// many it removed.
+func RemoveAll() (int, error) {
+	if runtime.GOOS != "linux" {
+		return 0, nil
+	}
+	n := 0
+	var errs []error
+	if lookPath("nft") {
+		if _, err := run("", "nft", "list", "table", "inet", table); err == nil {
+			if _, err := run("", "nft", "delete", "table", "inet", table); err != nil {
+				errs = append(errs, err)
+			} else {
+				n++
+			}
+		}
+	}
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		for _, rule := range taggedRules(bin) {
+			if err := deleteRule(bin, rule); err != nil {
+				errs = append(errs, err)
+			} else {
+				n++
+			}
+		}
+	}
+	return n, errors.Join(errs...)
+}
+
+// nftScript returns an nft script that replaces the reflex table with one
+// redirecting from to to on ips. Declaring the table before deleting it
+// makes the delete succeed when there is none.
+func nftScript(ips []string, from, to int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", table, table)
+	fmt.Fprintf(&b, "table inet %s {\n\tchain output {\n\t\ttype nat hook output priority -100; policy accept;\n", table)
+	for _, ip := range ips {
+		family := "ip"
+		if isIPv6(ip) {
+			family = "ip6"
+		}
+		fmt.Fprintf(&b, "\t\t%s daddr %s tcp dport %d redirect to :%d comment %q\n", family, ip, from, to, Tag)
+	}
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
+
+func startNft(ips []string, from, to int) (func() error, error) {
+	if runtime.GOOS != "linux" {
+		return nil, errors.New("nftables is only available on Linux")
+	}
+	if _, err := run(nftScript(ips, from, to), "nft", "-f", "-"); err != nil {
+		return nil, err
+	}
+	return func() error {
+		_, err := run("", "nft", "delete", "table", "inet", table)
+		return err
+	}, nil
+}
+
+// iptablesRule returns the nat OUTPUT rule redirecting from to to on ip,
+// without the leading -A or -D.
+func iptablesRule(ip string, from, to int) []string {
+	return []string{"OUTPUT", "-d", ip, "-p", "tcp", "-m", "tcp", "--dport", strconv.Itoa(from),
+		"-m", "comment", "--comment", Tag, "-j", "REDIRECT", "--to-ports", strconv.Itoa(to)}
+}
+
+func iptablesBin(ip string) string {
+	if isIPv6(ip) {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func startIptables(ips []string, from, to int) (func() error, error) {
+	if runtime.GOOS != "linux" {
+		return nil, errors.New("iptables is only available on Linux")
+	}
+	for _, ip := range ips {
+		for _, rule := range taggedRules(iptablesBin(ip)) {
+			_ = deleteRule(iptablesBin(ip), rule)
+		}
+	}
+	var added []string
+	remove := func() error {
+		var errs []error
+		for _, ip := range added {
+			if err := deleteRule(iptablesBin(ip), iptablesRule(ip, from, to)); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+	for _, ip := range ips {
+		args := append([]string{"-t", "nat", "-A"}, iptablesRule(ip, from, to)...)
+		if _, err := run("", iptablesBin(ip), args...); err != nil {
+			_ = remove()
+			return nil, err
+		}
+		added = append(added, ip)
+	}
+	return remove, nil
+}
+
+// taggedRules returns reflex's rules in the nat OUTPUT chain of bin, as
+// printed by -S without the leading -A.
+func taggedRules(bin string) [][]string {
+	if !lookPath(bin) {
+		return nil
+	}
+	b, err := run("", bin, "-t", "nat", "-S", "OUTPUT")
+	if err != nil {
+		return nil
+	}
+	var out [][]string
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" || !strings.Contains(line, "--comment "+Tag) {
+			continue
+		}
+		out = append(out, fields[1:])
+	}
+	return out
+}
+
+func deleteRule(bin string, rule []string) error {
+	_, err := run("", bin, append([]string{"-t", "nat", "-D"}, rule...)...)
+	return err
+}
+
+func isIPv6(ip string) bool {
+	p := net.ParseIP(ip)
+	return p != nil && p.To4() == nil
+}
@@ -0,0 +1,101 @@
+package portfwd
+
+import (
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeRun records commands and answers iptables -S with listing.
+func fakeRun(t *testing.T, listing string) *[]string {
+	t.Helper()
+	var calls []string
+	oldRun, oldLook := run, lookPath
+	run = func(stdin, name string, args ...string) ([]byte, error) {
+		call := name + " " + strings.Join(args, " ")
+		calls = append(calls, call)
+		if strings.HasSuffix(call, "-S OUTPUT") && name == "iptables" {
+			return []byte(listing), nil
+		}
+		return nil, nil
+	}
+	lookPath = func(string) bool { return true }
+	t.Cleanup(func() { run, lookPath = oldRun, oldLook })
+	return &calls
+}
+
+func TestNftScript(t *testing.T) {
+	got := nftScript([]string{"127.0.0.1", "::1"}, 443, 8443)
+	for _, want := range []string{
+		"table inet reflex\ndelete table inet reflex\n",
+		"type nat hook output priority -100;",
+		`ip daddr 127.0.0.1 tcp dport 443 redirect to :8443 comment "reflex-managed"`,
+		`ip6 daddr ::1 tcp dport 443 redirect to :8443 comment "reflex-managed"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("script lacks %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestIptablesReplacesStaleRulesAndCloses(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("iptables is Linux only")
+	}
+	calls := fakeRun(t, "-P OUTPUT ACCEPT\n"+
+		"-A OUTPUT -d 127.0.0.1/32 -p tcp -m tcp --dport 443 -m comment --comment reflex-managed -j REDIRECT --to-ports 9443\n"+
+		"-A OUTPUT -d 10.0.0.1/32 -j ACCEPT\n")
+	f, err := Start(Iptables, []string{"127.0.0.1", "::1"}, 443, 8443)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	want := []string{
+		"iptables -t nat -S OUTPUT",
+		"iptables -t nat -D OUTPUT -d 127.0.0.1/32 -p tcp -m tcp --dport 443 -m comment --comment reflex-managed -j REDIRECT --to-ports 9443",
+		"ip6tables -t nat -S OUTPUT",
+		"iptables -t nat -A OUTPUT -d 127.0.0.1 -p tcp -m tcp --dport 443 -m comment --comment reflex-managed -j REDIRECT --to-ports 8443",
+		"ip6tables -t nat -A OUTPUT -d ::1 -p tcp -m tcp --dport 443 -m comment --comment reflex-managed -j REDIRECT --to-ports 8443",
+		"iptables -t nat -D OUTPUT -d 127.0.0.1 -p tcp -m tcp --dport 443 -m comment --comment reflex-managed -j REDIRECT --to-ports 8443",
+		"ip6tables -t nat -D OUTPUT -d ::1 -p tcp -m tcp --dport 443 -m comment --comment reflex-managed -j REDIRECT --to-ports 8443",
+	}
+	if strings.Join(*calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(*calls, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestAutoForwardsBusyPort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("firewall rules are Linux only")
+	}
+	// Another process holds the public port, the case forwarding is for.
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	from := busy.Addr().(*net.TCPAddr).Port
+
+	calls := fakeRun(t, "")
+	oldEuid := geteuid
+	t.Cleanup(func() { geteuid = oldEuid })
+
+	geteuid = func() int { return 0 }
+	f, err := Start(Auto, []string{"127.0.0.1"}, from, 8443)
+	if err != nil {
+		t.Fatalf("Start as root: %v", err)
+	}
+	if f.Method != Nft || len(*calls) == 0 || (*calls)[0] != "nft -f -" {
+		t.Errorf("method %s, commands %q; want nft rules", f.Method, *calls)
+	}
+	_ = f.Close()
+
+	geteuid = func() int { return 1000 }
+	if _, err := Start(Auto, []string{"127.0.0.1"}, from, 8443); err == nil || !strings.Contains(err.Error(), "needs root") {
+		t.Errorf("Start without root = %v; want a needs root error", err)
+	}
+}
@@ -0,0 +1,140 @@
+// Package presets is a catalog of well-known referrers: the URLs visitors
+// arrive from and how those sites link out.
+package presets
+
+import (
+	"sort"
+
+	"github.com/samfrm/reflex/internal/server"
+)
+
+// Preset describes how a real site sends visitors to other sites.
+type Preset struct {
+	Name string
+	// Referrer is a realistic URL of the page the visitor leaves.
+	Referrer string
+	// Policy is the Referrer-Policy the site applies to outbound links.
+	Policy string
+	// Method, Rel and NewWindow reproduce how the site links out.
+	Method    server.RedirectMethod
+	Rel       string
+	NewWindow bool
+	// ClickID is the click ID parameter the site's ads append, if any.
+	// --auto-click-id adds it.
+	ClickID string
+	// Params are query parameters the site adds to every outbound link.
+	Params map[string]string
+	// Notes explains the choices above.
+	Notes string
+}
+
+var catalog = []Preset{
+	{
+		Name:     "google-search",
+		Referrer: "https://www.google.com/search?q=running+shoes",
+		Policy:   "origin",
+		Method:   server.MethodClick,
+		ClickID:  "gclid",
+		Notes:    "Result pages set <meta name=referrer content=origin>: targets see https://www.google.com/ and never the query. Ads add gclid.",
+	},
+	{
+		Name:      "google-news",
+		Referrer:  "https://news.google.com/home?hl=en-US&gl=US&ceid=US:en",
+		Policy:    "strict-origin-when-cross-origin",
+		Method:    server.MethodClick,
+		NewWindow: true,
+		ClickID:   "gclid",
+		Notes:     "Articles open in a new tab under the browser default policy, so only the origin arrives.",
+	},
+	{
+		Name:     "bing",
+		Referrer: "https://www.bing.com/search?q=running+shoes",
+		Policy:   "origin-when-cross-origin",
+		Method:   server.MethodClick,
+		ClickID:  "msclkid",
+		Notes:    "Sends the origin cross-site. Microsoft Advertising adds msclkid.",
+	},
+	{
+		Name:     "duckduckgo",
+		Referrer: "https://duckduckgo.com/?q=running+shoes",
+		Policy:   "origin",
+		Method:   server.MethodClick,
+		Notes:    "Only the origin, no query and no click IDs.",
+	},
+	{
+		Name:     "facebook",
+		Referrer: "https://l.facebook.com/l.php?u=https%3A%2F%2Fexample.com%2F",
+		Policy:   "origin-when-cross-origin",
+		Method:   server.MethodJS,
+		ClickID:  "fbclid",
+		Notes:    "Outbound links go through the l.facebook.com link shim, which redirects with script; targets see https://l.facebook.com/ (m.facebook.com on mobile). fbclid is added to outbound links and ads.",
+	},
+	{
+		Name:     "t.co",
+		Referrer: "https://t.co/AbCdEf1234",
+		Policy:   "unsafe-url",
+		Method:   server.MethodMeta,
+		ClickID:  "twclid",
+		Notes:    "X/Twitter wraps links in t.co, which answers browsers with a meta refresh under a permissive policy, so the full short URL arrives. Ads add twclid.",
+	},
+	{
+		Name:      "linkedin",
+		Referrer:  "https://www.linkedin.com/feed/",
+		Policy:    "strict-origin-when-cross-origin",
+		Method:    server.MethodClick,
+		NewWindow: true,
+		ClickID:   "li_fat_id",
+		Notes:     "Feed links open in a new tab under the browser default policy; in-app browsers often send no Referer at all.",
+	},
+	{
+		Name:     "reddit",
+		Referrer: "https://www.reddit.com/r/programming/comments/1abcde/show_reddit_running_shoes/",
+		Policy:   "origin-when-cross-origin",
+		Method:   server.MethodClick,
+		Notes:    "Only https://www.reddit.com/ arrives cross-site; the thread URL does not.",
+	},
+	{
+		Name:     "hacker-news",
+		Referrer: "https://news.ycombinator.com/item?id=40000000",
+		Policy:   "origin",
+		Method:   server.MethodClick,
+		Notes:    "Sets <meta name=referrer content=origin>; the item id never arrives.",
+	},
+	{
+		Name:      "chatgpt",
+		Referrer:  "https://chatgpt.com/",
+		Policy:    "strict-origin-when-cross-origin",
+		Method:    server.MethodClick,
+		Rel:       "noopener",
+		NewWindow: true,
+		Params:    map[string]string{"utm_source": "chatgpt.com"},
+		Notes:     "Cited links open in a new tab and carry utm_source=chatgpt.com, so attribution often works even when the Referer is stripped.",
+	},
+}
+
+// All returns every preset, sorted by name.
+func All() []Preset {
+	out := append([]Preset(nil), catalog...)
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Names returns the preset names, sorted.
+func Names() []string {
+	all := All()
+	names := make([]string, len(all))
+	for i, p := range all {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// Lookup returns the preset called name.
+func Lookup(name string) (Preset, bool) {
+	for _, p := range catalog {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Preset{}, false
+}
@@ -0,0 +1,40 @@
+package presets
+
+import (
+	"testing"
+
+	"github.com/samfrm/reflex/internal/policy"
+	"github.com/samfrm/reflex/internal/server"
+	"github.com/samfrm/reflex/internal/tracking"
+	"github.com/samfrm/reflex/internal/util"
+)
+
+func TestCatalogIsValid(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, p := range All() {
+		if seen[p.Name] {
+			t.Errorf("duplicate preset %s", p.Name)
+		}
+		seen[p.Name] = true
+		u, err := util.ParseReferrer(p.Referrer)
+		if err != nil {
+			t.Errorf("%s: referrer: %v", p.Name, err)
+			continue
+		}
+		if !policy.Valid(p.Policy) || !p.Method.Valid() {
+			t.Errorf("%s: invalid policy %q or method %q", p.Name, p.Policy, p.Method)
+		}
+		if err := server.ValidRel(p.Rel); err != nil {
+			t.Errorf("%s: %v", p.Name, err)
+		}
+		// --auto-click-id derives the parameter from the referrer host.
+		if got := tracking.ClickIDFor(u.Hostname()); got != p.ClickID {
+			t.Errorf("%s: ClickIDFor(%s) = %q, preset says %q", p.Name, u.Hostname(), got, p.ClickID)
+		}
+	}
+	for _, name := range []string{"google-search", "google-news", "bing", "duckduckgo", "facebook", "t.co", "linkedin", "reddit", "hacker-news", "chatgpt"} {
+		if _, ok := Lookup(name); !ok {
+			t.Errorf("missing preset %s", name)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+//go:build linux
+
+package privhelper
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/samfrm/reflex/internal/hosts"
+)
+
+// Helper performs the privileged requests of one user. It runs as root.
+type Helper struct {
+	// Hosts is the hosts file the helper edits; clients cannot pick it.
+	Hosts hosts.Manager
+	// UID is the user allowed to connect besides root.
+	UID int
+}
+
+// Listen opens the helper socket at path, or takes the unix socket systemd
+// passed when the helper is socket activated. Access is checked per
+// connection against the peer's credentials, so the socket itself is
+// world-writable.
+func Listen(path string) (*net.UnixListener, error) {
+	files, err := SystemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		defer func() {
+			for _, f := range files {
+				f.Close()
+			}
+		}()
+		ln, err := net.FileListener(files[0])
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket: %w", err)
+		}
+		ul, ok := ln.(*net.UnixListener)
+		if !ok {
+			ln.Close()
+			return nil, fmt.Errorf("systemd socket %s is not a unix socket", files[0].Name())
+		}
+		return ul, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		// Left behind by a helper that did not shut down cleanly.
+		_ = os.Remove(path)
+	}
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o666); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Serve answers clients on ln until it is closed. A client may only remove
+// the hosts entries it added; those it did not remove are removed when its
+// connection ends, so a crashed reflex leaves nothing behind.
+func (h *Helper) Serve(ln *net.UnixListener) error {
+	for {
+		conn, err := ln.AcceptUnix()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go h.handle(conn)
+	}
+}
+
+func (h *Helper) handle(conn *net.UnixConn) {
+	defer conn.Close()
+	uid, err := peerUID(conn)
+	if err != nil {
+		log.Printf("helper: peer credentials: %v", err)
+		return
+	}
+	if uid != 0 && uid != h.UID {
+		log.Printf("helper: refusing connection from uid %d", uid)
+		return
+	}
+	added := make(map[string]bool)
+	defer func() {
+		for host := range added {
+			if err := h.Hosts.Remove(host); err != nil {
+				log.Printf("helper: remove %s: %v", host, err)
+			} else {
+				log.Printf("helper: removed %s left by a closed connection", host)
+			}
+		}
+	}()
+	dec := json.NewDecoder(conn)
+	for {
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("helper: uid %d: %v", uid, err)
+			}
+			return
+		}
+		resp, file := h.do(req, added)
+		if resp.Error != "" {
+			log.Printf("helper: uid %d: %s: %s", uid, req, resp.Error)
+		} else {
+			log.Printf("helper: uid %d: %s", uid, req)
+		}
+		if err := reply(conn, resp, file); err != nil {
+			log.Printf("helper: reply: %v", err)
+			return
+		}
+	}
+}
+
+// do performs req and returns the response, plus the bound socket for a
+// listen request.
+func (h *Helper) do(req request, added map[string]bool) (response, *os.File) {
+	if err := req.check(); err != nil {
+		return errorResponse(err), nil
+	}
+	switch req.Op {
+	case opAddHost:
+		err := h.Hosts.Add(req.IP, req.Host)
+		if err == nil {
+			added[strings.ToLower(req.Host)] = true
+		}
+		return errorResponse(err), nil
+	case opRemoveHost:
+		// Another session may still serve entries this one did not add.
+		host := strings.ToLower(req.Host)
+		if !added[host] {
+			return errorResponse(fmt.Errorf("%s was not added by this connection", req.Host)), nil
+		}
+		delete(added, host)
+		return errorResponse(h.Hosts.Remove(req.Host)), nil
+	default:
+		network := "tcp6"
+		if host, _, _ := net.SplitHostPort(req.Addr); net.ParseIP(host).To4() != nil {
+			network = "tcp4"
+		}
+		ln, err := net.Listen(network, req.Addr)
+		if err != nil {
+			return errorResponse(err), nil
+		}
+		defer ln.Close()
+		f, err := ln.(*net.TCPListener).File()
+		return errorResponse(err), f
+	}
+}
+
+func errorResponse(err error) response {
+	var conflict *hosts.ConflictError
+	switch {
+	case err == nil:
+		return response{}
+	case errors.Is(err, hosts.ErrAlreadyPresent):
+		return response{Error: err.Error(), Code: codeAlreadyPresent}
+	case errors.As(err, &conflict):
+		return response{Error: err.Error(), Code: codeConflict}
+	}
+	return response{Error: err.Error()}
+}
+
+// reply writes resp as one line of JSON, passing file along as SCM_RIGHTS.
+func reply(conn *net.UnixConn, resp response, file *os.File) error {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	var oob []byte
+	if file != nil {
+		defer file.Close()
+		oob = syscall.UnixRights(int(file.Fd()))
+	}
+	_, _, err = conn.WriteMsgUnix(append(b, '\n'), oob, nil)
+	return err
+}
+
+// peerUID returns the user id of the process at the other end of conn.
+func peerUID(conn *net.UnixConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return int(cred.Uid), nil
+}
+
+// Client talks to a helper. Its Add and Remove methods mirror those of
+// hosts.Manager. It is safe for concurrent use.
+type Client struct {
+	mu   sync.Mutex
+	conn *net.UnixConn
+}
+
+// Dial connects to the helper listening at path.
+func Dial(path string) (*Client, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn}, nil
+}
+
+// Close ends the connection; the helper then removes the hosts entries the
+// client added and did not remove.
+func (c *Client) Close() error { return c.conn.Close() }
+
+// Add maps domain to ip in the hosts file, like hosts.Manager.Add.
+func (c *Client) Add(ip, domain string) error {
+	_, err := c.call(request{Op: opAddHost, IP: ip, Host: domain})
+	return err
+}
+
+// Remove deletes the managed entries of domain, like hosts.Manager.Remove.
+func (c *Client) Remove(domain string) error {
+	_, err := c.call(request{Op: opRemoveHost, Host: domain})
+	return err
+}
+
+// Listen asks the helper to bind addr, a loopback address and port, and
+// returns the listening socket. Use net.FileListener to serve on it.
+func (c *Client) Listen(addr string) (*os.File, error) {
+	f, err := c.call(request{Op: opListen, Addr: addr})
+	if err == nil && f == nil {
+		err = errors.New("helper sent no socket")
+	}
+	return f, err
+}
+
+func (c *Client) call(req request) (*os.File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.Write(append(b, '\n')); err != nil {
+		return nil, fmt.Errorf("helper: %w", err)
+	}
+	var (
+		line []byte
+		file *os.File
+		buf  = make([]byte, 4096)
+		oob  = make([]byte, syscall.CmsgSpace(4))
+	)
+	for !bytes.HasSuffix(line, []byte("\n")) {
+		n, oobn, _, _, err := c.conn.ReadMsgUnix(buf, oob)
+		if err == nil && n == 0 {
+			err = io.EOF
+		}
+		if err != nil {
+			if file != nil {
+				file.Close()
+			}
+			return nil, fmt.Errorf("helper: %w", err)
+		}
+		line = append(line, buf[:n]...)
+		if oobn > 0 && file == nil {
+			if file, err = unixRightsFile(oob[:oobn]); err != nil {
+				return nil, fmt.Errorf("helper: %w", err)
+			}
+		}
+	}
+	var resp response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("helper: %w", err)
+	}
+	switch {
+	case resp.Code == codeAlreadyPresent:
+		err = hosts.ErrAlreadyPresent
+	case resp.Error != "":
+		err = errors.New(resp.Error)
+	}
+	if err != nil && file != nil {
+		file.Close()
+		file = nil
+	}
+	return file, err
+}
+
+// unixRightsFile returns the file descriptor passed in oob.
+func unixRightsFile(oob []byte) (*os.File, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil || len(msgs) == 0 {
+		return nil, fmt.Errorf("parse control message: %v", err)
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) == 0 {
+		return nil, fmt.Errorf("parse passed socket: %v", err)
+	}
+	for _, fd := range fds[1:] {
+		syscall.Close(fd)
+	}
+	return os.NewFile(uintptr(fds[0]), "reflex-helper-socket"), nil
+}
+
+// SystemdListeners returns the sockets passed by systemd socket activation
+// (LISTEN_PID and LISTEN_FDS), or nil when there are none. The variables
+// are cleared so that child processes, such as the browser, do not claim
+// the sockets too.
+func SystemdListeners() ([]*os.File, error) {
+	pid, count := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if count == "" {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(v)
+	}
+	if p, err := strconv.Atoi(pid); err != nil || p != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS=%q", count)
+	}
+	const firstFD = 3
+	files := make([]*os.File, n)
+	for i := range files {
+		fd := firstFD + i
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files[i] = os.NewFile(uintptr(fd), name)
+	}
+	return files, nil
+}
@@ -0,0 +1,175 @@
+//go:build linux
+
+package privhelper
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samfrm/reflex/internal/hosts"
+)
+
+func startHelper(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	hp := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(hp, []byte("127.0.0.1 localhost\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "run", "helper.sock")
+	ln, err := Listen(sock)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	h := &Helper{Hosts: hosts.Manager{Path: hp}, UID: os.Getuid()}
+	go h.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	return sock, hp
+}
+
+func TestHelperHosts(t *testing.T) {
+	sock, hp := startHelper(t)
+	c, err := Dial(sock)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if err := c.Add("127.0.0.1", "news.google.com"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := c.Add("127.0.0.1", "news.google.com"); !errors.Is(err, hosts.ErrAlreadyPresent) {
+		t.Fatalf("second Add = %v; want ErrAlreadyPresent", err)
+	}
+	for _, bad := range [][2]string{{"203.0.113.9", "news.google.com"}, {"127.0.0.1", "evil.test # x"}, {"127.0.0.1", ""}} {
+		if err := c.Add(bad[0], bad[1]); err == nil {
+			t.Fatalf("Add(%q, %q) accepted", bad[0], bad[1])
+		}
+	}
+	if err := c.Add("::1", "t.co"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := c.Remove("news.google.com"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if ok, _, _ := (hosts.Manager{Path: hp}).Contains("news.google.com"); ok {
+		t.Fatalf("news.google.com still mapped")
+	}
+
+	// Entries a client leaves behind go with its connection.
+	c.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		ok, _, _ := (hosts.Manager{Path: hp}).Contains("t.co")
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("t.co not removed after the client disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHelperRemovesOnlyOwnEntries(t *testing.T) {
+	sock, hp := startHelper(t)
+	owner, err := Dial(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Close()
+	other, err := Dial(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := owner.Add("127.0.0.1", "news.google.com"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	for _, host := range []string{"news.google.com", "localhost"} {
+		if err := other.Remove(host); err == nil {
+			t.Errorf("Remove(%q) from another connection accepted", host)
+		}
+	}
+	if ok, _, _ := (hosts.Manager{Path: hp}).Contains("news.google.com"); !ok {
+		t.Fatalf("another connection removed news.google.com")
+	}
+	if err := owner.Remove("NEWS.google.com"); err != nil {
+		t.Fatalf("owner Remove: %v", err)
+	}
+}
+
+func TestHelperListen(t *testing.T) {
+	sock, _ := startHelper(t)
+	c, err := Dial(sock)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Listen("0.0.0.0:0"); err == nil || !strings.Contains(err.Error(), "loopback") {
+		t.Fatalf("Listen on every interface = %v; want refusal", err)
+	}
+	f, err := c.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		t.Fatalf("FileListener: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			conn.Write([]byte("hi"))
+			conn.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	buf := make([]byte, 2)
+	if _, err := conn.Read(buf); err != nil || string(buf) != "hi" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	conn.Close()
+}
+
+func TestHelperRefusesOtherUsers(t *testing.T) {
+	dir := t.TempDir()
+	ln, err := Listen(filepath.Join(dir, "helper.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	uid := os.Getuid()
+	if uid == 0 {
+		t.Skip("root is always allowed")
+	}
+	h := &Helper{Hosts: hosts.Manager{Path: filepath.Join(dir, "hosts")}, UID: uid + 1}
+	go h.Serve(ln)
+	c, err := Dial(filepath.Join(dir, "helper.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Remove("t.co"); err == nil {
+		t.Fatalf("helper served a user it should refuse")
+	}
+}
+
+func TestSystemdListenersIgnoresOtherPIDs(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	files, err := SystemdListeners()
+	if err != nil || files != nil {
+		t.Fatalf("SystemdListeners = %v, %v; want none", files, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Fatalf("LISTEN_FDS not cleared")
+	}
+}
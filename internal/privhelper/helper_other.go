@@ -0,0 +1,36 @@
+//go:build !linux
+
+package privhelper
+
+import (
+	"net"
+	"os"
+
+	"github.com/samfrm/reflex/internal/hosts"
+)
+
+// Helper performs the privileged requests of one user. Linux only.
+type Helper struct {
+	Hosts hosts.Manager
+	UID   int
+}
+
+// Listen is not supported outside Linux.
+func Listen(path string) (*net.UnixListener, error) { return nil, ErrUnsupported }
+
+// Serve is not supported outside Linux.
+func (h *Helper) Serve(ln *net.UnixListener) error { return ErrUnsupported }
+
+// Client talks to a helper. Linux only.
+type Client struct{}
+
+// Dial is not supported outside Linux.
+func Dial(path string) (*Client, error) { return nil, ErrUnsupported }
+
+func (c *Client) Close() error                         { return nil }
+func (c *Client) Add(ip, domain string) error          { return ErrUnsupported }
+func (c *Client) Remove(domain string) error           { return ErrUnsupported }
+func (c *Client) Listen(addr string) (*os.File, error) { return nil, ErrUnsupported }
+
+// SystemdListeners reports no sockets outside Linux.
+func SystemdListeners() ([]*os.File, error) { return nil, nil }
@@ -0,0 +1,107 @@
+// Package privhelper splits reflex's privileged work from the rest on
+// Linux. A small helper running as root edits the hosts file and binds
+// privileged ports; reflex, running as the normal user, asks it over a unix
+// socket and receives the bound sockets by fd passing. Sockets handed over
+// by systemd socket activation work the same way without a helper.
+package privhelper
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultSocket is where the helper listens unless told otherwise.
+const DefaultSocket = "/run/reflex/helper.sock"
+
+// ErrUnsupported is returned on platforms without the helper.
+var ErrUnsupported = errors.New("the privileged helper is only available on Linux")
+
+// Operations a client can request.
+const (
+	opAddHost    = "hosts-add"
+	opRemoveHost = "hosts-remove"
+	opListen     = "listen"
+)
+
+// Error codes that map back to errors of the hosts package.
+const (
+	codeAlreadyPresent = "already-present"
+	codeConflict       = "conflict"
+)
+
+// request is one line of JSON sent by the client.
+type request struct {
+	Op   string `json:"op"`
+	IP   string `json:"ip,omitempty"`
+	Host string `json:"host,omitempty"`
+	Addr string `json:"addr,omitempty"`
+}
+
+// response answers a request. A listen response carries the socket as
+// SCM_RIGHTS ancillary data.
+type response struct {
+	Error string `json:"error,omitempty"`
+	Code  string `json:"code,omitempty"`
+}
+
+// String describes req for the helper log.
+func (req request) String() string {
+	parts := []string{req.Op}
+	for _, v := range []string{req.IP, req.Host, req.Addr} {
+		if v != "" {
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// check validates req against what the helper is willing to do: map names
+// to loopback addresses only, and bind loopback addresses only, so the
+// helper cannot be used to redirect real traffic or expose a port.
+func (req request) check() error {
+	switch req.Op {
+	case opAddHost:
+		if ip := net.ParseIP(req.IP); ip == nil || !ip.IsLoopback() {
+			return fmt.Errorf("refusing to map %q: only loopback addresses are allowed", req.IP)
+		}
+		return checkHost(req.Host)
+	case opRemoveHost:
+		return checkHost(req.Host)
+	case opListen:
+		host, port, err := net.SplitHostPort(req.Addr)
+		if err != nil {
+			return fmt.Errorf("invalid listen address %q: %w", req.Addr, err)
+		}
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return fmt.Errorf("refusing to listen on %q: only loopback addresses are allowed", req.Addr)
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+			return fmt.Errorf("invalid listen port in %q", req.Addr)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown operation %q", req.Op)
+	}
+}
+
+// checkHost accepts DNS names only, so nothing else can end up in the
+// hosts file.
+func checkHost(host string) error {
+	if host == "" || len(host) > 253 {
+		return fmt.Errorf("invalid host name %q", host)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("invalid host name %q", host)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("invalid host name %q", host)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+// Package scenario loads declarative referrer → target test matrices from
+// YAML or JSON files.
+package scenario
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/samfrm/reflex/internal/policy"
+	"github.com/samfrm/reflex/internal/presets"
+	"github.com/samfrm/reflex/internal/server"
+	"github.com/samfrm/reflex/internal/util"
+)
+
+// DefaultDuration is how long a scenario is served when it sets no duration.
+const DefaultDuration = 20 * time.Second
+
+// File is the top-level document of a scenario file. Defaults fill in any
+// field a scenario leaves empty.
+type File struct {
+	Defaults  Scenario   `yaml:"defaults" json:"defaults"`
+	Scenarios []Scenario `yaml:"scenarios" json:"scenarios"`
+}
+
+// Scenario describes one referrer → target run.
+type Scenario struct {
+	Name string `yaml:"name" json:"name"`
+	// Preset names a well-known referrer (see reflex presets list) whose
+	// URL, method, policy, link attributes and parameters fill the fields
+	// the scenario leaves empty.
+	Preset         string `yaml:"preset" json:"preset"`
+	Referrer       string `yaml:"referrer" json:"referrer"`
+	Target         string `yaml:"target" json:"target"`
+	Method         string `yaml:"method" json:"method"`
+	ReferrerPolicy string `yaml:"referrer_policy" json:"referrer_policy"`
+	Rel            string `yaml:"rel" json:"rel"`
+	NewWindow      *bool  `yaml:"new_window" json:"new_window"`
+	// Template is a built-in landing page template name or the path of an
+	// html/template file, relative to the scenario file. Paths contain a
+	// slash or end in .html.
+	Template string `yaml:"template" json:"template"`
+	// Params are query parameters set on the target, such as utm_source or
+	// gclid. They override the defaults and run flags key by key.
+	Params map[string]string `yaml:"params" json:"params"`
+	// ClickID is "auto" to add a random click ID of the kind the
+	// referrer's ads use, or "none" to turn --auto-click-id off.
+	ClickID  string   `yaml:"click_id" json:"click_id"`
+	Delay    Duration `yaml:"delay" json:"delay"`
+	Duration Duration `yaml:"duration" json:"duration"`
+	Expect   Expect   `yaml:"expect" json:"expect"`
+}
+
+// Expect holds the outcome a scenario should produce on the target; only
+// reflex verify checks it. Empty fields are not checked; "none" means the
+// value must be empty.
+type Expect struct {
+	Referer          string `yaml:"referer" json:"referer"`
+	DocumentReferrer string `yaml:"document_referrer" json:"document_referrer"`
+}
+
+// IsZero reports whether no expectation was set.
+func (e Expect) IsZero() bool { return e.Referer == "" && e.DocumentReferrer == "" }
+
+// Duration accepts either a Go duration string ("1.5s") or a number of
+// milliseconds, matching the --delay flag.
+type Duration struct {
+	time.Duration
+	Set bool
+}
+
+func (d *Duration) parse(s string) error {
+	s = strings.TrimSpace(s)
+	if ms, err := strconv.Atoi(s); err == nil {
+		d.Duration, d.Set = time.Duration(ms)*time.Millisecond, true
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	d.Duration, d.Set = v, true
+	return nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (d *Duration) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: duration must be a scalar", n.Line)
+	}
+	return d.parse(n.Value)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		s = string(b)
+	}
+	return d.parse(s)
+}
+
+// Load reads and validates a scenario file. The format is chosen by
+// extension: .json is JSON, anything else is parsed as YAML.
+func Load(path string) ([]Scenario, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f File
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(&f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	out := make([]Scenario, len(f.Scenarios))
+	d := f.Defaults.withPreset()
+	for i, s := range f.Scenarios {
+		if s.Preset == "" {
+			s.Preset = d.Preset
+		}
+		s = s.withPreset().withDefaults(d)
+		s.Template = resolveTemplate(s.Template, filepath.Dir(path))
+		out[i] = s
+	}
+	if err := Validate(out); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return out, nil
+}
+
+// resolveTemplate makes a template file path relative to dir; built-in
+// template names and absolute paths are returned as is. What counts as a
+// file is server.IsTemplateFile's rule, the same as for --template.
+func resolveTemplate(spec, dir string) string {
+	if !server.IsTemplateFile(spec) || filepath.IsAbs(spec) {
+		return spec
+	}
+	return filepath.Join(dir, spec)
+}
+
+// withPreset fills the fields s leaves empty from its preset. Unknown
+// presets are reported by validate.
+func (s Scenario) withPreset() Scenario {
+	p, ok := presets.Lookup(s.Preset)
+	if !ok {
+		return s
+	}
+	if s.Referrer == "" {
+		s.Referrer = p.Referrer
+	}
+	if s.Method == "" {
+		s.Method = string(p.Method)
+	}
+	if s.ReferrerPolicy == "" {
+		s.ReferrerPolicy = p.Policy
+	}
+	if s.Rel == "" {
+		s.Rel = p.Rel
+	}
+	if s.NewWindow == nil {
+		nw := p.NewWindow
+		s.NewWindow = &nw
+	}
+	if len(p.Params) > 0 {
+		merged := make(map[string]string, len(p.Params)+len(s.Params))
+		for k, v := range p.Params {
+			merged[k] = v
+		}
+		for k, v := range s.Params {
+			merged[k] = v
+		}
+		s.Params = merged
+	}
+	return s
+}
+
+func (s Scenario) withDefaults(d Scenario) Scenario {
+	if s.Referrer == "" {
+		s.Referrer = d.Referrer
+	}
+	if s.Target == "" {
+		s.Target = d.Target
+	}
+	if s.Method == "" {
+		s.Method = d.Method
+	}
+	if s.ReferrerPolicy == "" {
+		s.ReferrerPolicy = d.ReferrerPolicy
+	}
+	if s.Rel == "" {
+		s.Rel = d.Rel
+	}
+	if s.NewWindow == nil {
+		s.NewWindow = d.NewWindow
+	}
+	if s.Template == "" {
+		s.Template = d.Template
+	}
+	if len(d.Params) > 0 {
+		merged := make(map[string]string, len(d.Params)+len(s.Params))
+		for k, v := range d.Params {
+			merged[k] = v
+		}
+		for k, v := range s.Params {
+			merged[k] = v
+		}
+		s.Params = merged
+	}
+	if s.ClickID == "" {
+		s.ClickID = d.ClickID
+	}
+	if !s.Delay.Set {
+		s.Delay = d.Delay
+	}
+	if !s.Duration.Set {
+		s.Duration = d.Duration
+	}
+	if s.Expect.Referer == "" {
+		s.Expect.Referer = d.Expect.Referer
+	}
+	if s.Expect.DocumentReferrer == "" {
+		s.Expect.DocumentReferrer = d.Expect.DocumentReferrer
+	}
+	return s
+}
+
+// Validate checks every scenario and reports all problems at once.
+func Validate(list []Scenario) error {
+	if len(list) == 0 {
+		return errors.New("no scenarios defined")
+	}
+	var errs []error
+	names := make(map[string]bool, len(list))
+	for i, s := range list {
+		label := s.Name
+		if label == "" {
+			label = fmt.Sprintf("#%d", i+1)
+			errs = append(errs, fmt.Errorf("scenario %s: missing name", label))
+		} else if names[s.Name] {
+			errs = append(errs, fmt.Errorf("scenario %s: duplicate name", label))
+		}
+		names[s.Name] = true
+		for _, err := range s.validate() {
+			errs = append(errs, fmt.Errorf("scenario %s: %w", label, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s Scenario) validate() []error {
+	var errs []error
+	if _, ok := presets.Lookup(s.Preset); s.Preset != "" && !ok {
+		errs = append(errs, fmt.Errorf("unknown preset: %s (want %s)", s.Preset, strings.Join(presets.Names(), ", ")))
+	}
+	if s.Referrer == "" {
+		errs = append(errs, errors.New("missing referrer"))
+	} else if _, err := util.ParseReferrer(s.Referrer); err != nil {
+		errs = append(errs, fmt.Errorf("invalid referrer: %w", err))
+	}
+	if s.Target == "" {
+		errs = append(errs, errors.New("missing target"))
+	} else if _, err := util.ParseTarget(s.Target); err != nil {
+		errs = append(errs, fmt.Errorf("invalid target: %w", err))
+	}
+	if err := policy.Validate(s.ReferrerPolicy); err != nil {
+		errs = append(errs, fmt.Errorf("invalid referrer_policy: %w", err))
+	}
+	if m := server.RedirectMethod(strings.ToLower(s.Method)); m != "" && !m.Valid() {
+		errs = append(errs, fmt.Errorf("invalid method: %s (want %s)", s.Method, server.MethodNames(", ")))
+	}
+	if err := server.ValidRel(s.Rel); err != nil {
+		errs = append(errs, err)
+	}
+	if s.Template != "" {
+		if _, err := server.ParseTemplate(s.Template); err != nil {
+			errs = append(errs, err)
+		} else if server.RedirectMethod(strings.ToLower(s.Method)).StatusCode() != 0 {
+			errs = append(errs, fmt.Errorf("template needs a page based method; %s redirects serve no page", s.Method))
+		}
+	}
+	for k := range s.Params {
+		if strings.TrimSpace(k) == "" {
+			errs = append(errs, errors.New("params: empty parameter name"))
+		}
+	}
+	if c := strings.ToLower(s.ClickID); c != "" && c != "auto" && c != "none" {
+		errs = append(errs, fmt.Errorf("invalid click_id: %s (want auto or none)", s.ClickID))
+	}
+	if s.Delay.Duration < 0 || s.Duration.Duration < 0 {
+		errs = append(errs, errors.New("delay and duration must not be negative"))
+	}
+	return errs
+}
@@ -0,0 +1,214 @@
+package scenario
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, body string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadYAMLWithDefaults(t *testing.T) {
+	p := writeFile(t, "s.yaml", `
+defaults:
+  target: https://example.com/landing
+  method: meta
+  delay: 800
+scenarios:
+  - name: gnews-origin
+    referrer: https://news.google.com
+    referrer_policy: origin
+    expect:
+      referer: https://news.google.com/
+  - name: tco-302
+    referrer: t.co
+    method: "302"
+    delay: 2s
+    duration: 5s
+    expect:
+      referer: none
+`)
+	list, err := Load(p)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("got %d scenarios; want 2", len(list))
+	}
+	a, b := list[0], list[1]
+	if a.Target != "https://example.com/landing" || a.Method != "meta" || a.Delay.Duration != 800*time.Millisecond {
+		t.Fatalf("defaults not applied: %+v", a)
+	}
+	if b.Method != "302" || b.Delay.Duration != 2*time.Second || b.Duration.Duration != 5*time.Second {
+		t.Fatalf("overrides not kept: %+v", b)
+	}
+	if b.Expect.Referer != "none" {
+		t.Fatalf("expect.referer=%q", b.Expect.Referer)
+	}
+}
+
+func TestLoadJSON(t *testing.T) {
+	p := writeFile(t, "s.json", `{"scenarios":[{"name":"a","referrer":"https://bing.com","target":"https://example.com","delay":"250ms"}]}`)
+	list, err := Load(p)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if list[0].Delay.Duration != 250*time.Millisecond {
+		t.Fatalf("delay=%v", list[0].Delay.Duration)
+	}
+}
+
+func TestLoadReportsAllErrors(t *testing.T) {
+	p := writeFile(t, "bad.yaml", `
+scenarios:
+  - name: dup
+    referrer: news.google.com
+    target: example.com
+  - name: dup
+    referrer: t.co
+    target: https://example.com
+    method: carrier-pigeon
+    rel: prefetch
+`)
+	_, err := Load(p)
+	if err == nil {
+		t.Fatalf("expected validation error")
+	}
+	for _, want := range []string{"absolute http(s) URL", "duplicate name", "invalid method", "unsupported rel"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %q missing %q", err, want)
+		}
+	}
+}
+
+func TestLoadRejectsUnknownFields(t *testing.T) {
+	p := writeFile(t, "typo.yaml", "scenarios:\n  - name: a\n    referer: t.co\n    target: https://example.com\n")
+	if _, err := Load(p); err == nil {
+		t.Fatalf("expected unknown field error")
+	}
+}
+
+func TestLoadResolvesTemplatePaths(t *testing.T) {
+	p := writeFile(t, "s.yaml", `
+defaults:
+  target: https://example.com
+  template: page.html
+scenarios:
+  - name: custom
+    referrer: t.co
+  - name: builtin
+    referrer: news.google.com
+    template: search
+  - name: status
+    referrer: bing.com
+    method: "302"
+    template: search
+`)
+	if err := os.WriteFile(filepath.Join(filepath.Dir(p), "page.html"), []byte(`{{template "reflex-redirect" .}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Load(p)
+	if err == nil || !strings.Contains(err.Error(), "scenario status: template needs a page based method") {
+		t.Fatalf("expected template/method error, got %v", err)
+	}
+
+	if err := os.WriteFile(p, []byte(`
+defaults:
+  target: https://example.com
+  template: page.html
+scenarios:
+  - name: custom
+    referrer: t.co
+  - name: builtin
+    referrer: news.google.com
+    template: search
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	list, err := Load(p)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if want := filepath.Join(filepath.Dir(p), "page.html"); list[0].Template != want {
+		t.Fatalf("template = %q, want %q", list[0].Template, want)
+	}
+	if list[1].Template != "search" {
+		t.Fatalf("template = %q, want search", list[1].Template)
+	}
+}
+
+func TestLoadMergesParams(t *testing.T) {
+	p := writeFile(t, "s.yaml", `
+defaults:
+  target: https://example.com
+  params: {utm_medium: referral, utm_source: default}
+scenarios:
+  - name: ads
+    referrer: www.google.com
+    click_id: auto
+    params: {utm_source: google, gclid: fixed}
+  - name: plain
+    referrer: t.co
+`)
+	list, err := Load(p)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	want := map[string]string{"utm_medium": "referral", "utm_source": "google", "gclid": "fixed"}
+	if !reflect.DeepEqual(list[0].Params, want) || list[0].ClickID != "auto" {
+		t.Fatalf("ads: params=%v click_id=%q", list[0].Params, list[0].ClickID)
+	}
+	if list[1].Params["utm_source"] != "default" || list[1].ClickID != "" {
+		t.Fatalf("plain: params=%v click_id=%q", list[1].Params, list[1].ClickID)
+	}
+
+	bad := writeFile(t, "bad.yaml", "scenarios:\n  - name: a\n    referrer: t.co\n    target: https://example.com\n    click_id: sometimes\n")
+	if _, err := Load(bad); err == nil || !strings.Contains(err.Error(), "invalid click_id") {
+		t.Fatalf("expected click_id error, got %v", err)
+	}
+}
+
+func TestLoadAppliesPresets(t *testing.T) {
+	p := writeFile(t, "s.yaml", `
+defaults:
+  target: https://example.com
+  preset: hacker-news
+scenarios:
+  - name: hn
+  - name: gpt
+    preset: chatgpt
+    method: js
+    params: {utm_medium: referral}
+`)
+	list, err := Load(p)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	hn := list[0]
+	if hn.Referrer != "https://news.ycombinator.com/item?id=40000000" || hn.ReferrerPolicy != "origin" || hn.Method != "click" {
+		t.Fatalf("hn: %+v", hn)
+	}
+	gpt := list[1]
+	if gpt.Referrer != "https://chatgpt.com/" || gpt.Method != "js" || gpt.Rel != "noopener" || !*gpt.NewWindow {
+		t.Fatalf("gpt: %+v", gpt)
+	}
+	want := map[string]string{"utm_source": "chatgpt.com", "utm_medium": "referral"}
+	if !reflect.DeepEqual(gpt.Params, want) {
+		t.Fatalf("gpt params = %v, want %v", gpt.Params, want)
+	}
+
+	bad := writeFile(t, "bad.yaml", "scenarios:\n  - name: a\n    preset: myspace\n    target: https://example.com\n")
+	if _, err := Load(bad); err == nil || !strings.Contains(err.Error(), "unknown preset: myspace") {
+		t.Fatalf("expected preset error, got %v", err)
+	}
+}
@@ -1,73 +1,624 @@
 package server
 
 import (
+    "context"
+    "crypto/tls"
+    "errors"
     "fmt"
+    "html/template"
     "log"
+    "net"
     "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
     "time"
+
+    "github.com/samfrm/reflex/internal/capture"
 )
 
 type RedirectMethod string
 
 const (
-	Method302  RedirectMethod = "302"
-	MethodMeta RedirectMethod = "meta"
-	MethodJS   RedirectMethod = "js"
+	Method301        RedirectMethod = "301"
+	Method302        RedirectMethod = "302"
+	Method307        RedirectMethod = "307"
+	Method308        RedirectMethod = "308"
+	MethodMeta       RedirectMethod = "meta"
+	MethodJS         RedirectMethod = "js"
+	MethodClick      RedirectMethod = "click"
+	MethodFormGet    RedirectMethod = "form-get"
+	MethodFormPost   RedirectMethod = "form-post"
+	MethodWindowOpen RedirectMethod = "window-open"
+	MethodIframe     RedirectMethod = "iframe"
 )
 
+// Methods lists every supported redirect method.
+var Methods = []RedirectMethod{
+	MethodMeta, MethodJS, MethodClick, MethodFormGet, MethodFormPost, MethodWindowOpen, MethodIframe,
+	Method301, Method302, Method307, Method308,
+}
+
+// Valid reports whether m is one of Methods.
+func (m RedirectMethod) Valid() bool {
+	for _, v := range Methods {
+		if m == v {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusCode returns the HTTP status of a status-code redirect, or 0 for
+// methods that serve a page.
+func (m RedirectMethod) StatusCode() int {
+	switch m {
+	case Method301:
+		return http.StatusMovedPermanently
+	case Method302:
+		return http.StatusFound
+	case Method307:
+		return http.StatusTemporaryRedirect
+	case Method308:
+		return http.StatusPermanentRedirect
+	}
+	return 0
+}
+
+// relTokens are the link types accepted in Config.Rel.
+var relTokens = map[string]bool{
+	"noreferrer": true, "noopener": true, "opener": true,
+	"nofollow": true, "external": true, "ugc": true, "sponsored": true,
+}
+
+// ValidRel reports an error for link types reflex does not know.
+func ValidRel(rel string) error {
+	for _, t := range strings.Fields(strings.ToLower(rel)) {
+		if !relTokens[t] {
+			return fmt.Errorf("unsupported rel %q", t)
+		}
+	}
+	return nil
+}
+
+// MethodNames returns Methods joined by sep, for flag help and errors.
+func MethodNames(sep string) string {
+	names := make([]string, len(Methods))
+	for i, m := range Methods {
+		names[i] = string(m)
+	}
+	return strings.Join(names, sep)
+}
+
 type Config struct {
     Port       int
+    // Listen are the addresses to listen on, one listener each, such as
+    // "127.0.0.1:443" and "[::1]:443". Empty means loopback on Port.
+    Listen     []string
+    // Allow, when not empty, restricts clients to these networks and to
+    // loopback; other clients get 403.
+    Allow      []*net.IPNet
+    // Listeners, when set, are served instead of opening Listen: sockets
+    // bound elsewhere, e.g. by systemd or a privileged helper. Shutdown
+    // closes them.
+    Listeners  []net.Listener
     CertFile   string
     KeyFile    string
     Method     RedirectMethod
     Target     string
     Delay      time.Duration
     RefHost    string
+    // LogVerbose logs a line for every request.
     LogVerbose bool
     ReferrerPolicy string
+    // Rel is the link relation ("noreferrer", "noopener", ...) set on the
+    // link or form of the click, form-* and window-open methods.
+    Rel string
+    // NewWindow opens the target in a new browsing context (target=_blank)
+    // for the click and form-* methods.
+    NewWindow bool
+    // Capture, when set, receives a record of every request, including
+    // those that matched no site.
+    Capture func(capture.Record) error
+    // Template, when set, renders the landing page of the page based
+    // methods instead of the minimal built-in markup. See ParseTemplate.
+    Template *template.Template
+    // DrainTimeout bounds how long Shutdown waits for in-flight requests;
+    // DefaultDrainTimeout when zero.
+    DrainTimeout time.Duration
+    // Sites lists additional referrer hosts served from the same listener.
+    // Requests are routed by Host and certificates are picked by SNI; empty
+    // Target/CertFile/KeyFile fields fall back to the values above.
+    Sites []Site
+}
+
+// Site is one spoofed referrer host and the target it redirects to.
+type Site struct {
+    Host     string
+    // Path is the request URI of the referrer page, e.g. "/search?q=shoes".
+    // Only its path is matched; other paths get 404. Empty or "/" answers
+    // on every path. Several sites may share a host under distinct paths;
+    // the certificate of the first one is used.
+    Path     string
+    Target   string
+    CertFile string
+    KeyFile  string
+    // Method and ReferrerPolicy override the Config values for this site
+    // when set.
+    Method         RedirectMethod
+    ReferrerPolicy string
+    // Variant lets several sites share a host and path: a request whose
+    // VariantCookie names the variant gets that site, others get the site
+    // without one, or 404 when every site has a variant. The cookie lives
+    // in the client's cookie jar, so variants suit one client visiting them
+    // in turn; capture records name the variant that served each request.
+    Variant string
 }
 
+// VariantCookie selects among sites that differ only by Variant.
+const VariantCookie = "reflex_variant"
+
 // NewHTTPServer builds an *http.Server with a dedicated handler for the
 // provided configuration. Tests can use this to start/stop the server.
 func NewHTTPServer(cfg Config) (*http.Server, error) {
-    mux := http.NewServeMux()
-    switch cfg.Method {
-    case Method302:
-        mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-            if cfg.ReferrerPolicy != "" {
-                w.Header().Set("Referrer-Policy", cfg.ReferrerPolicy)
+    if len(cfg.Sites) == 0 {
+        h, err := redirectHandler(cfg, cfg.Target)
+        if err != nil {
+            return nil, err
+        }
+        mux := http.NewServeMux()
+        mux.Handle("/", observe(cfg, cfg.Method, cfg.Target, "", h))
+        return &http.Server{Addr: cfg.addr(), Handler: restrict(cfg, mux)}, nil
+    }
+
+    byHost := make(map[string]*hostRoutes, len(cfg.Sites))
+    certByHost := make(map[string]*tls.Certificate, len(cfg.Sites))
+    var fallbackCert *tls.Certificate
+    notFound := observe(cfg, "", "", "", http.NotFoundHandler())
+    for _, site := range cfg.Sites {
+        host := strings.ToLower(site.Host)
+        if host == "" {
+            return nil, fmt.Errorf("site without host")
+        }
+        routes, ok := byHost[host]
+        if !ok {
+            routes = &hostRoutes{paths: make(map[route]http.Handler), notFound: notFound}
+            byHost[host] = routes
+        }
+        target := site.Target
+        if target == "" {
+            target = cfg.Target
+        }
+        scfg := cfg
+        if site.Method != "" {
+            scfg.Method = site.Method
+        }
+        if site.ReferrerPolicy != "" {
+            scfg.ReferrerPolicy = site.ReferrerPolicy
+        }
+        h, err := redirectHandler(scfg, target)
+        if err != nil {
+            return nil, err
+        }
+        if err := routes.add(site.Path, site.Variant, observe(scfg, scfg.Method, target, site.Variant, h)); err != nil {
+            return nil, fmt.Errorf("duplicate site: %s%s", site.Host, err)
+        }
+        if _, ok := certByHost[host]; ok {
+            continue
+        }
+        certFile, keyFile := site.CertFile, site.KeyFile
+        if certFile == "" {
+            certFile, keyFile = cfg.CertFile, cfg.KeyFile
+        }
+        if certFile == "" {
+            continue
+        }
+        pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+        if err != nil {
+            return nil, fmt.Errorf("load certificate for %s: %w", site.Host, err)
+        }
+        certByHost[host] = &pair
+        if fallbackCert == nil {
+            fallbackCert = &pair
+        }
+    }
+
+    router := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        host := r.Host
+        if h, _, err := net.SplitHostPort(host); err == nil {
+            host = h
+        }
+        if h, ok := byHost[strings.ToLower(host)]; ok {
+            h.ServeHTTP(w, r)
+            return
+        }
+        notFound.ServeHTTP(w, r)
+    })
+    tlsCfg := &tls.Config{
+        GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+            if c, ok := certByHost[strings.ToLower(hello.ServerName)]; ok {
+                return c, nil
             }
-            http.Redirect(w, r, cfg.Target, http.StatusFound)
-        })
-    case MethodMeta:
-        mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-            w.Header().Set("Content-Type", "text/html; charset=utf-8")
-            if cfg.ReferrerPolicy != "" {
-                w.Header().Set("Referrer-Policy", cfg.ReferrerPolicy)
+            if fallbackCert == nil {
+                return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+            }
+            return fallbackCert, nil
+        },
+    }
+    return &http.Server{Addr: cfg.addr(), Handler: restrict(cfg, router), TLSConfig: tlsCfg}, nil
+}
+
+// addr returns the first listen address.
+func (cfg Config) addr() string {
+    if len(cfg.Listen) > 0 {
+        return cfg.Listen[0]
+    }
+    return net.JoinHostPort("127.0.0.1", strconv.Itoa(cfg.Port))
+}
+
+// restrict answers clients outside cfg.Allow with 403 before h sees them.
+// Refused requests are still observed.
+func restrict(cfg Config, h http.Handler) http.Handler {
+    if len(cfg.Allow) == 0 {
+        return h
+    }
+    forbidden := observe(cfg, "", "", "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        http.Error(w, "forbidden", http.StatusForbidden)
+    }))
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if allowed(cfg.Allow, r.RemoteAddr) {
+            h.ServeHTTP(w, r)
+            return
+        }
+        forbidden.ServeHTTP(w, r)
+    })
+}
+
+// allowed reports whether the client at remoteAddr is loopback or in one
+// of nets.
+func allowed(nets []*net.IPNet, remoteAddr string) bool {
+    host, _, err := net.SplitHostPort(remoteAddr)
+    if err != nil {
+        host = remoteAddr
+    }
+    ip := net.ParseIP(host)
+    if ip == nil {
+        return false
+    }
+    if ip.IsLoopback() {
+        return true
+    }
+    for _, n := range nets {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// hostRoutes dispatches the requests of one host by path and variant. A
+// site without a path answers every path no other site of the host claims.
+type hostRoutes struct {
+    paths    map[route]http.Handler
+    notFound http.Handler
+}
+
+// route is a path, "" for any path, and a variant, "" for none.
+type route struct{ path, variant string }
+
+// add routes the path of requestURI under variant to h; the error names a
+// route that is already taken.
+func (rt *hostRoutes) add(requestURI, variant string, h http.Handler) error {
+    p := requestURI
+    if i := strings.IndexByte(p, '?'); i >= 0 {
+        p = p[:i]
+    }
+    if p == "/" {
+        p = ""
+    }
+    k := route{p, variant}
+    if _, dup := rt.paths[k]; dup {
+        name := p
+        if name == "" {
+            name = "/"
+        }
+        if variant != "" {
+            name += " (variant " + variant + ")"
+        }
+        return errors.New(name)
+    }
+    rt.paths[k] = h
+    return nil
+}
+
+func (rt *hostRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    p, variant := r.URL.EscapedPath(), ""
+    if c, err := r.Cookie(VariantCookie); err == nil {
+        variant = c.Value
+    }
+    for _, k := range []route{{p, variant}, {p, ""}, {"", variant}, {"", ""}} {
+        if h, ok := rt.paths[k]; ok {
+            h.ServeHTTP(w, r)
+            return
+        }
+    }
+    rt.notFound.ServeHTTP(w, r)
+}
+
+// observe records every request served by h through cfg.Capture and, with
+// LogVerbose, logs a summary line. method, target and variant describe the
+// redirect h serves and are empty when no site matched.
+func observe(cfg Config, method RedirectMethod, target, variant string, h http.Handler) http.Handler {
+    if cfg.Capture == nil && !cfg.LogVerbose {
+        return h
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        rec := capture.FromRequest(r)
+        sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+        h.ServeHTTP(sw, r)
+        rec.Redirect, rec.Target, rec.Variant, rec.Status = string(method), target, variant, sw.status
+        if cfg.LogVerbose {
+            served := ""
+            if variant != "" {
+                served = " [" + variant + "]"
+            }
+            log.Printf("%s https://%s%s%s from %s: %d (%s), Referer %q, UA %q", rec.Method, rec.Host, rec.Path, served, rec.RemoteAddr, rec.Status, rec.TLSVersion, rec.Referer, rec.UserAgent)
+        }
+        if cfg.Capture != nil {
+            if err := cfg.Capture(rec); err != nil {
+                log.Printf("capture request: %v", err)
             }
-            fmt.Fprintf(w, `<!doctype html><html><head><title>Redirect</title><meta name="referrer" content="%s"><meta http-equiv="refresh" content="%.1f;url=%s"></head><body>Redirecting to <a href="%s">target</a>…</body></html>`, cfg.ReferrerPolicy, cfg.Delay.Seconds(), cfg.Target, cfg.Target)
-        })
-    case MethodJS:
-        mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-            w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        }
+    })
+}
+
+// statusWriter remembers the status code written through it.
+type statusWriter struct {
+    http.ResponseWriter
+    status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+    w.status = code
+    w.ResponseWriter.WriteHeader(code)
+}
+
+// redirectHandler serves the configured redirect method towards target.
+func redirectHandler(cfg Config, target string) (http.Handler, error) {
+    if code := cfg.Method.StatusCode(); code != 0 {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
             if cfg.ReferrerPolicy != "" {
                 w.Header().Set("Referrer-Policy", cfg.ReferrerPolicy)
             }
-            fmt.Fprintf(w, `<!doctype html><html><head><title>Redirect</title><meta name="referrer" content="%s"></head><body>Redirecting to <a id="l" href="%s">target</a>…<script>setTimeout(function(){window.location=%q}, %d)</script></body></html>`, cfg.ReferrerPolicy, cfg.Target, cfg.Target, int(cfg.Delay.Milliseconds()))
-        })
-    default:
-        return nil, fmt.Errorf("unknown redirect method: %s", cfg.Method)
+            http.Redirect(w, r, target, code)
+        }), nil
+    }
+    p, err := redirectPage(cfg, target)
+    if err != nil {
+        return nil, err
+    }
+    if cfg.Template == nil {
+        cfg.Template = defaultTemplate
+    }
+    return templateHandler(cfg, target, p), nil
+}
+
+// page is the method specific markup of a redirect page.
+type page struct{ head, body template.HTML }
+
+// pageData is what the method templates are executed with.
+type pageData struct {
+    Target string
+    // Action and Fields are the form action and hidden inputs of form-get
+    // and form-post.
+    Action    string
+    Fields    []formField
+    Post      bool
+    Rel       string
+    NewWindow bool
+    // Features is the window.open feature list of window-open.
+    Features string
+    Seconds  string
+    DelayMS  int64
+}
+
+type formField struct{ Name, Value string }
+
+// redirectPage returns the markup that navigates to target for the page
+// based methods. Script driven methods keep a visible fallback.
+func redirectPage(cfg Config, target string) (page, error) {
+    if !cfg.Method.Valid() {
+        return page{}, fmt.Errorf("unknown redirect method: %s", cfg.Method)
+    }
+    u, err := url.Parse(target)
+    if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+        return page{}, fmt.Errorf("target %q must be an absolute http(s) URL", target)
+    }
+    data := pageData{
+        Target:    target,
+        Action:    target,
+        Post:      cfg.Method == MethodFormPost,
+        Rel:       cfg.Rel,
+        NewWindow: cfg.NewWindow,
+        Features:  strings.Join(strings.Fields(cfg.Rel), ","),
+        Seconds:   strconv.FormatFloat(cfg.Delay.Seconds(), 'f', 1, 64),
+        DelayMS:   cfg.Delay.Milliseconds(),
+    }
+    if cfg.Method == MethodFormGet && u.RawQuery != "" {
+        // A GET submission replaces the action's query with the form
+        // fields, so carry the target query over as hidden inputs.
+        q := u.Query()
+        keys := make([]string, 0, len(q))
+        for k := range q {
+            keys = append(keys, k)
+        }
+        sort.Strings(keys)
+        for _, k := range keys {
+            for _, v := range q[k] {
+                data.Fields = append(data.Fields, formField{k, v})
+            }
+        }
+        u.RawQuery = ""
+        data.Action = u.String()
+    }
+    var p page
+    for _, part := range []struct {
+        name string
+        out  *template.HTML
+    }{{"head-", &p.head}, {"body-", &p.body}} {
+        t := methodTemplates.Lookup(part.name + string(cfg.Method))
+        if t == nil {
+            continue
+        }
+        var buf strings.Builder
+        if err := t.Execute(&buf, data); err != nil {
+            return page{}, fmt.Errorf("render %s page: %w", cfg.Method, err)
+        }
+        *part.out = template.HTML(buf.String())
     }
-    addr := fmt.Sprintf(":%d", cfg.Port)
-    return &http.Server{Addr: addr, Handler: mux}, nil
+    return p, nil
 }
 
-func Run(cfg Config) error {
+// DefaultDrainTimeout is how long Shutdown lets in-flight requests finish
+// when Config.DrainTimeout is zero.
+const DefaultDrainTimeout = 5 * time.Second
+
+// Server is a running HTTPS server returned by Start.
+type Server struct {
+    srv   *http.Server
+    lns   []net.Listener
+    drain time.Duration
+    done  chan struct{}
+    err   error
+}
+
+// Start listens on cfg.Listen (or loopback on cfg.Port) and serves cfg in the background
+// until Shutdown is called or serving fails.
+func Start(cfg Config) (*Server, error) {
     srv, err := NewHTTPServer(cfg)
+    if err != nil {
+        return nil, err
+    }
+    if len(cfg.Listeners) > 0 {
+        return serveListeners(srv, cfg.Listeners, cfg.CertFile, cfg.KeyFile, cfg.DrainTimeout), nil
+    }
+    addrs := cfg.Listen
+    if len(addrs) == 0 {
+        addrs = []string{srv.Addr}
+    }
+    return serve(srv, addrs, cfg.CertFile, cfg.KeyFile, cfg.DrainTimeout)
+}
+
+// Serve listens on srv.Addr and serves srv over TLS in the background, like
+// Start, for handlers other than the redirect server. certFile and keyFile
+// may be empty when srv.TLSConfig provides certificates; drain is the
+// Shutdown drain timeout, DefaultDrainTimeout when zero.
+func Serve(srv *http.Server, certFile, keyFile string, drain time.Duration) (*Server, error) {
+    return serve(srv, []string{srv.Addr}, certFile, keyFile, drain)
+}
+
+func serve(srv *http.Server, addrs []string, certFile, keyFile string, drain time.Duration) (*Server, error) {
+    var lns []net.Listener
+    for _, addr := range addrs {
+        ln, err := net.Listen(listenNetwork(addr), addr)
+        if err != nil {
+            for _, l := range lns {
+                _ = l.Close()
+            }
+            return nil, fmt.Errorf("listen %s: %w", addr, err)
+        }
+        lns = append(lns, ln)
+    }
+    return serveListeners(srv, lns, certFile, keyFile, drain), nil
+}
+
+func serveListeners(srv *http.Server, lns []net.Listener, certFile, keyFile string, drain time.Duration) *Server {
+    s := &Server{srv: srv, lns: lns, drain: drain, done: make(chan struct{})}
+    if s.drain <= 0 {
+        s.drain = DefaultDrainTimeout
+    }
+    var wg sync.WaitGroup
+    var once sync.Once
+    for _, ln := range s.lns {
+        wg.Add(1)
+        go func(ln net.Listener) {
+            defer wg.Done()
+            if err := srv.ServeTLS(ln, certFile, keyFile); !errors.Is(err, http.ErrServerClosed) {
+                once.Do(func() { s.err = err })
+                // One failed listener stops the others too.
+                _ = srv.Close()
+            }
+        }(ln)
+    }
+    go func() {
+        wg.Wait()
+        close(s.done)
+    }()
+    return s
+}
+
+// listenNetwork pins a listener to one address family when addr names an
+// IP, so "[::1]:443" never ends up dual-stack and "127.0.0.1:443" never
+// IPv6-only, whatever the system defaults are.
+func listenNetwork(addr string) string {
+    host, _, err := net.SplitHostPort(addr)
+    if ip := net.ParseIP(host); err == nil && ip != nil {
+        if ip.To4() != nil {
+            return "tcp4"
+        }
+        return "tcp6"
+    }
+    return "tcp"
+}
+
+// Addr returns the address of the first listener.
+func (s *Server) Addr() net.Addr { return s.lns[0].Addr() }
+
+// Addrs returns the addresses of all listeners.
+func (s *Server) Addrs() []net.Addr {
+    out := make([]net.Addr, len(s.lns))
+    for i, ln := range s.lns {
+        out[i] = ln.Addr()
+    }
+    return out
+}
+
+// Done is closed when the server has stopped serving.
+func (s *Server) Done() <-chan struct{} { return s.done }
+
+// Err returns why serving stopped once Done is closed; nil after Shutdown.
+func (s *Server) Err() error {
+    <-s.done
+    return s.err
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests to
+// complete, for at most the drain timeout or until ctx ends. Connections
+// still open after that are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+    ctx, cancel := context.WithTimeout(ctx, s.drain)
+    defer cancel()
+    err := s.srv.Shutdown(ctx)
+    if err != nil {
+        _ = s.srv.Close()
+    }
+    <-s.done
+    return err
+}
+
+// Run serves cfg until ctx is cancelled, then shuts down gracefully.
+func Run(ctx context.Context, cfg Config) error {
+    s, err := Start(cfg)
     if err != nil {
         return err
     }
-    addr := fmt.Sprintf(":%d", cfg.Port)
-    log.Printf("starting HTTPS server on %s", addr)
-    return srv.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
+    log.Printf("starting HTTPS server on %s", s.Addr())
+    select {
+    case <-ctx.Done():
+        return s.Shutdown(context.Background())
+    case <-s.Done():
+        return s.Err()
+    }
 }
@@ -8,16 +8,21 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/samfrm/reflex/internal/capture"
 )
 
 // genSelfSigned writes a localhost cert/key pair to dir and returns their paths.
@@ -142,3 +147,582 @@ func TestServerMetaAndJS(t *testing.T) {
 		stop()
 	}
 }
+
+// genSelfSignedFor writes a cert/key pair for host into dir/host.
+func genSelfSignedFor(t *testing.T, dir, host string) (string, string) {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("gen key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{host},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+	sub := filepath.Join(dir, host)
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(sub, "cert.pem")
+	keyFile := filepath.Join(sub, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+// clientVia returns a client that sends every request to addr regardless of
+// the URL host, so SNI and Host reflect the spoofed referrer name.
+func clientVia(addr string) *http.Client {
+	c := httpClientInsecure()
+	c.Transport.(*http.Transport).DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	return c
+}
+
+func TestServerMultiSiteSNI(t *testing.T) {
+	dir := t.TempDir()
+	var sites []Site
+	for _, h := range []string{"news.google.com", "t.co"} {
+		cert, key := genSelfSignedFor(t, dir, h)
+		sites = append(sites, Site{Host: h, Target: "https://example.com/from-" + h, CertFile: cert, KeyFile: key})
+	}
+	cfg := Config{Method: Method302, Sites: sites}
+	addr, stop := startTLS(t, cfg)
+	defer stop()
+
+	c := clientVia(addr)
+	for _, site := range sites {
+		resp, err := c.Get("https://" + site.Host + "/")
+		if err != nil {
+			t.Fatalf("get %s: %v", site.Host, err)
+		}
+		_ = resp.Body.Close()
+		if got := resp.Header.Get("Location"); got != site.Target {
+			t.Fatalf("%s: Location=%q want %q", site.Host, got, site.Target)
+		}
+		if cn := resp.TLS.PeerCertificates[0].Subject.CommonName; cn != site.Host {
+			t.Fatalf("%s: served certificate for %q", site.Host, cn)
+		}
+	}
+
+	resp, err := c.Get("https://unknown.test/")
+	if err != nil {
+		t.Fatalf("get unknown: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown host status=%d want 404", resp.StatusCode)
+	}
+}
+
+func TestServerSitePath(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := genSelfSignedFor(t, dir, "www.google.com")
+	site := Site{Host: "www.google.com", Path: "/search?q=acme+shoes", Target: "https://example.com/", CertFile: cert, KeyFile: key}
+	addr, stop := startTLS(t, Config{Method: Method302, Sites: []Site{site}})
+	defer stop()
+
+	c := clientVia(addr)
+	for path, want := range map[string]int{
+		"/search?q=acme+shoes": http.StatusFound,
+		"/search?q=other":      http.StatusFound,
+		"/":                    http.StatusNotFound,
+		"/favicon.ico":         http.StatusNotFound,
+	} {
+		resp, err := c.Get("https://www.google.com" + path)
+		if err != nil {
+			t.Fatalf("get %s: %v", path, err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("%s: status=%d want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestServerCapture(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := genSelfSignedFor(t, dir, "news.google.com")
+	site := Site{Host: "news.google.com", Target: "https://example.com/", CertFile: cert, KeyFile: key}
+	var mu sync.Mutex
+	var got []capture.Record
+	cfg := Config{Method: Method302, Sites: []Site{site}, Capture: func(r capture.Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, r)
+		return nil
+	}}
+	addr, stop := startTLS(t, cfg)
+	defer stop()
+
+	c := clientVia(addr)
+	for _, u := range []string{"https://news.google.com/?q=1", "https://unknown.test/x"} {
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+		req.Header.Set("User-Agent", "reflex-test")
+		req.Header.Set("Referer", "https://origin.test/")
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("get %s: %v", u, err)
+		}
+		_ = resp.Body.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 {
+		t.Fatalf("captured %d records, want 2", len(got))
+	}
+	r := got[0]
+	if r.Host != "news.google.com" || r.Path != "/?q=1" || r.Status != http.StatusFound ||
+		r.Redirect != "302" || r.Target != site.Target || r.UserAgent != "reflex-test" ||
+		r.Referer != "https://origin.test/" || r.SNI != "news.google.com" || r.TLSVersion == "" {
+		t.Fatalf("unexpected record: %+v", r)
+	}
+	if r := got[1]; r.Status != http.StatusNotFound || r.Redirect != "" || r.Target != "" || r.SNI != "unknown.test" {
+		t.Fatalf("unexpected record for unknown host: %+v", r)
+	}
+}
+
+func TestServerShutdownDrainsInFlight(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := genSelfSigned(t, dir)
+	entered, release := make(chan struct{}), make(chan struct{})
+	cfg := Config{CertFile: cert, KeyFile: key, Method: Method302, Target: "https://example.com/", Capture: func(capture.Record) error {
+		// The response is not flushed until the handler returns, so the
+		// request stays in flight while this blocks.
+		close(entered)
+		<-release
+		return nil
+	}}
+	s, err := Start(cfg)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+
+	respErr := make(chan error, 1)
+	go func() {
+		resp, err := httpClientInsecure().Get("https://" + addr + "/")
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusFound {
+				err = fmt.Errorf("status=%d", resp.StatusCode)
+			}
+		}
+		respErr <- err
+	}()
+	<-entered
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned before the request finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if err := <-respErr; err != nil {
+		t.Fatalf("in-flight request: %v", err)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatalf("Err after Shutdown: %v", err)
+	}
+}
+
+func TestServerShutdownDrainTimeout(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := genSelfSigned(t, dir)
+	entered, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	cfg := Config{CertFile: cert, KeyFile: key, Method: Method302, Target: "https://example.com/", DrainTimeout: 50 * time.Millisecond, Capture: func(capture.Record) error {
+		close(entered)
+		<-release
+		return nil
+	}}
+	s, err := Start(cfg)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+	go func() {
+		if resp, err := httpClientInsecure().Get("https://" + addr + "/"); err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	<-entered
+	if err := s.Shutdown(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown = %v, want deadline exceeded", err)
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Fatalf("server still serving after Shutdown")
+	}
+}
+
+func TestServerStatusMethods(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := genSelfSigned(t, dir)
+	for _, m := range []RedirectMethod{Method301, Method302, Method307, Method308} {
+		cfg := Config{CertFile: cert, KeyFile: key, Method: m, Target: "https://example.com/target"}
+		addr, stop := startTLS(t, cfg)
+		resp, err := httpClientInsecure().Get("https://" + addr + "/")
+		stop()
+		if err != nil {
+			t.Fatalf("get %s: %v", m, err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != m.StatusCode() || resp.Header.Get("Location") != cfg.Target {
+			t.Fatalf("%s: status=%d Location=%q", m, resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+}
+
+func TestServerPageMethods(t *testing.T) {
+	target := "https://example.com/landing?utm_source=x&b=2"
+	// The same target as escaped inside HTML attributes and JS strings.
+	attr := strings.ReplaceAll(target, "&", "&amp;")
+	js := strings.ReplaceAll(target, "&", `\u0026`)
+	cases := []struct {
+		cfg  Config
+		want []string
+	}{
+		{Config{Method: MethodClick, Rel: "noreferrer", NewWindow: true}, []string{`<a id="l" href="` + attr + `" rel="noreferrer" target="_blank">`, `.click()`}},
+		{Config{Method: MethodFormGet}, []string{`method="get" action="https://example.com/landing"`, `<input type="hidden" name="b" value="2"><input type="hidden" name="utm_source" value="x">`, `.submit()`}},
+		{Config{Method: MethodFormPost, Rel: "noopener"}, []string{`method="post" action="` + attr + `" rel="noopener"`}},
+		{Config{Method: MethodWindowOpen, Rel: "noopener noreferrer"}, []string{`window.open("` + js + `", "_blank", "noopener,noreferrer")`}},
+		{Config{Method: MethodIframe}, []string{`<iframe id="f"`, `.src="` + js + `"`}},
+	}
+	for _, tc := range cases {
+		tc.cfg.Target = target
+		p, err := redirectPage(tc.cfg, target)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.cfg.Method, err)
+		}
+		for _, w := range tc.want {
+			if !strings.Contains(string(p.head+p.body), w) {
+				t.Errorf("%s page missing %q:\n%s", tc.cfg.Method, w, p.body)
+			}
+		}
+	}
+	if _, err := NewHTTPServer(Config{Method: "bogus", Target: target}); err == nil {
+		t.Fatalf("expected error for unknown method")
+	}
+	if err := ValidRel("noopener NoReferrer"); err != nil {
+		t.Fatalf("ValidRel: %v", err)
+	}
+	if err := ValidRel("prefetch"); err == nil {
+		t.Fatalf("expected error for unsupported rel")
+	}
+}
+
+func TestServerTemplate(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := genSelfSigned(t, dir)
+	custom := filepath.Join(dir, "page.html")
+	src := `<html><head>{{template "reflex-head" .}}</head><body>{{.Host}}|{{.Query}}|{{.DelayMS}}|{{.Target}}|{{template "reflex-redirect" .}}</body></html>`
+	if err := os.WriteFile(custom, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := ParseTemplate(custom)
+	if err != nil {
+		t.Fatalf("ParseTemplate: %v", err)
+	}
+	cfg := Config{CertFile: cert, KeyFile: key, Method: MethodJS, Target: "https://example.com/t", Delay: 250 * time.Millisecond, ReferrerPolicy: "unsafe-url", Template: tmpl}
+	addr, stop := startTLS(t, cfg)
+	defer stop()
+	resp, err := httpClientInsecure().Get("https://" + addr + "/search?q=running+shoes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	for _, want := range []string{`<meta name="referrer" content="unsafe-url">`, `127.0.0.1|running shoes|250|https://example.com/t|`, `window.location="https://example.com/t"`} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("page missing %q:\n%s", want, body)
+		}
+	}
+	if resp.Header.Get("Referrer-Policy") != "unsafe-url" {
+		t.Errorf("Referrer-Policy = %q", resp.Header.Get("Referrer-Policy"))
+	}
+
+	for _, name := range TemplateNames() {
+		tmpl, err := ParseTemplate(name)
+		if err != nil {
+			t.Fatalf("built-in %s: %v", name, err)
+		}
+		var buf strings.Builder
+		if err := tmpl.Execute(&buf, PageData{Target: "https://example.com/t", Host: "news.google.com", Redirect: "<script>go()</script>"}); err != nil {
+			t.Fatalf("execute %s: %v", name, err)
+		}
+		if !strings.Contains(buf.String(), "<script>go()</script>") || !strings.Contains(buf.String(), `href="https://example.com/t"`) {
+			t.Errorf("built-in %s lacks the redirect markup or target link", name)
+		}
+	}
+	if _, err := ParseTemplate("no-such-template"); err == nil {
+		t.Fatalf("expected error for unknown template")
+	}
+}
+
+func TestParseTemplateNameOrPath(t *testing.T) {
+	// A file named like a built-in is only used when given as a path.
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "search"), []byte(`custom {{template "reflex-redirect" .}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for spec, custom := range map[string]bool{"search": false, "./search": true} {
+		tmpl, err := ParseTemplate(spec)
+		if err != nil {
+			t.Fatalf("ParseTemplate(%q): %v", spec, err)
+		}
+		var buf strings.Builder
+		if err := tmpl.Execute(&buf, PageData{Target: "https://example.com/t"}); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.HasPrefix(buf.String(), "custom "); got != custom {
+			t.Errorf("ParseTemplate(%q) used the file: %v, want %v", spec, got, custom)
+		}
+	}
+	if _, err := ParseTemplate("missing.html"); err == nil || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+func TestServerEscapesTarget(t *testing.T) {
+	// A quote in the query used to end the href attribute early.
+	target := `https://example.com/landing?q="><script>alert(1)</script>&x='y'`
+	for _, m := range Methods {
+		if m.StatusCode() != 0 {
+			continue
+		}
+		h, err := redirectHandler(Config{Method: m, ReferrerPolicy: `origin"><b>`, Rel: "noreferrer"}, target)
+		if err != nil {
+			t.Fatalf("%s: %v", m, err)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "https://news.google.com/", nil))
+		body := rec.Body.String()
+		for _, bad := range []string{"<script>alert(1)", `"><b>`} {
+			if strings.Contains(body, bad) {
+				t.Errorf("%s page contains unescaped %q:\n%s", m, bad, body)
+			}
+		}
+	}
+	for _, bad := range []string{"javascript:alert(1)", "/relative", "example.com"} {
+		if _, err := redirectPage(Config{Method: MethodMeta}, bad); err == nil {
+			t.Errorf("expected error for target %q", bad)
+		}
+	}
+}
+
+func TestServerSiteVariants(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := genSelfSignedFor(t, dir, "www.google.com")
+	sites := []Site{
+		{Host: "www.google.com", Path: "/302/origin", Target: "https://example.com/", CertFile: cert, KeyFile: key, Method: Method302, ReferrerPolicy: "origin"},
+		{Host: "www.google.com", Path: "/meta/unsafe-url", Target: "https://example.com/", Method: MethodMeta, ReferrerPolicy: "unsafe-url"},
+		{Host: "www.google.com", Target: "https://example.com/"},
+	}
+	addr, stop := startTLS(t, Config{Method: Method301, ReferrerPolicy: "no-referrer", Sites: sites})
+	defer stop()
+
+	c := clientVia(addr)
+	for path, want := range map[string]struct {
+		status int
+		policy string
+	}{
+		"/302/origin":      {http.StatusFound, "origin"},
+		"/meta/unsafe-url": {http.StatusOK, "unsafe-url"},
+		"/elsewhere":       {http.StatusMovedPermanently, "no-referrer"},
+	} {
+		resp, err := c.Get("https://www.google.com" + path)
+		if err != nil {
+			t.Fatalf("get %s: %v", path, err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != want.status || resp.Header.Get("Referrer-Policy") != want.policy {
+			t.Fatalf("%s: status=%d policy=%q, want %d %q", path, resp.StatusCode, resp.Header.Get("Referrer-Policy"), want.status, want.policy)
+		}
+	}
+
+	dup := append(sites[:1:1], Site{Host: "WWW.google.com", Path: "/302/origin?x=1", Target: "https://example.com/"})
+	if _, err := NewHTTPServer(Config{Method: MethodMeta, Sites: dup}); err == nil || !strings.Contains(err.Error(), "duplicate site") {
+		t.Fatalf("expected duplicate site error, got %v", err)
+	}
+}
+
+func TestServerVariantCookie(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := genSelfSignedFor(t, dir, "t.co")
+	sites := []Site{
+		{Host: "t.co", Path: "/AbC", Target: "https://example.com/", CertFile: cert, KeyFile: key},
+		{Host: "t.co", Path: "/AbC", Target: "https://example.com/", Variant: "302/origin", Method: Method302, ReferrerPolicy: "origin"},
+		{Host: "t.co", Path: "/AbC", Target: "https://example.com/", Variant: "301/unsafe-url", Method: Method301, ReferrerPolicy: "unsafe-url"},
+	}
+	addr, stop := startTLS(t, Config{Method: Method307, ReferrerPolicy: "no-referrer", Sites: sites})
+	defer stop()
+
+	c := clientVia(addr)
+	for variant, want := range map[string]struct {
+		status int
+		policy string
+	}{
+		"":               {http.StatusTemporaryRedirect, "no-referrer"},
+		"302/origin":     {http.StatusFound, "origin"},
+		"301/unsafe-url": {http.StatusMovedPermanently, "unsafe-url"},
+		"unknown":        {http.StatusTemporaryRedirect, "no-referrer"},
+	} {
+		req, _ := http.NewRequest("GET", "https://t.co/AbC", nil)
+		if variant != "" {
+			req.AddCookie(&http.Cookie{Name: VariantCookie, Value: variant})
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("variant %q: %v", variant, err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != want.status || resp.Header.Get("Referrer-Policy") != want.policy {
+			t.Errorf("variant %q: status=%d policy=%q, want %d %q", variant, resp.StatusCode, resp.Header.Get("Referrer-Policy"), want.status, want.policy)
+		}
+	}
+
+	dup := append(sites[:2:2], Site{Host: "t.co", Path: "/AbC", Target: "https://example.com/", Variant: "302/origin"})
+	if _, err := NewHTTPServer(Config{Method: MethodMeta, Sites: dup}); err == nil || !strings.Contains(err.Error(), "variant 302/origin") {
+		t.Fatalf("expected duplicate variant error, got %v", err)
+	}
+}
+
+func TestServerVariantCapture(t *testing.T) {
+	// As in a sweep every site has a variant: a request without the cookie
+	// matches none, and each record names the variant that served it.
+	dir := t.TempDir()
+	cert, key := genSelfSignedFor(t, dir, "t.co")
+	sites := []Site{
+		{Host: "t.co", Path: "/AbC", Target: "https://example.com/", CertFile: cert, KeyFile: key, Variant: "302/origin", Method: Method302, ReferrerPolicy: "origin"},
+		{Host: "t.co", Path: "/AbC", Target: "https://example.com/", Variant: "301/unsafe-url", Method: Method301, ReferrerPolicy: "unsafe-url"},
+	}
+	var mu sync.Mutex
+	var got []capture.Record
+	addr, stop := startTLS(t, Config{Method: Method307, Sites: sites, Capture: func(r capture.Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, r)
+		return nil
+	}})
+	defer stop()
+
+	c := clientVia(addr)
+	for _, variant := range []string{"301/unsafe-url", ""} {
+		req, _ := http.NewRequest("GET", "https://t.co/AbC", nil)
+		if variant != "" {
+			req.AddCookie(&http.Cookie{Name: VariantCookie, Value: variant})
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("variant %q: %v", variant, err)
+		}
+		_ = resp.Body.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 {
+		t.Fatalf("captured %d records, want 2", len(got))
+	}
+	if r := got[0]; r.Variant != "301/unsafe-url" || r.Redirect != "301" || r.Status != http.StatusMovedPermanently {
+		t.Errorf("unexpected record for variant: %+v", r)
+	}
+	if r := got[1]; r.Variant != "" || r.Redirect != "" || r.Status != http.StatusNotFound {
+		t.Errorf("unexpected record without cookie: %+v", r)
+	}
+}
+
+func TestServerListensOnEveryAddr(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := genSelfSigned(t, dir)
+	addrs := []string{"127.0.0.1:0"}
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		_ = ln.Close()
+		addrs = append(addrs, "[::1]:0")
+	}
+	s, err := Start(Config{Listen: addrs, CertFile: cert, KeyFile: key, Method: Method302, Target: "https://example.com/"})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer s.Shutdown(context.Background())
+	if got := len(s.Addrs()); got != len(addrs) {
+		t.Fatalf("got %d listeners, want %d", got, len(addrs))
+	}
+	for _, a := range s.Addrs() {
+		resp, err := httpClientInsecure().Get("https://" + a.String() + "/")
+		if err != nil {
+			t.Fatalf("GET via %s: %v", a, err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("GET via %s: status=%d", a, resp.StatusCode)
+		}
+	}
+
+	// A listener that cannot be opened closes the ones already open.
+	busy := s.Addrs()[0].String()
+	if _, err := Start(Config{Listen: []string{"127.0.0.1:0", busy}, CertFile: cert, KeyFile: key, Method: Method302, Target: "https://example.com/"}); err == nil {
+		t.Fatalf("expected listen error on %s", busy)
+	}
+}
+
+func TestServerAllow(t *testing.T) {
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	var recs []capture.Record
+	srv, err := NewHTTPServer(Config{Method: Method302, Target: "https://example.com/", Allow: []*net.IPNet{n}, Capture: func(r capture.Record) error {
+		recs = append(recs, r)
+		return nil
+	}})
+	if err != nil {
+		t.Fatalf("NewHTTPServer: %v", err)
+	}
+	for remote, want := range map[string]int{
+		"10.1.2.3:5000":  http.StatusFound,
+		"127.0.0.1:5000": http.StatusFound,
+		"[::1]:5000":     http.StatusFound,
+		"192.0.2.1:5000": http.StatusForbidden,
+	} {
+		r := httptest.NewRequest("GET", "https://news.google.com/", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Fatalf("%s: status=%d; want %d", remote, w.Code, want)
+		}
+	}
+	if len(recs) != 4 {
+		t.Fatalf("captured %d requests; want 4 including the refused one", len(recs))
+	}
+}
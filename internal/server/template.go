@@ -0,0 +1,153 @@
+package server
+
+import (
+    "bytes"
+    "embed"
+    "fmt"
+    "html/template"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+//go:embed templates/*.html
+var builtinTemplates embed.FS
+
+// helperTemplates are defined in every landing page template. Custom
+// templates may redefine them.
+const helperTemplates = `{{define "reflex-head"}}{{with .Policy}}<meta name="referrer" content="{{.}}">{{end}}{{.Head}}{{end}}` +
+    `{{define "reflex-redirect"}}{{.Redirect}}{{end}}`
+
+// methodTemplates render the markup that performs each page based method;
+// "head-<method>" goes into <head> and "body-<method>" into <body>.
+// html/template escapes the target for the attribute, URL and script
+// contexts it lands in.
+var methodTemplates = template.Must(template.New("methods").Parse(`
+{{- define "head-meta"}}<meta http-equiv="refresh" content="{{.Seconds}};url={{.Target}}">{{end}}
+{{- define "body-meta"}}Redirecting to <a href="{{.Target}}">target</a>…{{end}}
+{{- define "body-js"}}Redirecting to <a id="l" href="{{.Target}}">target</a>…<script>setTimeout(function(){window.location={{.Target}}}, {{.DelayMS}})</script>{{end}}
+{{- define "body-click"}}Following <a id="l" href="{{.Target}}"{{with .Rel}} rel="{{.}}"{{end}}{{if .NewWindow}} target="_blank"{{end}}>target</a>…<script>setTimeout(function(){document.getElementById("l").click()}, {{.DelayMS}})</script>{{end}}
+{{- define "form"}}<form id="f" method="{{if .Post}}post{{else}}get{{end}}" action="{{.Action}}"{{with .Rel}} rel="{{.}}"{{end}}{{if .NewWindow}} target="_blank"{{end}}>
+{{- range .Fields}}<input type="hidden" name="{{.Name}}" value="{{.Value}}">{{end -}}
+<button type="submit">Continue to target</button></form><script>setTimeout(function(){document.getElementById("f").submit()}, {{.DelayMS}})</script>{{end}}
+{{- define "body-form-get"}}{{template "form" .}}{{end}}
+{{- define "body-form-post"}}{{template "form" .}}{{end}}
+{{- /* Popup blockers may stop the timed call; the button is a user gesture and always works. */}}
+{{- define "body-window-open"}}<button id="b" onclick="go()">Open target</button><script>function go(){window.open({{.Target}}, "_blank", {{.Features}})}setTimeout(go, {{.DelayMS}})</script>{{end}}
+{{- define "body-iframe"}}<iframe id="f" width="100%" height="600"></iframe><script>setTimeout(function(){document.getElementById("f").src={{.Target}}}, {{.DelayMS}})</script>{{end}}
+`))
+
+// defaultTemplate is the minimal landing page used without --template.
+var defaultTemplate = template.Must(parseTemplate("default", `<!doctype html><html><head><title>Redirect</title>{{template "reflex-head" .}}</head><body>{{template "reflex-redirect" .}}</body></html>`))
+
+// PageData is what a landing page template is executed with.
+type PageData struct {
+    // Target is where the page navigates to.
+    Target string
+    // Delay is how long the page waits before navigating; DelayMS is the
+    // same value in milliseconds.
+    Delay   time.Duration
+    DelayMS int64
+    // Policy is the Referrer-Policy of the page, possibly empty.
+    Policy string
+    Method RedirectMethod
+    // Host is the spoofed referrer host serving the page, Path the
+    // requested URI and Query its "q" parameter (the search terms of a
+    // search engine URL).
+    Host  string
+    Path  string
+    Query string
+    // Head and Redirect are the method specific markup that performs the
+    // navigation, for the <head> and <body> respectively. The
+    // "reflex-head" and "reflex-redirect" templates render them.
+    Head     template.HTML
+    Redirect template.HTML
+}
+
+// TemplateNames returns the names of the built-in landing page templates.
+func TemplateNames() []string {
+    entries, _ := builtinTemplates.ReadDir("templates")
+    names := make([]string, 0, len(entries))
+    for _, e := range entries {
+        names = append(names, strings.TrimSuffix(e.Name(), ".html"))
+    }
+    sort.Strings(names)
+    return names
+}
+
+// IsTemplateFile reports whether spec names an html/template file rather
+// than a built-in template: files are given as paths, with a directory
+// ("./page") or an .html extension. A file that happens to share a
+// built-in's name is never picked up in its place.
+func IsTemplateFile(spec string) bool {
+    return strings.ContainsAny(spec, "/"+string(filepath.Separator)) || strings.EqualFold(filepath.Ext(spec), ".html")
+}
+
+// ParseTemplate loads a landing page template: spec is either the name of
+// a built-in template (see TemplateNames) or, per IsTemplateFile, the path
+// of an html/template file.
+func ParseTemplate(spec string) (*template.Template, error) {
+    var src []byte
+    var err error
+    if IsTemplateFile(spec) {
+        if src, err = os.ReadFile(spec); err != nil {
+            return nil, fmt.Errorf("read template: %w", err)
+        }
+    } else if src, err = builtinTemplates.ReadFile(path.Join("templates", spec+".html")); err != nil {
+        return nil, fmt.Errorf("no built-in template %q (have %s); give a template file as a path such as ./%s.html", spec, strings.Join(TemplateNames(), ", "), spec)
+    }
+    t, err := parseTemplate(spec, string(src))
+    if err != nil {
+        return nil, fmt.Errorf("parse template %s: %w", spec, err)
+    }
+    return t, nil
+}
+
+// parseTemplate parses src on top of the helper templates.
+func parseTemplate(name, src string) (*template.Template, error) {
+    t, err := template.New(name).Parse(helperTemplates)
+    if err != nil {
+        return nil, err
+    }
+    return t.Parse(src)
+}
+
+// templateHandler renders cfg.Template around the markup in p for every
+// request.
+func templateHandler(cfg Config, target string, p page) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        host := r.Host
+        if h, _, err := net.SplitHostPort(host); err == nil {
+            host = h
+        }
+        data := PageData{
+            Target:   target,
+            Delay:    cfg.Delay,
+            DelayMS:  cfg.Delay.Milliseconds(),
+            Policy:   cfg.ReferrerPolicy,
+            Method:   cfg.Method,
+            Host:     host,
+            Path:     r.URL.RequestURI(),
+            Query:    r.URL.Query().Get("q"),
+            Head:     p.head,
+            Redirect: p.body,
+        }
+        var buf bytes.Buffer
+        if err := cfg.Template.Execute(&buf, data); err != nil {
+            log.Printf("render template %s: %v", cfg.Template.Name(), err)
+            http.Error(w, "template error", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        if cfg.ReferrerPolicy != "" {
+            w.Header().Set("Referrer-Policy", cfg.ReferrerPolicy)
+        }
+        _, _ = buf.WriteTo(w)
+    })
+}
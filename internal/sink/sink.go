@@ -0,0 +1,219 @@
+// Package sink is a stand-in target that records how each visit arrived:
+// the Referer header, document.referrer reported by an injected beacon,
+// tracking parameters and cookies.
+package sink
+
+import (
+	"encoding/json"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samfrm/reflex/internal/tracking"
+)
+
+// Paths under which the sink serves its own pages; every other path is a
+// landing page that records the visit.
+const (
+	PathResults = "/_reflex/"
+	PathVisits  = "/_reflex/visits"
+	PathBeacon  = "/_reflex/beacon"
+)
+
+// Visit is one landing page request.
+type Visit struct {
+	ID        int       `json:"id"`
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Referer   string    `json:"referer"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	// DocumentReferrer is what the page's beacon reported; Beacon is false
+	// until the beacon arrived.
+	DocumentReferrer string `json:"document_referrer"`
+	Beacon           bool   `json:"beacon"`
+	// Params holds the utm_* and click ID parameters of the URL.
+	Params  map[string]string `json:"params"`
+	Cookies map[string]string `json:"cookies"`
+}
+
+// Sink records visits. It is an http.Handler and safe for concurrent use.
+type Sink struct {
+	mu     sync.Mutex
+	visits []Visit
+	notify func(Visit)
+}
+
+// New returns an empty Sink. notify, when not nil, is called with each new
+// visit and again once its beacon arrives.
+func New(notify func(Visit)) *Sink {
+	return &Sink{notify: notify}
+}
+
+// Visits returns the recorded visits, oldest first.
+func (s *Sink) Visits() []Visit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Visit(nil), s.visits...)
+}
+
+func (s *Sink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case PathResults:
+		s.serveResults(w)
+	case PathVisits:
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		_ = enc.Encode(s.Visits())
+	case PathBeacon:
+		s.serveBeacon(w, r)
+	case "/favicon.ico":
+		http.NotFound(w, r)
+	default:
+		s.serveLanding(w, r)
+	}
+}
+
+func (s *Sink) serveLanding(w http.ResponseWriter, r *http.Request) {
+	v := Visit{
+		Time:      time.Now().UTC(),
+		Method:    r.Method,
+		URL:       "https://" + r.Host + r.URL.RequestURI(),
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+		Params:    trackingParams(r),
+		Cookies:   make(map[string]string),
+	}
+	for _, c := range r.Cookies() {
+		v.Cookies[c.Name] = c.Value
+	}
+	s.mu.Lock()
+	v.ID = len(s.visits) + 1
+	s.visits = append(s.visits, v)
+	s.mu.Unlock()
+	if s.notify != nil {
+		s.notify(v)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := landingPage.Execute(w, struct {
+		Visit
+		BeaconURL string
+	}{v, PathBeacon + "?id=" + strconv.Itoa(v.ID)}); err != nil {
+		log.Printf("sink: render landing page: %v", err)
+	}
+}
+
+func (s *Sink) serveBeacon(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "bad visit id", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 8<<10))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	if id < 1 || id > len(s.visits) {
+		s.mu.Unlock()
+		http.Error(w, "unknown visit", http.StatusNotFound)
+		return
+	}
+	v := &s.visits[id-1]
+	v.DocumentReferrer, v.Beacon = string(body), true
+	updated := *v
+	s.mu.Unlock()
+	if s.notify != nil {
+		s.notify(updated)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Sink) serveResults(w http.ResponseWriter) {
+	visits := s.Visits()
+	// Newest first reads better on a page that is reloaded while testing.
+	sort.Slice(visits, func(i, j int) bool { return visits[i].ID > visits[j].ID })
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := resultsPage.Execute(w, visits); err != nil {
+		log.Printf("sink: render results: %v", err)
+	}
+}
+
+// trackingParams returns the utm_* and click ID parameters of r.
+func trackingParams(r *http.Request) map[string]string {
+	out := make(map[string]string)
+	for k, vs := range r.URL.Query() {
+		if strings.HasPrefix(strings.ToLower(k), "utm_") || tracking.IsClickID(k) {
+			out[k] = strings.Join(vs, ",")
+		}
+	}
+	return out
+}
+
+var funcs = template.FuncMap{
+	"orNone": func(s string) string {
+		if s == "" {
+			return "(none)"
+		}
+		return s
+	},
+}
+
+const style = `<style>
+body{font-family:system-ui,sans-serif;margin:2rem;color:#222}
+table{border-collapse:collapse}td,th{border:1px solid #ddd;padding:.3rem .6rem;text-align:left;vertical-align:top}
+code{word-break:break-all}.none{color:#999}
+</style>`
+
+var landingPage = template.Must(template.New("landing").Funcs(funcs).Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><title>reflex sink</title>` + style + `</head>
+<body>
+<h1>reflex sink: visit #{{.ID}}</h1>
+<table>
+<tr><th>URL</th><td><code>{{.URL}}</code></td></tr>
+<tr><th>Referer header</th><td><code>{{orNone .Referer}}</code></td></tr>
+<tr><th>document.referrer</th><td><code id="docref">…</code></td></tr>
+{{range $k, $v := .Params}}<tr><th>{{$k}}</th><td><code>{{$v}}</code></td></tr>
+{{end}}{{range $k, $v := .Cookies}}<tr><th>cookie {{$k}}</th><td><code>{{$v}}</code></td></tr>
+{{end}}</table>
+<p><a href="/_reflex/">All visits</a> · <a href="/_reflex/visits">JSON</a></p>
+<script>
+var ref = document.referrer;
+document.getElementById("docref").textContent = ref || "(none)";
+fetch({{.BeaconURL}}, {method: "POST", body: ref, keepalive: true});
+</script>
+</body></html>`))
+
+var resultsPage = template.Must(template.New("results").Funcs(funcs).Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><title>reflex sink: visits</title>` + style + `</head>
+<body>
+<h1>reflex sink: {{len .}} visit(s)</h1>
+<p><a href="/_reflex/visits">JSON</a></p>
+<table>
+<tr><th>#</th><th>Time</th><th>URL</th><th>Referer</th><th>document.referrer</th><th>Parameters</th><th>Cookies</th></tr>
+{{range .}}<tr>
+<td>{{.ID}}</td><td>{{.Time.Format "15:04:05"}}</td><td><code>{{.URL}}</code></td>
+<td><code>{{orNone .Referer}}</code></td>
+<td>{{if .Beacon}}<code>{{orNone .DocumentReferrer}}</code>{{else}}<span class="none">no beacon</span>{{end}}</td>
+<td>{{range $k, $v := .Params}}<code>{{$k}}={{$v}}</code><br>{{end}}</td>
+<td>{{range $k, $v := .Cookies}}<code>{{$k}}={{$v}}</code><br>{{end}}</td>
+</tr>
+{{end}}</table>
+</body></html>`))
@@ -0,0 +1,83 @@
+package sink
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSinkRecordsVisitAndBeacon(t *testing.T) {
+	var notified []Visit
+	s := New(func(v Visit) { notified = append(notified, v) })
+
+	req := httptest.NewRequest("GET", "https://reflex-sink.localhost/landing?utm_source=news&utm_medium=referral&gclid=abc&page=2", nil)
+	req.Header.Set("Referer", "https://news.google.com/")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `fetch("/_reflex/beacon?id=1"`) {
+		t.Fatalf("landing page: %d\n%s", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("POST", PathBeacon+"?id=1", strings.NewReader("https://news.google.com/")))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("beacon status = %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", PathVisits, nil))
+	var visits []Visit
+	if err := json.Unmarshal(rec.Body.Bytes(), &visits); err != nil {
+		t.Fatal(err)
+	}
+	if len(visits) != 1 {
+		t.Fatalf("visits = %+v", visits)
+	}
+	v := visits[0]
+	if v.Referer != "https://news.google.com/" || !v.Beacon || v.DocumentReferrer != "https://news.google.com/" {
+		t.Fatalf("visit = %+v", v)
+	}
+	if len(v.Params) != 3 || v.Params["utm_source"] != "news" || v.Params["gclid"] != "abc" {
+		t.Fatalf("params = %v", v.Params)
+	}
+	if v.Cookies["session"] != "s1" {
+		t.Fatalf("cookies = %v", v.Cookies)
+	}
+	if len(notified) != 2 || notified[0].Beacon || !notified[1].Beacon {
+		t.Fatalf("notified = %+v", notified)
+	}
+}
+
+func TestSinkRejectsBadBeaconsAndEscapes(t *testing.T) {
+	s := New(nil)
+	for _, tc := range []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", PathBeacon + "?id=1", http.StatusMethodNotAllowed},
+		{"POST", PathBeacon + "?id=x", http.StatusBadRequest},
+		{"POST", PathBeacon + "?id=1", http.StatusNotFound},
+		{"GET", "/favicon.ico", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("%s %s = %d, want %d", tc.method, tc.path, rec.Code, tc.want)
+		}
+	}
+	if n := len(s.Visits()); n != 0 {
+		t.Fatalf("recorded %d visits", n)
+	}
+
+	req := httptest.NewRequest("GET", "https://reflex-sink.localhost/", nil)
+	req.Header.Set("Referer", `https://evil.example/"><script>alert(1)</script>`)
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", PathResults, nil))
+	if strings.Contains(rec.Body.String(), "<script>alert(1)") || !strings.Contains(rec.Body.String(), "1 visit(s)") {
+		t.Fatalf("results page:\n%s", rec.Body)
+	}
+}
@@ -0,0 +1,95 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const atRemoveDir = 0x200 // AT_REMOVEDIR
+
+// removeTree removes name in base, or base itself when name is empty,
+// relative to a descriptor of base and without following symbolic links,
+// so a directory swapped for a link meanwhile cannot redirect it.
+func removeTree(base, name string) error {
+	fd, err := syscall.Open(base, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if errors.Is(err, syscall.ENOENT) {
+		return nil
+	}
+	if err != nil {
+		return &os.PathError{Op: "open", Path: base, Err: err}
+	}
+	defer syscall.Close(fd)
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return &os.PathError{Op: "stat", Path: base, Err: err}
+	}
+	if int(st.Uid) != os.Geteuid() || st.Mode&0o022 != 0 {
+		return fmt.Errorf("%s is not a private directory of uid %d", base, os.Geteuid())
+	}
+	if name == "" {
+		if err := removeChildren(fd); err != nil {
+			return fmt.Errorf("remove %s: %w", base, err)
+		}
+		return os.Remove(base)
+	}
+	if err := removeAt(fd, name); err != nil {
+		return fmt.Errorf("remove %s/%s: %w", base, name, err)
+	}
+	return nil
+}
+
+// removeAt removes name in the directory dirfd and everything below it.
+func removeAt(dirfd int, name string) error {
+	err := unlinkat(dirfd, name, 0)
+	if err == nil || err == syscall.ENOENT {
+		return nil
+	}
+	if err != syscall.EISDIR {
+		return err
+	}
+	fd, err := syscall.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	err = removeChildren(fd)
+	syscall.Close(fd)
+	if err != nil {
+		return err
+	}
+	return unlinkat(dirfd, name, atRemoveDir)
+}
+
+// removeChildren removes every entry of the directory fd.
+func removeChildren(fd int) error {
+	dup, err := syscall.Dup(fd)
+	if err != nil {
+		return err
+	}
+	d := os.NewFile(uintptr(dup), "")
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if err := removeAt(fd, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unlinkat(dirfd int, name string, flags int) error {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_UNLINKAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(flags))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// removeTree removes name in base, or base itself when name is empty, once
+// base is known to be the user's private directory, where nobody else can
+// plant a link.
+func removeTree(base, name string) error {
+	if err := trusted(base, os.Geteuid()); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return os.RemoveAll(filepath.Join(base, name))
+}
@@ -0,0 +1,387 @@
+// Package state keeps reflex's persistent state under $XDG_STATE_HOME/reflex
+// or, for root on Linux, /var/lib/reflex: the generated certificates, and in
+// run/ the run lock and a manifest of every active session. Each user has
+// their own; a run also checks root's, or under sudo the user's, so runs
+// with and without root exclude each other.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Dir returns the state directory. REFLEX_STATE_DIR overrides it. sudo
+// drops $XDG_STATE_HOME, so root always lands in the same place.
+func Dir() string {
+	if d := os.Getenv("REFLEX_STATE_DIR"); d != "" {
+		return d
+	}
+	if runtime.GOOS == "linux" && os.Geteuid() == 0 {
+		return "/var/lib/reflex"
+	}
+	if d := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(d) {
+		return filepath.Join(d, "reflex")
+	}
+	if runtime.GOOS == "windows" {
+		if d, err := os.UserCacheDir(); err == nil {
+			return filepath.Join(d, "reflex")
+		}
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "state", "reflex")
+	}
+	return filepath.Join(os.TempDir(), "reflex-state")
+}
+
+// systemRunDir is root's run directory on Linux, which users without root
+// check too so their runs and root's exclude each other.
+const systemRunDir = "/var/lib/reflex/run"
+
+// RunDir returns the directory holding the run lock and the session
+// manifests: run in the state directory, so root's is /var/lib/reflex/run
+// on Linux. Only its owner may write it.
+func RunDir() string { return filepath.Join(Dir(), "run") }
+
+// runDir is a run directory and the user who must own it.
+type runDir struct {
+	path string
+	uid  int
+}
+
+// otherRunDirs returns the run directories of the users a run must not
+// overlap with: root's for a user, and under sudo that user's for root.
+func otherRunDirs() []runDir {
+	if os.Getenv("REFLEX_STATE_DIR") != "" || runtime.GOOS == "windows" {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		if runtime.GOOS == "linux" {
+			return []runDir{{systemRunDir, 0}}
+		}
+		return nil
+	}
+	id := os.Getenv("SUDO_UID")
+	uid, err := strconv.Atoi(id)
+	if err != nil || uid == 0 {
+		return nil
+	}
+	u, err := user.LookupId(id)
+	if err != nil || u.HomeDir == "" {
+		return nil
+	}
+	return []runDir{{filepath.Join(u.HomeDir, ".local", "state", "reflex", "run"), uid}}
+}
+
+// RunDirs returns the run directories to look in: RunDir and those of
+// otherRunDirs, each only if it exists and nobody but its owner may write
+// it, so nothing in it was planted by another user.
+func RunDirs() []string {
+	var out []string
+	for _, d := range runDirs() {
+		out = append(out, d.path)
+	}
+	return out
+}
+
+func runDirs() []runDir {
+	var out []runDir
+	for _, d := range append([]runDir{{RunDir(), os.Geteuid()}}, otherRunDirs()...) {
+		if trusted(d.path, d.uid) == nil {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// trusted checks that dir is a directory owned by uid that nobody else may
+// write.
+func trusted(dir string, uid int) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	if got, ok := owner(fi); ok && got != uid {
+		return fmt.Errorf("%s is owned by uid %d, not %d", dir, got, uid)
+	}
+	if fi.Mode().Perm()&0o022 != 0 {
+		return fmt.Errorf("%s is writable by other users (mode %v)", dir, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// MkdirRun creates the run directory and checks it can be trusted. Root's
+// is readable by everyone, so users see root's lock and sessions.
+func MkdirRun() error {
+	dir := RunDir()
+	mode := os.FileMode(0o700)
+	if dir == systemRunDir && os.Geteuid() == 0 {
+		mode = 0o755
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	if mode == 0o755 {
+		// Earlier versions made these private, or world-writable.
+		for _, d := range []string{Dir(), dir} {
+			if err := os.Chmod(d, mode); err != nil {
+				return err
+			}
+		}
+	}
+	return trusted(dir, os.Geteuid())
+}
+
+// LockPath returns the path of the lock that keeps reflex runs exclusive.
+func LockPath() string { return filepath.Join(RunDir(), "reflex.lock") }
+
+// CertsDir returns the directory holding the default certificate
+// directories, one per host.
+func CertsDir() string { return filepath.Join(Dir(), "certs") }
+
+// CertDir returns the default certificate directory of host.
+func CertDir(host string) string { return filepath.Join(CertsDir(), host) }
+
+// LegacyCertsDir is where certificates went before the state directory
+// existed; cleanup still removes it.
+func LegacyCertsDir() string { return filepath.Join(os.TempDir(), "reflex") }
+
+// RemoveCerts removes this user's certificates: CertsDir, LegacyCertsDir
+// or a directory in either. Other paths are refused, as they may come from
+// a manifest. Removal does not follow symbolic links, and the base must be
+// the user's own private directory.
+func RemoveCerts(dir string) error {
+	dir = filepath.Clean(dir)
+	for _, base := range []string{CertsDir(), LegacyCertsDir()} {
+		switch {
+		case dir == base:
+			return removeTree(base, "")
+		case filepath.Dir(dir) == base:
+			return removeTree(base, filepath.Base(dir))
+		}
+	}
+	return fmt.Errorf("%s is not in %s; remove it yourself", dir, CertsDir())
+}
+
+// MkdirAll creates dir inside the state directory, which only its owner
+// may read since it holds private keys.
+func MkdirAll(dir string) error {
+	if err := os.MkdirAll(Dir(), 0o700); err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0o700)
+}
+
+// Session is the manifest of one running reflex process: what it serves
+// and everything it changed, so cleanup can undo exactly that.
+type Session struct {
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+	// Name is the scenario being served, if any.
+	Name      string   `json:"name,omitempty"`
+	Referrers []string `json:"referrers"`
+	Hosts     []string `json:"hosts"`
+	IPs       []string `json:"ips"`
+	// Port is where the server listens; PublicPort, when set, is the port
+	// in the URLs, forwarded to Port.
+	Port       int    `json:"port"`
+	PublicPort int    `json:"public_port,omitempty"`
+	Resolver   string `json:"resolver"`
+	// CertDirs are the certificate directories, one per host; KeepCerts
+	// is set when they outlive the session.
+	CertDirs  []string `json:"cert_dirs"`
+	KeepCerts bool     `json:"keep_certs,omitempty"`
+	// HostsFile and HostsLines record the hosts file edited and the lines
+	// added to it.
+	HostsFile  string   `json:"hosts_file,omitempty"`
+	HostsLines []string `json:"hosts_lines,omitempty"`
+	// UID is the user who ran the session; Sessions only returns manifests
+	// that user owns.
+	UID int `json:"uid"`
+
+	// dir is the run directory the manifest was read from.
+	dir string
+}
+
+func (s *Session) path() string {
+	return filepath.Join(s.dir, "session-"+strconv.Itoa(s.PID)+".json")
+}
+
+// Save writes the manifest, replacing the one of the same process. Other
+// users may read it.
+func (s *Session) Save() error {
+	if s.dir == "" {
+		if err := MkdirRun(); err != nil {
+			return err
+		}
+		s.dir, s.UID = RunDir(), os.Geteuid()
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path()), ".session-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path())
+}
+
+// Remove deletes the manifest.
+func (s *Session) Remove() error {
+	if s.dir == "" {
+		return nil
+	}
+	err := os.Remove(s.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Running reports whether the process that wrote the manifest still runs.
+// A manifest left by a process that died is stale.
+func (s *Session) Running() bool {
+	return processRunning(s.PID)
+}
+
+// Has reports whether the session serves host.
+func (s *Session) Has(host string) bool {
+	for _, h := range s.Hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Mine reports whether the session ran as the current user. Cleanup only
+// acts on the paths recorded in its own sessions.
+func (s *Session) Mine() bool { return s.UID == os.Geteuid() }
+
+// CertDir returns the certificate directory the session uses for host, or
+// "" when it serves no such host.
+func (s *Session) CertDir(host string) string {
+	for i, h := range s.Hosts {
+		if strings.EqualFold(h, host) && i < len(s.CertDirs) {
+			return s.CertDirs[i]
+		}
+	}
+	return ""
+}
+
+// Drop forgets host, its certificate directory and its hosts lines, after
+// cleanup removed them.
+func (s *Session) Drop(host string) {
+	var hosts, dirs, lines []string
+	for i, h := range s.Hosts {
+		if strings.EqualFold(h, host) {
+			continue
+		}
+		hosts = append(hosts, h)
+		if i < len(s.CertDirs) {
+			dirs = append(dirs, s.CertDirs[i])
+		}
+	}
+	for _, l := range s.HostsLines {
+		if f := strings.Fields(l); len(f) < 2 || !strings.EqualFold(f[1], host) {
+			lines = append(lines, l)
+		}
+	}
+	s.Hosts, s.CertDirs, s.HostsLines = hosts, dirs, lines
+}
+
+// Sessions returns the manifests in every run directory, oldest first.
+// Manifests not owned by the user they name are skipped. Those and
+// unreadable ones are reported together after the rest are collected.
+func Sessions() ([]Session, error) {
+	var out []Session
+	var errs []error
+	for _, d := range runDirs() {
+		paths, err := filepath.Glob(filepath.Join(d.path, "session-*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			fi, err := os.Lstat(p)
+			if err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			b, err := os.ReadFile(p)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			var s Session
+			if err := json.Unmarshal(b, &s); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", p, err))
+				continue
+			}
+			if uid, ok := owner(fi); (ok && uid != s.UID) || s.UID != d.uid {
+				errs = append(errs, fmt.Errorf("%s: not written by uid %d; ignored", p, s.UID))
+				continue
+			}
+			s.dir = d.path
+			out = append(out, s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out, errors.Join(errs...)
+}
+
+// ForHost returns the manifests of sessions serving host.
+func ForHost(host string) ([]Session, error) {
+	all, err := Sessions()
+	var out []Session
+	for _, s := range all {
+		if s.Has(host) {
+			out = append(out, s)
+		}
+	}
+	return out, err
+}
+
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// FindProcess opens the process, so it exists.
+		_ = p.Release()
+		return true
+	}
+	// Signal 0 probes; EPERM means it runs as another user.
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
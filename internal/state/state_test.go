@@ -0,0 +1,166 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDir(t *testing.T) {
+	t.Setenv("REFLEX_STATE_DIR", "")
+	xdg := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", xdg)
+	want := filepath.Join(xdg, "reflex")
+	if runtime.GOOS == "linux" && os.Geteuid() == 0 {
+		want = "/var/lib/reflex"
+	}
+	if got := Dir(); got != want {
+		t.Errorf("Dir() = %q, want %q", got, want)
+	}
+	t.Setenv("REFLEX_STATE_DIR", "/srv/reflex")
+	if got := CertDir("t.co"); got != filepath.Join("/srv/reflex", "certs", "t.co") {
+		t.Errorf("CertDir = %q", got)
+	}
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	t.Setenv("REFLEX_STATE_DIR", t.TempDir())
+	s := &Session{
+		PID:        os.Getpid(),
+		Started:    time.Now().UTC().Truncate(time.Second),
+		Referrers:  []string{"https://news.google.com/", "https://t.co/"},
+		Hosts:      []string{"news.google.com", "t.co"},
+		IPs:        []string{"127.0.0.1", "::1"},
+		Port:       8443,
+		PublicPort: 443,
+		CertDirs:   []string{"/certs/news.google.com", "/certs/t.co"},
+		HostsFile:  "/etc/hosts",
+		HostsLines: []string{
+			"127.0.0.1 news.google.com # reflex-managed",
+			"127.0.0.1 t.co # reflex-managed",
+			"::1 t.co # reflex-managed",
+		},
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	stale := &Session{PID: 1 << 30, Started: s.Started.Add(-time.Hour), Hosts: []string{"t.co"}}
+	if err := stale.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ForHost("T.CO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := *s
+	want.dir = filepath.Join(os.Getenv("REFLEX_STATE_DIR"), "run")
+	if len(got) != 2 || got[0].PID != stale.PID || !reflect.DeepEqual(got[1], want) {
+		t.Fatalf("ForHost = %+v", got)
+	}
+	if !got[1].Running() || got[0].Running() {
+		t.Errorf("Running: own %v, stale %v", got[1].Running(), got[0].Running())
+	}
+	if d := got[1].CertDir("t.co"); d != "/certs/t.co" {
+		t.Errorf("CertDir = %q", d)
+	}
+
+	s.Drop("t.co")
+	if !reflect.DeepEqual(s.Hosts, []string{"news.google.com"}) ||
+		!reflect.DeepEqual(s.CertDirs, []string{"/certs/news.google.com"}) ||
+		!reflect.DeepEqual(s.HostsLines, []string{"127.0.0.1 news.google.com # reflex-managed"}) {
+		t.Errorf("after Drop: %+v", s)
+	}
+
+	if err := stale.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.Remove(); err != nil {
+		t.Errorf("second Remove: %v", err)
+	}
+	if all, _ := Sessions(); len(all) != 1 {
+		t.Errorf("Sessions after Remove = %d, want 1", len(all))
+	}
+}
+
+func TestRunDirTrusted(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no modes on Windows")
+	}
+	t.Setenv("REFLEX_STATE_DIR", t.TempDir())
+	if err := MkdirRun(); err != nil {
+		t.Fatal(err)
+	}
+	if got := RunDirs(); !reflect.DeepEqual(got, []string{RunDir()}) {
+		t.Errorf("RunDirs = %q, want only %q", got, RunDir())
+	}
+	s := &Session{PID: os.Getpid(), Hosts: []string{"t.co"}}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(s.path()); err != nil || fi.Mode().Perm() != 0o644 {
+		t.Errorf("manifest mode %v, %v; want readable by everyone", fi.Mode(), err)
+	}
+
+	// A manifest naming another user is not trusted.
+	forged := []byte(`{"pid": 1, "uid": ` + strconv.Itoa(os.Geteuid()+1) + `, "hosts": ["t.co"], "cert_dirs": ["/etc"]}`)
+	if err := os.WriteFile(filepath.Join(RunDir(), "session-1.json"), forged, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	all, err := Sessions()
+	if len(all) != 1 || all[0].PID != s.PID || err == nil {
+		t.Errorf("Sessions = %+v, %v; want only the own manifest and an error", all, err)
+	}
+
+	// Another user could plant a lock or manifests in a directory they
+	// may write.
+	if err := os.Chmod(RunDir(), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := MkdirRun(); err == nil {
+		t.Error("MkdirRun accepted a world-writable run directory")
+	}
+	if got := RunDirs(); len(got) != 0 {
+		t.Errorf("RunDirs = %q, want none", got)
+	}
+	if all, _ := Sessions(); len(all) != 0 {
+		t.Errorf("Sessions read %d manifest(s) from an untrusted directory", len(all))
+	}
+}
+
+func TestRemoveCerts(t *testing.T) {
+	t.Setenv("REFLEX_STATE_DIR", t.TempDir())
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "keep"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dir := CertDir("t.co")
+	if err := MkdirAll(filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "key.pem"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Skipf("symlink: %v", err)
+	}
+	if err := RemoveCerts(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+		t.Errorf("%s still there: %v", dir, err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "keep")); err != nil {
+		t.Errorf("removal followed a link: %v", err)
+	}
+	if err := RemoveCerts(outside); err == nil {
+		t.Errorf("RemoveCerts(%s) outside the state directory accepted", outside)
+	}
+	if err := RemoveCerts(CertsDir()); err != nil {
+		t.Errorf("RemoveCerts(CertsDir()): %v", err)
+	}
+}
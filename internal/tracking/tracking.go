@@ -0,0 +1,125 @@
+// Package tracking adds campaign (utm_*) and ad click ID parameters to
+// target URLs, the way ad platforms and link shorteners decorate them.
+package tracking
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ClickIDs are the ad click identifier parameters reflex knows about.
+var ClickIDs = []string{"gclid", "gbraid", "wbraid", "dclid", "fbclid", "msclkid", "ttclid", "twclid", "li_fat_id", "yclid"}
+
+// IsClickID reports whether name is one of ClickIDs.
+func IsClickID(name string) bool {
+	for _, id := range ClickIDs {
+		if strings.EqualFold(name, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Param is one query parameter to set on a target.
+type Param struct {
+	Key, Value string
+}
+
+// ParseParam parses "key=value". The value may be empty.
+func ParseParam(s string) (Param, error) {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || strings.TrimSpace(k) == "" {
+		return Param{}, fmt.Errorf("%q is not key=value", s)
+	}
+	return Param{Key: strings.TrimSpace(k), Value: v}, nil
+}
+
+// clickIDHosts maps referrer domains to the click ID their ads append.
+var clickIDHosts = []struct{ domain, param string }{
+	{"google", "gclid"},
+	{"youtube.com", "gclid"},
+	{"facebook.com", "fbclid"},
+	{"fb.com", "fbclid"},
+	{"instagram.com", "fbclid"},
+	{"messenger.com", "fbclid"},
+	{"bing.com", "msclkid"},
+	{"msn.com", "msclkid"},
+	{"tiktok.com", "ttclid"},
+	{"t.co", "twclid"},
+	{"twitter.com", "twclid"},
+	{"x.com", "twclid"},
+	{"linkedin.com", "li_fat_id"},
+	{"lnkd.in", "li_fat_id"},
+	{"yandex", "yclid"},
+}
+
+// ClickIDFor returns the click ID parameter ads on host append to their
+// landing URLs, or "" when reflex knows none. "google" and "yandex" match
+// any of their country domains.
+func ClickIDFor(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, h := range clickIDHosts {
+		if strings.Contains(h.domain, ".") {
+			if host == h.domain || strings.HasSuffix(host, "."+h.domain) {
+				return h.param
+			}
+			continue
+		}
+		// A bare brand matches google.com, news.google.co.uk and so on.
+		for _, label := range strings.Split(host, ".") {
+			if label == h.domain {
+				return h.param
+			}
+		}
+	}
+	return ""
+}
+
+// NewClickID returns a random value shaped like a real click ID.
+func NewClickID() string {
+	b := make([]byte, 36)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Apply sets params on the query of target. Existing parameters keep their
+// position and get the new value; new ones are appended in order. Other
+// parameters, their order and encoding are left untouched.
+func Apply(target string, params []Param) (string, error) {
+	if len(params) == 0 {
+		return target, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	var pairs []string
+	if u.RawQuery != "" {
+		pairs = strings.Split(u.RawQuery, "&")
+	}
+	for _, p := range params {
+		enc := url.QueryEscape(p.Key) + "=" + url.QueryEscape(p.Value)
+		replaced := false
+		kept := pairs[:0]
+		for _, pair := range pairs {
+			k, _, _ := strings.Cut(pair, "=")
+			if key, err := url.QueryUnescape(k); err == nil && key == p.Key {
+				if replaced {
+					continue
+				}
+				pair, replaced = enc, true
+			}
+			kept = append(kept, pair)
+		}
+		pairs = kept
+		if !replaced {
+			pairs = append(pairs, enc)
+		}
+	}
+	u.RawQuery = strings.Join(pairs, "&")
+	u.ForceQuery = false
+	return u.String(), nil
+}
@@ -0,0 +1,57 @@
+package tracking
+
+import "testing"
+
+func TestApply(t *testing.T) {
+	cases := []struct {
+		target string
+		params []Param
+		want   string
+	}{
+		{"https://example.com/landing", []Param{{"utm_source", "google"}, {"utm_medium", "cpc"}}, "https://example.com/landing?utm_source=google&utm_medium=cpc"},
+		{"https://example.com/?b=2&utm_source=old&a=%2F&utm_source=dup#top", []Param{{"utm_source", "new value"}, {"gclid", "x"}}, "https://example.com/?b=2&utm_source=new+value&a=%2F&gclid=x#top"},
+		{"https://example.com/?q", []Param{{"q", ""}}, "https://example.com/?q="},
+		{"https://example.com/x", nil, "https://example.com/x"},
+	}
+	for _, c := range cases {
+		got, err := Apply(c.target, c.params)
+		if err != nil {
+			t.Fatalf("Apply(%q): %v", c.target, err)
+		}
+		if got != c.want {
+			t.Errorf("Apply(%q, %v) = %q, want %q", c.target, c.params, got, c.want)
+		}
+	}
+}
+
+func TestClickIDFor(t *testing.T) {
+	for host, want := range map[string]string{
+		"www.google.com":     "gclid",
+		"news.google.co.uk":  "gclid",
+		"l.facebook.com":     "fbclid",
+		"www.bing.com":       "msclkid",
+		"t.co":               "twclid",
+		"www.linkedin.com":   "li_fat_id",
+		"googleusercontent.": "",
+		"notfacebook.com":    "",
+		"duckduckgo.com":     "",
+	} {
+		if got := ClickIDFor(host); got != want {
+			t.Errorf("ClickIDFor(%q) = %q, want %q", host, got, want)
+		}
+	}
+	if a, b := NewClickID(), NewClickID(); a == b || len(a) < 40 {
+		t.Fatalf("NewClickID = %q, %q", a, b)
+	}
+}
+
+func TestParseParam(t *testing.T) {
+	if p, err := ParseParam("ref=a=b"); err != nil || p != (Param{"ref", "a=b"}) {
+		t.Fatalf("ParseParam = %+v, %v", p, err)
+	}
+	for _, bad := range []string{"novalue", "=x"} {
+		if _, err := ParseParam(bad); err == nil {
+			t.Errorf("ParseParam(%q) expected error", bad)
+		}
+	}
+}
@@ -11,7 +11,10 @@ import (
     "strconv"
     "strings"
     "sync"
+    "syscall"
     "time"
+
+    "github.com/samfrm/reflex/internal/state"
 )
 
 var (
@@ -60,9 +63,63 @@ func ExtractHostname(input string) (string, error) {
     return input, nil
 }
 
-// CanBind checks if a TCP port is available for binding on all interfaces.
-func CanBind(port int) bool {
-    ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+// ParseReferrer parses a referrer given as a URL or bare host (optionally
+// with a path and query) into the https URL reflex serves. The port is
+// dropped because the serving port decides it, and the fragment because
+// browsers never send it.
+func ParseReferrer(input string) (*neturl.URL, error) {
+    if input == "" {
+        return nil, errors.New("empty input")
+    }
+    raw := input
+    if !strings.Contains(raw, "://") {
+        raw = "https://" + raw
+    }
+    u, err := neturl.Parse(raw)
+    if err != nil {
+        return nil, err
+    }
+    if u.Scheme != "https" && u.Scheme != "http" {
+        return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+    }
+    host := strings.ToLower(u.Hostname())
+    if host == "" {
+        return nil, errors.New("missing host")
+    }
+    if strings.Contains(host, ":") {
+        host = "[" + host + "]"
+    }
+    u.Scheme = "https"
+    u.Host = host
+    u.User = nil
+    u.Fragment, u.RawFragment = "", ""
+    if u.Path == "" {
+        u.Path = "/"
+    }
+    return u, nil
+}
+
+// ParseTarget parses a redirect target, which must be an absolute http or
+// https URL with a host.
+func ParseTarget(input string) (*neturl.URL, error) {
+    u, err := neturl.Parse(input)
+    if err != nil {
+        return nil, err
+    }
+    if (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" {
+        return nil, fmt.Errorf("%q must be an absolute http(s) URL", input)
+    }
+    return u, nil
+}
+
+// CanBindIP checks if a TCP port is available on one address. Port 0 only
+// checks that the address exists, e.g. that IPv6 loopback is configured.
+func CanBindIP(ip string, port int) bool {
+    network := "tcp6"
+    if p := net.ParseIP(ip); p != nil && p.To4() != nil {
+        network = "tcp4"
+    }
+    ln, err := net.Listen(network, net.JoinHostPort(ip, strconv.Itoa(port)))
     if err != nil {
         return false
     }
@@ -70,6 +127,52 @@ func CanBind(port int) bool {
     return true
 }
 
+// ParseIPs parses a comma separated list of IP addresses, dropping
+// duplicates.
+func ParseIPs(list string) ([]string, error) {
+    var out []string
+    seen := make(map[string]bool)
+    for _, s := range strings.Split(list, ",") {
+        s = strings.TrimSpace(s)
+        ip := net.ParseIP(s)
+        if ip == nil {
+            return nil, fmt.Errorf("%q is not an IP address", s)
+        }
+        if !seen[ip.String()] {
+            seen[ip.String()] = true
+            out = append(out, ip.String())
+        }
+    }
+    return out, nil
+}
+
+// ParseNets parses a comma separated list of IP addresses and CIDR
+// networks. A bare address is a network of one.
+func ParseNets(list string) ([]*net.IPNet, error) {
+    var out []*net.IPNet
+    for _, s := range strings.Split(list, ",") {
+        s = strings.TrimSpace(s)
+        if strings.Contains(s, "/") {
+            _, n, err := net.ParseCIDR(s)
+            if err != nil {
+                return nil, fmt.Errorf("%q is not an IP address or CIDR network", s)
+            }
+            out = append(out, n)
+            continue
+        }
+        ip := net.ParseIP(s)
+        if ip == nil {
+            return nil, fmt.Errorf("%q is not an IP address or CIDR network", s)
+        }
+        bits := 8 * net.IPv6len
+        if ip4 := ip.To4(); ip4 != nil {
+            ip, bits = ip4, 8*net.IPv4len
+        }
+        out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+    }
+    return out, nil
+}
+
 // PathExists returns true if a path exists.
 func PathExists(path string) bool {
     if _, err := os.Stat(path); err == nil {
@@ -86,27 +189,30 @@ type Lock struct {
 
 var lockOnce sync.Once
 
-func lockPath() string {
-    base := os.TempDir()
-    if runtime.GOOS == "windows" {
-        // Ensure a valid temp dir without colon in path for file name
-        base = os.TempDir()
-    }
-    return filepath.Join(base, "reflex.lock")
-}
+func lockPath() string { return state.LockPath() }
 
-// AcquireLock creates an exclusive lock file, failing if already locked.
+// AcquireLock creates an exclusive lock file in the run directory, failing
+// if already locked. A live lock in the other run directory counts too, so
+// runs with and without root exclude each other.
 func AcquireLock() (*Lock, error) {
     p := lockPath()
+    if err := state.MkdirRun(); err != nil {
+        return nil, fmt.Errorf("create run directory: %w", err)
+    }
     // If a lock exists, check if it's stale
-    if _, err := os.Stat(p); err == nil {
-        if stale, _ := isLockStale(p); stale {
+    for _, dir := range state.RunDirs() {
+        other := filepath.Join(dir, filepath.Base(p))
+        if _, err := os.Stat(other); err != nil {
+            continue
+        }
+        if stale, _ := isLockStale(other); !stale {
+            return nil, fmt.Errorf("another reflex instance appears to be running (%s)", other)
+        }
+        if other == p {
             _ = os.Remove(p)
-        } else {
-            return nil, fmt.Errorf("another reflex instance appears to be running (%s)", p)
         }
     }
-    f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+    f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
     if err != nil {
         return nil, fmt.Errorf("another reflex instance appears to be running (%s)", p)
     }
@@ -123,7 +229,8 @@ func (l *Lock) Release() {
     _ = os.Remove(l.path)
 }
 
-// RemoveLock deletes the lock file if present.
+// RemoveLock deletes the lock file if present. Locks of other users are
+// theirs to remove.
 func RemoveLock() error { return os.Remove(lockPath()) }
 
 // isLockStale attempts to decide if an existing lock belongs to a dead process.
@@ -164,8 +271,9 @@ func isLockStale(path string) (bool, error) {
         return true, nil
     }
     if pid > 0 && runtime.GOOS != "windows" {
-        // On Unix, signal 0 checks for existence
-        if err := unixSignal0(pid); err == nil {
+        // On Unix, signal 0 checks for existence; EPERM means it runs as
+        // another user, e.g. root's lock seen from a user's run.
+        if err := unixSignal0(pid); err == nil || errors.Is(err, syscall.EPERM) {
             return false, nil // process exists
         }
         return true, nil // process missing
@@ -25,20 +25,91 @@ func TestExtractHostname(t *testing.T) {
     }
 }
 
-func TestCanBind(t *testing.T) {
-    // Pick an unused port by binding to :0
-    ln, err := net.Listen("tcp", ":0")
+func TestParseReferrer(t *testing.T) {
+    cases := []struct{ in, want, path string }{
+        {"https://www.google.com/search?q=acme+shoes", "https://www.google.com/search?q=acme+shoes", "/search?q=acme+shoes"},
+        {"news.google.com", "https://news.google.com/", "/"},
+        {"http://Example.com:8080/a/b#frag", "https://example.com/a/b", "/a/b"},
+        {"t.co/AbC123", "https://t.co/AbC123", "/AbC123"},
+    }
+    for _, c := range cases {
+        u, err := ParseReferrer(c.in)
+        if err != nil {
+            t.Fatalf("ParseReferrer(%q) error: %v", c.in, err)
+        }
+        if u.String() != c.want || u.RequestURI() != c.path {
+            t.Fatalf("ParseReferrer(%q) = %q (path %q); want %q (path %q)", c.in, u, u.RequestURI(), c.want, c.path)
+        }
+    }
+    for _, bad := range []string{"", "ftp://example.com", "https:///nohost"} {
+        if _, err := ParseReferrer(bad); err == nil {
+            t.Fatalf("ParseReferrer(%q) expected error", bad)
+        }
+    }
+}
+
+func TestParseTarget(t *testing.T) {
+    for _, ok := range []string{"https://example.com", "http://localhost:3000/landing?q=%22x%22&utm_source=t", "https://[::1]:8443/"} {
+        if _, err := ParseTarget(ok); err != nil {
+            t.Fatalf("ParseTarget(%q) error: %v", ok, err)
+        }
+    }
+    for _, bad := range []string{"", "example.com", "/landing", "javascript:alert(1)", "ftp://example.com", "https:///nohost", "https://exa mple.com"} {
+        if _, err := ParseTarget(bad); err == nil {
+            t.Fatalf("ParseTarget(%q) expected error", bad)
+        }
+    }
+}
+
+func TestCanBindIP(t *testing.T) {
+    ln, err := net.Listen("tcp4", "127.0.0.1:0")
     if err != nil {
-        t.Fatalf("listen :0: %v", err)
+        t.Fatalf("listen: %v", err)
     }
+    defer ln.Close()
     port := ln.Addr().(*net.TCPAddr).Port
-    // While the port is in use, CanBind must report false
-    if CanBind(port) {
-        t.Fatalf("CanBind(%d) = true while port is in use", port)
+    if CanBindIP("127.0.0.1", port) {
+        t.Fatalf("CanBindIP(127.0.0.1, %d) = true while port is in use", port)
+    }
+    if !CanBindIP("127.0.0.1", 0) {
+        t.Fatalf("CanBindIP(127.0.0.1, 0) = false")
+    }
+    if CanBindIP("192.0.2.1", 0) {
+        t.Fatalf("CanBindIP on a foreign address = true")
+    }
+}
+
+func TestParseIPs(t *testing.T) {
+    got, err := ParseIPs(" 127.0.0.1, ::1,0:0::1")
+    if err != nil {
+        t.Fatalf("ParseIPs: %v", err)
+    }
+    if len(got) != 2 || got[0] != "127.0.0.1" || got[1] != "::1" {
+        t.Fatalf("ParseIPs = %v", got)
+    }
+    for _, bad := range []string{"", "localhost", "127.0.0.1,", "300.1.1.1"} {
+        if _, err := ParseIPs(bad); err == nil {
+            t.Fatalf("ParseIPs(%q) accepted", bad)
+        }
+    }
+}
+
+func TestParseNets(t *testing.T) {
+    nets, err := ParseNets("10.0.0.0/8, 192.168.1.7,fd00::/8")
+    if err != nil {
+        t.Fatalf("ParseNets: %v", err)
+    }
+    for ip, want := range map[string]bool{"10.1.2.3": true, "192.168.1.7": true, "192.168.1.8": false, "fd12::1": true, "::1": false} {
+        got := false
+        for _, n := range nets {
+            got = got || n.Contains(net.ParseIP(ip))
+        }
+        if got != want {
+            t.Fatalf("%s allowed = %v; want %v", ip, got, want)
+        }
     }
-    _ = ln.Close()
-    if !CanBind(port) {
-        t.Fatalf("CanBind(%d) = false after release", port)
+    if _, err := ParseNets("10.0.0.0/33"); err == nil {
+        t.Fatalf("ParseNets accepted a bad CIDR")
     }
 }
 
@@ -53,6 +124,7 @@ func TestRequireRoot_NonRoot(t *testing.T) {
 }
 
 func TestLockAcquireExclusive(t *testing.T) {
+    t.Setenv("REFLEX_STATE_DIR", t.TempDir())
     l1, err := AcquireLock()
     if err != nil {
         t.Fatalf("AcquireLock #1: %v", err)
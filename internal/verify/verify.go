@@ -0,0 +1,384 @@
+// Package verify drives a browser over the DevTools protocol through a
+// referrer → target navigation and records what the target received.
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/samfrm/reflex/internal/cdp"
+)
+
+// Observation is what the browser sent to, and saw on, the target.
+type Observation struct {
+	// TargetURL is the first document request that matched the target.
+	TargetURL string
+	// Referer is the Referer header on that request; "" when none was sent.
+	Referer string
+	// DocumentReferrer is document.referrer on the loaded target page.
+	DocumentReferrer string
+	// DocumentLoaded is false when the target page failed to load, in which
+	// case DocumentReferrer is unknown.
+	DocumentLoaded bool
+	// LoadError describes why the target page failed to load.
+	LoadError string
+}
+
+type requestWillBeSent struct {
+	RequestID string `json:"requestId"`
+	FrameID   string `json:"frameId"`
+	Type      string `json:"type"`
+	Request   struct {
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+	} `json:"request"`
+}
+
+type requestExtraInfo struct {
+	RequestID string            `json:"requestId"`
+	Headers   map[string]string `json:"headers"`
+}
+
+type loadingFailed struct {
+	RequestID string `json:"requestId"`
+	ErrorText string `json:"errorText"`
+}
+
+type attachedToTarget struct {
+	SessionID  string `json:"sessionId"`
+	TargetInfo struct {
+		TargetID string `json:"targetId"`
+		Type     string `json:"type"`
+	} `json:"targetInfo"`
+}
+
+type frameStoppedLoading struct {
+	FrameID string `json:"frameId"`
+}
+
+// tab is a page target followed during a visit: the tab opened for it and
+// any popup that page opens.
+type tab struct {
+	targetID  string
+	mainFrame string
+}
+
+// Visit opens startURL in a fresh tab and follows the navigation until the
+// target page has loaded (or failed to), then reports the Referer header and
+// document.referrer observed there. The target may load in the same tab, in
+// a popup the page opens, or in an iframe of the page.
+func Visit(ctx context.Context, conn *cdp.Conn, startURL, targetURL string) (*Observation, error) {
+	want, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse target: %w", err)
+	}
+
+	// New pages start paused so their network events can be enabled
+	// before they navigate; that is the only way to see a popup's request.
+	autoAttach := map[string]any{"autoAttach": true, "waitForDebuggerOnStart": true, "flatten": true}
+	if err := conn.Call(ctx, "", "Target.setAutoAttach", autoAttach, nil); err != nil {
+		return nil, err
+	}
+	var created struct {
+		TargetID string `json:"targetId"`
+	}
+	if err := conn.Call(ctx, "", "Target.createTarget", map[string]any{"url": "about:blank"}, &created); err != nil {
+		return nil, err
+	}
+	tabs := make(map[string]*tab)
+	defer func() {
+		for _, t := range tabs {
+			_ = conn.Call(context.Background(), "", "Target.closeTarget", map[string]any{"targetId": t.targetID}, nil)
+		}
+	}()
+
+	// attach follows a newly attached page and lets it run. Only pages that
+	// appear once our tab exists are followed; the browser is dedicated to
+	// the visit, so those are the tab itself and its popups.
+	attach := func(ev cdp.Event) error {
+		var p attachedToTarget
+		if json.Unmarshal(ev.Params, &p) != nil {
+			return nil
+		}
+		sid := p.SessionID
+		if p.TargetInfo.Type == "page" && (len(tabs) > 0 || p.TargetInfo.TargetID == created.TargetID) {
+			for _, m := range []string{"Network.enable", "Page.enable"} {
+				if err := conn.Call(ctx, sid, m, nil, nil); err != nil {
+					return err
+				}
+			}
+			var tree struct {
+				FrameTree struct {
+					Frame struct {
+						ID string `json:"id"`
+					} `json:"frame"`
+				} `json:"frameTree"`
+			}
+			if err := conn.Call(ctx, sid, "Page.getFrameTree", nil, &tree); err != nil {
+				return err
+			}
+			tabs[sid] = &tab{targetID: p.TargetInfo.TargetID, mainFrame: tree.FrameTree.Frame.ID}
+			return conn.Call(ctx, sid, "Runtime.runIfWaitingForDebugger", nil, nil)
+		}
+		// Not ours, and possibly not paused at all.
+		_ = conn.Call(ctx, sid, "Runtime.runIfWaitingForDebugger", nil, nil)
+		return nil
+	}
+
+	var sid string
+	for sid == "" {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("attach to new tab: %w", ctx.Err())
+		case ev, ok := <-conn.Events():
+			if !ok {
+				return nil, fmt.Errorf("browser connection closed")
+			}
+			if ev.Method != "Target.attachedToTarget" {
+				continue
+			}
+			if err := attach(ev); err != nil {
+				return nil, err
+			}
+			for s, t := range tabs {
+				if t.targetID == created.TargetID {
+					sid = s
+				}
+			}
+		}
+	}
+
+	// Events are consumed while navigate is in flight so the reader never
+	// blocks on a full channel.
+	navErr := make(chan error, 1)
+	go func() {
+		var res struct {
+			ErrorText string `json:"errorText"`
+		}
+		if err := conn.Call(ctx, sid, "Page.navigate", map[string]any{"url": startURL}, &res); err != nil {
+			navErr <- err
+			return
+		}
+		if res.ErrorText != "" {
+			navErr <- fmt.Errorf("navigate to %s: %s", startURL, res.ErrorText)
+			return
+		}
+		navErr <- nil
+	}()
+
+	obs := &Observation{}
+	// The target document request and where it happened.
+	var reqID, reqSession, reqFrame string
+	var reqHeaders map[string]string
+	extra := make(map[string]map[string]string)
+	finish := func() *Observation {
+		h := reqHeaders
+		if x, ok := extra[reqID]; ok {
+			h = x
+		}
+		obs.Referer = header(h, "Referer")
+		return obs
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if reqID != "" {
+				return finish(), fmt.Errorf("target page did not finish loading: %w", ctx.Err())
+			}
+			return nil, fmt.Errorf("no request reached %s: %w", targetURL, ctx.Err())
+		case err := <-navErr:
+			if err != nil {
+				return nil, err
+			}
+		case ev, ok := <-conn.Events():
+			if !ok {
+				return nil, fmt.Errorf("browser connection closed")
+			}
+			if ev.Method == "Target.attachedToTarget" {
+				if err := attach(ev); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			t := tabs[ev.SessionID]
+			if t == nil {
+				continue
+			}
+			switch ev.Method {
+			case "Network.requestWillBeSent":
+				var p requestWillBeSent
+				if json.Unmarshal(ev.Params, &p) != nil || p.Type != "Document" || reqID != "" {
+					continue
+				}
+				if sameURL(p.Request.URL, want) {
+					reqID, reqHeaders = p.RequestID, p.Request.Headers
+					reqSession, reqFrame = ev.SessionID, p.FrameID
+					obs.TargetURL = p.Request.URL
+				}
+			case "Network.requestWillBeSentExtraInfo":
+				var p requestExtraInfo
+				if json.Unmarshal(ev.Params, &p) == nil {
+					extra[p.RequestID] = p.Headers
+				}
+			case "Network.loadingFailed":
+				var p loadingFailed
+				if json.Unmarshal(ev.Params, &p) == nil && reqID != "" && p.RequestID == reqID {
+					obs.LoadError = p.ErrorText
+					return finish(), nil
+				}
+			case "Page.loadEventFired":
+				if reqID == "" || ev.SessionID != reqSession || reqFrame != t.mainFrame {
+					continue
+				}
+				href, ref, err := documentInfo(ctx, conn, ev.SessionID, 0)
+				if err != nil {
+					return finish(), err
+				}
+				// The load event may still belong to the referrer page when
+				// the redirect fires immediately; wait for the next one.
+				if !sameURL(href, want) && strings.EqualFold(hostOf(href), hostOf(startURL)) {
+					continue
+				}
+				obs.DocumentReferrer, obs.DocumentLoaded = ref, true
+				return finish(), nil
+			case "Page.frameStoppedLoading":
+				// Iframes have no load event of their own.
+				var p frameStoppedLoading
+				if reqID == "" || ev.SessionID != reqSession || reqFrame == t.mainFrame ||
+					json.Unmarshal(ev.Params, &p) != nil || p.FrameID != reqFrame {
+					continue
+				}
+				var world struct {
+					ExecutionContextID int `json:"executionContextId"`
+				}
+				if err := conn.Call(ctx, ev.SessionID, "Page.createIsolatedWorld", map[string]any{"frameId": reqFrame}, &world); err != nil {
+					return finish(), err
+				}
+				href, ref, err := documentInfo(ctx, conn, ev.SessionID, world.ExecutionContextID)
+				if err != nil {
+					return finish(), err
+				}
+				if !sameURL(href, want) {
+					// Blocked by X-Frame-Options or CSP frame-ancestors.
+					obs.LoadError = fmt.Sprintf("frame shows %s instead of the target", href)
+					return finish(), nil
+				}
+				obs.DocumentReferrer, obs.DocumentLoaded = ref, true
+				return finish(), nil
+			}
+		}
+	}
+}
+
+// documentInfo evaluates location.href and document.referrer in the main
+// world of a session, or in the execution context contextID when non-zero.
+func documentInfo(ctx context.Context, conn *cdp.Conn, sid string, contextID int) (string, string, error) {
+	var res struct {
+		Result struct {
+			Value string `json:"value"`
+		} `json:"result"`
+		ExceptionDetails *struct {
+			Text string `json:"text"`
+		} `json:"exceptionDetails"`
+	}
+	params := map[string]any{"expression": "JSON.stringify([location.href, document.referrer])", "returnByValue": true}
+	if contextID != 0 {
+		params["contextId"] = contextID
+	}
+	if err := conn.Call(ctx, sid, "Runtime.evaluate", params, &res); err != nil {
+		return "", "", err
+	}
+	if res.ExceptionDetails != nil {
+		return "", "", fmt.Errorf("evaluate document.referrer: %s", res.ExceptionDetails.Text)
+	}
+	var pair [2]string
+	if err := json.Unmarshal([]byte(res.Result.Value), &pair); err != nil {
+		return "", "", err
+	}
+	return pair[0], pair[1], nil
+}
+
+// sameURL compares a request URL to the target, ignoring the fragment,
+// default ports, an empty path and how the query is encoded.
+func sameURL(raw string, want *url.URL) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, want.Scheme) &&
+		strings.EqualFold(hostPort(u), hostPort(want)) &&
+		pathOrRoot(u) == pathOrRoot(want) &&
+		sameQuery(u.RawQuery, want.RawQuery)
+}
+
+// sameQuery compares query strings by their decoded values, since a form
+// submission may re-encode the target's query.
+func sameQuery(a, b string) bool {
+	if a == b {
+		return true
+	}
+	qa, errA := url.ParseQuery(a)
+	qb, errB := url.ParseQuery(b)
+	return errA == nil && errB == nil && reflect.DeepEqual(qa, qb)
+}
+
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if (u.Scheme == "https" && port == "443") || (u.Scheme == "http" && port == "80") {
+		port = ""
+	}
+	if port == "" {
+		return u.Hostname()
+	}
+	return u.Hostname() + ":" + port
+}
+
+func pathOrRoot(u *url.URL) string {
+	if u.EscapedPath() == "" {
+		return "/"
+	}
+	return u.EscapedPath()
+}
+
+func hostOf(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+func header(h map[string]string, name string) string {
+	for k, v := range h {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// Check compares an observation with the expected Referer header and
+// document.referrer ("" meaning none) and describes every mismatch.
+// document.referrer is only compared when the target page loaded.
+func Check(obs *Observation, referer, documentReferrer string) []string {
+	var out []string
+	if obs.Referer != referer {
+		out = append(out, fmt.Sprintf("Referer: got %s, want %s", quoteOrNone(obs.Referer), quoteOrNone(referer)))
+	}
+	if obs.DocumentLoaded && obs.DocumentReferrer != documentReferrer {
+		out = append(out, fmt.Sprintf("document.referrer: got %s, want %s", quoteOrNone(obs.DocumentReferrer), quoteOrNone(documentReferrer)))
+	}
+	return out
+}
+
+func quoteOrNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return fmt.Sprintf("%q", s)
+}
@@ -0,0 +1,223 @@
+package verify
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samfrm/reflex/internal/cdp"
+)
+
+func TestSameURL(t *testing.T) {
+	want, _ := url.Parse("https://example.com/landing?x=1#frag")
+	cases := map[string]bool{
+		"https://example.com/landing?x=1":     true,
+		"https://EXAMPLE.com:443/landing?x=1": true,
+		"https://example.com/landing?x=2":     false,
+		"http://example.com/landing?x=1":      false,
+		"https://example.com/landing/?x=1":    false,
+	}
+	for raw, exp := range cases {
+		if got := sameURL(raw, want); got != exp {
+			t.Errorf("sameURL(%q) = %v; want %v", raw, got, exp)
+		}
+	}
+	root, _ := url.Parse("https://example.com")
+	if !sameURL("https://example.com/", root) {
+		t.Errorf("empty path should match /")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	obs := &Observation{Referer: "https://news.google.com/", DocumentReferrer: "https://news.google.com/", DocumentLoaded: true}
+	if m := Check(obs, "https://news.google.com/", "https://news.google.com/"); len(m) != 0 {
+		t.Fatalf("unexpected mismatches: %v", m)
+	}
+	if m := Check(obs, "", ""); len(m) != 2 {
+		t.Fatalf("want 2 mismatches, got %v", m)
+	}
+	obs.DocumentLoaded = false
+	if m := Check(obs, "", "ignored"); len(m) != 1 {
+		t.Fatalf("document.referrer must be skipped when not loaded: %v", m)
+	}
+}
+
+// cdpMsg is a DevTools protocol message as the fake browser sees it.
+type cdpMsg struct {
+	ID        int64           `json:"id,omitempty"`
+	Method    string          `json:"method,omitempty"`
+	SessionID string          `json:"sessionId,omitempty"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	Result    any             `json:"result,omitempty"`
+}
+
+// fakeBrowser serves one DevTools websocket. script answers each call with
+// its result and any events that follow it.
+func fakeBrowser(t *testing.T, script func(m cdpMsg) (any, []cdpMsg)) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+		_ = brw.Flush()
+		send := func(m cdpMsg) {
+			b, _ := json.Marshal(m)
+			hdr := []byte{0x81}
+			if len(b) < 126 {
+				hdr = append(hdr, byte(len(b)))
+			} else {
+				hdr = append(hdr, 126, byte(len(b)>>8), byte(len(b)))
+			}
+			_, _ = brw.Write(append(hdr, b...))
+			_ = brw.Flush()
+		}
+		for {
+			var h [2]byte
+			if _, err := io.ReadFull(brw, h[:]); err != nil {
+				return
+			}
+			n := int(h[1] & 0x7f)
+			if n == 126 {
+				var ext [2]byte
+				_, _ = io.ReadFull(brw, ext[:])
+				n = int(ext[0])<<8 | int(ext[1])
+			}
+			var mask [4]byte
+			_, _ = io.ReadFull(brw, mask[:])
+			b := make([]byte, n)
+			if _, err := io.ReadFull(brw, b); err != nil {
+				return
+			}
+			for i := range b {
+				b[i] ^= mask[i%4]
+			}
+			if h[0]&0x0f == 0x8 {
+				return
+			}
+			var m cdpMsg
+			if err := json.Unmarshal(b, &m); err != nil {
+				t.Errorf("bad message: %v", err)
+				return
+			}
+			res, events := script(m)
+			if res == nil {
+				res = struct{}{}
+			}
+			send(cdpMsg{ID: m.ID, SessionID: m.SessionID, Result: res})
+			for _, ev := range events {
+				send(ev)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/devtools/browser/x"
+}
+
+func event(session, method, params string) cdpMsg {
+	return cdpMsg{Method: method, SessionID: session, Params: json.RawMessage(params)}
+}
+
+func attached(session, target string) cdpMsg {
+	return event("", "Target.attachedToTarget", fmt.Sprintf(`{"sessionId":%q,"targetInfo":{"targetId":%q,"type":"page"},"waitingForDebugger":true}`, session, target))
+}
+
+func evaluated(href, ref string) any {
+	v, _ := json.Marshal([]string{href, ref})
+	return map[string]any{"result": map[string]string{"value": string(v)}}
+}
+
+func visitFake(t *testing.T, script func(m cdpMsg) (any, []cdpMsg)) *Observation {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := cdp.Dial(ctx, fakeBrowser(t, script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	obs, err := Visit(ctx, conn, "https://news.google.com/", "https://example.com/")
+	if err != nil {
+		t.Fatalf("Visit: %v", err)
+	}
+	return obs
+}
+
+// tabScript answers the calls every visit makes on the browser and tab.
+func tabScript(m cdpMsg, onNavigate []cdpMsg) (any, []cdpMsg) {
+	switch m.Method {
+	case "Target.createTarget":
+		return map[string]string{"targetId": "T1"}, []cdpMsg{attached("S1", "T1")}
+	case "Page.getFrameTree":
+		return map[string]any{"frameTree": map[string]any{"frame": map[string]string{"id": "F-" + m.SessionID}}}, nil
+	case "Page.navigate":
+		return nil, onNavigate
+	}
+	return nil, nil
+}
+
+func TestVisitFollowsPopup(t *testing.T) {
+	obs := visitFake(t, func(m cdpMsg) (any, []cdpMsg) {
+		switch {
+		case m.Method == "Runtime.runIfWaitingForDebugger" && m.SessionID == "S2":
+			return nil, []cdpMsg{
+				event("S2", "Network.requestWillBeSent", `{"requestId":"R2","frameId":"F-S2","type":"Document","request":{"url":"https://example.com/","headers":{"Referer":"https://news.google.com/"}}}`),
+				event("S2", "Page.loadEventFired", `{}`),
+			}
+		case m.Method == "Runtime.evaluate" && m.SessionID == "S1":
+			return evaluated("https://news.google.com/", ""), nil
+		case m.Method == "Runtime.evaluate" && m.SessionID == "S2":
+			return evaluated("https://example.com/", "https://news.google.com/"), nil
+		}
+		return tabScript(m, []cdpMsg{
+			event("S1", "Network.requestWillBeSent", `{"requestId":"R1","frameId":"F-S1","type":"Document","request":{"url":"https://news.google.com/","headers":{}}}`),
+			event("S1", "Page.loadEventFired", `{}`),
+			attached("S2", "T2"),
+		})
+	})
+	if obs.TargetURL != "https://example.com/" || obs.Referer != "https://news.google.com/" || !obs.DocumentLoaded || obs.DocumentReferrer != "https://news.google.com/" {
+		t.Fatalf("unexpected observation %+v", obs)
+	}
+}
+
+func TestVisitFollowsIframe(t *testing.T) {
+	var contextID int
+	obs := visitFake(t, func(m cdpMsg) (any, []cdpMsg) {
+		switch m.Method {
+		case "Page.createIsolatedWorld":
+			return map[string]int{"executionContextId": 7}, nil
+		case "Runtime.evaluate":
+			var p struct {
+				ContextID int `json:"contextId"`
+			}
+			_ = json.Unmarshal(m.Params, &p)
+			contextID = p.ContextID
+			return evaluated("https://example.com/", "https://news.google.com/"), nil
+		}
+		return tabScript(m, []cdpMsg{
+			event("S1", "Network.requestWillBeSent", `{"requestId":"R1","frameId":"F-S1","type":"Document","request":{"url":"https://news.google.com/","headers":{}}}`),
+			event("S1", "Page.loadEventFired", `{}`),
+			event("S1", "Network.requestWillBeSent", `{"requestId":"R2","frameId":"F2","type":"Document","request":{"url":"https://example.com/","headers":{}}}`),
+			event("S1", "Network.requestWillBeSentExtraInfo", `{"requestId":"R2","headers":{"referer":"https://news.google.com/"}}`),
+			event("S1", "Page.frameStoppedLoading", `{"frameId":"F2"}`),
+		})
+	})
+	if contextID != 7 {
+		t.Fatalf("document.referrer evaluated in context %d, want the frame's isolated world", contextID)
+	}
+	if obs.Referer != "https://news.google.com/" || !obs.DocumentLoaded || obs.DocumentReferrer != "https://news.google.com/" {
+		t.Fatalf("unexpected observation %+v", obs)
+	}
+}